@@ -1,6 +1,9 @@
 function ajax(req) {
   var r = new XMLHttpRequest();
   r.open(req.method, req.url, true);
+  for (var name in req.headers) {
+    r.setRequestHeader(name, req.headers[name]);
+  }
   r.onreadystatechange = function () {
     if (r.readyState != 4 || r.status != 200) {
       if (req.failure) {
@@ -26,20 +29,23 @@ function fade(element) {
 }
 function moderate(com_id, hash, action, isso_host_script) {
   ajax({method: "POST",
-        url: isso_host_script + "/id/" + com_id + "/" + action + "/" + hash,
+        url: isso_host_script + "/id/" + com_id + "/" + action,
+        headers: {"X-Admin-Key": hash},
         success: function(){
             fade(document.getElementById("isso-" + com_id));
         }});
 }
 function edit(com_id, hash, author, email, website, comment, isso_host_script) {
   ajax({method: "POST",
-        url: isso_host_script + "/id/" + com_id + "/edit/" + hash,
+        url: isso_host_script + "/id/" + com_id + "/edit",
+        headers: {"X-Admin-Key": hash},
         data: JSON.stringify({text: comment,
                               author: author,
                               email: email,
                               website: website}),
         success: function(ret){
-          console.log("edit successed: ", ret);// TODO display some pretty stuff & update msg
+          // source is shown while editing, so rendered text is restored
+          document.getElementById('isso-text-' + com_id).innerHTML = JSON.parse(ret).text;
         },
         error: function(ret){
           console.log("Error: ", ret); // TODO flash msg/notif
@@ -69,17 +75,24 @@ function set_editable(elt_id) {
       elt.classList.add("editable");
     }
 }
-function start_edit(com_id) {
-    var editable_elements = ['isso-author-' + com_id,
-                             'isso-email-' + com_id,
-                             'isso-website-' + com_id,
-                             'isso-text-' + com_id];
-    for (var idx=0; idx <= editable_elements.length; idx++) {
-        set_editable(editable_elements[idx]);
-    }
-    document.getElementById('edit-btn-' + com_id).classList.toggle('hidden');
-    document.getElementById('stop-edit-btn-' + com_id).classList.toggle('hidden');
-    document.getElementById('send-edit-btn-' + com_id).classList.toggle('hidden');
+function start_edit(com_id, hash, isso_host_script) {
+  // text is edited as markdown source, rendered html would lose markup
+  ajax({method: "GET",
+        url: isso_host_script + "/id/" + com_id + "?plain=1",
+        headers: {"X-Admin-Key": hash},
+        success: function(ret){
+          var editable_elements = ['isso-author-' + com_id,
+                                   'isso-email-' + com_id,
+                                   'isso-website-' + com_id,
+                                   'isso-text-' + com_id];
+          for (var idx=0; idx <= editable_elements.length; idx++) {
+              set_editable(editable_elements[idx]);
+          }
+          document.getElementById('isso-text-' + com_id).textContent = JSON.parse(ret).text;
+          document.getElementById('edit-btn-' + com_id).classList.toggle('hidden');
+          document.getElementById('stop-edit-btn-' + com_id).classList.toggle('hidden');
+          document.getElementById('send-edit-btn-' + com_id).classList.toggle('hidden');
+        }});
 }
 function stop_edit(com_id, save_changes) {
     var editable_elements = ['isso-author-' + com_id,
@@ -97,7 +110,8 @@ function send_edit(com_id, hash, isso_host_script) {
     var author = document.getElementById('isso-author-' + com_id).textContent;
     var email = document.getElementById('isso-email-' + com_id).textContent;
     var website = document.getElementById('isso-website-' + com_id).textContent;
-    var comment = document.getElementById('isso-text-' + com_id).textContent;
+    // line breaks of source are kept only by innerText
+    var comment = document.getElementById('isso-text-' + com_id).innerText;
     edit(com_id, hash, author, email, website, comment, isso_host_script);
     stop_edit(com_id, true);
 }
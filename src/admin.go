@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const ADMIN_PATH = "/admin" // of all sites, regardless of their selectors
+const ADMIN_COOKIE_NAME = "admin-session"
+const ADMIN_PAGE_SIZE = 100
+const ADMIN_JS_FILE = "./js/admin.js" // of isso frontend, served as is
+const ADMIN_ALL_SITES = "all"
+const ADMIN_KEY_HEADER = "X-Admin-Key"
+const ADMIN_CLOCK_SKEW = time.Minute
+
+// names of comment modes in filters of admin area
+var adminStatuses = map[string]int{
+	"public":  MODE_PUBLIC,
+	"pending": MODE_PENDING,
+	"deleted": MODE_DELETED,
+}
+
+func getAdminStatusName(mode int) string {
+	for name, statusMode := range adminStatuses {
+		if statusMode == mode {
+			return name
+		}
+	}
+	return strconv.Itoa(mode)
+}
+
+// AdminAuth checks password of site owner and signs sessions of admin area with session key
+type AdminAuth struct {
+	password   string
+	sessionKey string
+	sessionTtl time.Duration
+	secure     bool // cookie is sent only over https
+}
+
+func NewAdminAuth(config ApplicationConfig, sessionKey string) *AdminAuth {
+	sessionTtl := config.Admin.SessionTtl
+	if sessionTtl <= 0 {
+		sessionTtl = DefaultAdminConfig().SessionTtl
+	}
+	return &AdminAuth{
+		password:   config.Admin.Password,
+		sessionKey: sessionKey,
+		sessionTtl: sessionTtl,
+		secure:     strings.HasPrefix(config.Server.PublicUrl, "https://"),
+	}
+}
+
+// sign returns HMAC of value for purpose, so signatures of sessions and comment keys can't replace each other
+func (auth *AdminAuth) sign(purpose string, value string) string {
+	mac := hmac.New(sha256.New, []byte(auth.sessionKey))
+	fmt.Fprintf(mac, "admin-%v:%v", purpose, value)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (auth *AdminAuth) CheckPassword(password string) bool {
+	return auth.password != "" && hmac.Equal([]byte(password), []byte(auth.password))
+}
+
+// NewSession returns value of session cookie, <issued time>.<nonce>.<signature>
+func (auth *AdminAuth) NewSession(now time.Time) string {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	value := strconv.FormatInt(now.Unix(), 10) + "." + hex.EncodeToString(nonce)
+	return value + "." + auth.sign("session", value)
+}
+
+func (auth *AdminAuth) VerifySession(session string, now time.Time) bool {
+	parts := strings.SplitN(session, ".", 3)
+	if len(parts) != 3 {
+		return false
+	}
+	value := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(auth.sign("session", value))) {
+		return false
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	// clocks of replicas may differ a bit
+	issuedTime := time.Unix(issued, 0)
+	return issuedTime.Before(now.Add(ADMIN_CLOCK_SKEW)) && now.Before(issuedTime.Add(auth.sessionTtl))
+}
+
+// IsAdmin checks session cookie of admin console
+func (auth *AdminAuth) IsAdmin(c *gin.Context) bool {
+	session, err := c.Cookie(ADMIN_COOKIE_NAME)
+	return err == nil && auth.VerifySession(session, time.Now())
+}
+
+// IsApiClient checks password in Authorization header, API doesn't accept cookies, so it can't be used by CSRF
+func (auth *AdminAuth) IsApiClient(c *gin.Context) bool {
+	return auth.CheckPassword(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+}
+
+// CommentKey is sent by admin.js in header, it is known only to pages of admin console
+func (auth *AdminAuth) CommentKey(site string, commentId int64) string {
+	return auth.sign("comment", fmt.Sprintf("%v:%v", site, commentId))
+}
+
+func (auth *AdminAuth) setSessionCookie(c *gin.Context, value string, maxAge int) {
+	cookie := http.Cookie{
+		Name:     ADMIN_COOKIE_NAME,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   auth.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	c.Header("Set-Cookie", cookie.String())
+}
+
+// parseAdminQuery reads status, uri, limit and offset of API or page of console
+func parseAdminQuery(c *gin.Context) (AdminQuery, error) {
+	query := AdminQuery{Uri: c.Query("uri"), Limit: ADMIN_PAGE_SIZE}
+	if status := c.Query("status"); status != "" && status != "all" {
+		mode, exists := adminStatuses[status]
+		if !exists {
+			return query, fmt.Errorf("invalid status: %v", status)
+		}
+		query.Mode = mode
+	}
+	var err error
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = parseLimit(limit); err != nil {
+			return query, err
+		}
+	}
+	if offset := c.Query("offset"); offset != "" {
+		query.Offset, err = strconv.Atoi(offset)
+		if err != nil || query.Offset < 0 {
+			return query, fmt.Errorf("invalid offset: %v", offset)
+		}
+	}
+	return query, nil
+}
+
+// adminSite is site managed in admin area
+type adminSite struct {
+	name  string
+	logic CommentsLogicInterface
+}
+
+// selectAdminSites returns site by name, all sites for empty name
+func selectAdminSites(sites []adminSite, name string) ([]adminSite, error) {
+	if name == "" || name == ADMIN_ALL_SITES {
+		return sites, nil
+	}
+	for _, site := range sites {
+		if site.name == name {
+			return []adminSite{site}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown site: %v", name)
+}
+
+// findAdminComments merges newest comments of sites
+func findAdminComments(sites []adminSite, query AdminQuery) (int, []AdminCommentModel, error) {
+	siteQuery := query
+	if len(sites) > 1 {
+		// shown comments may be from any site
+		siteQuery.Offset = 0
+		if query.Limit >= 0 {
+			siteQuery.Limit = query.Offset + query.Limit
+		}
+	}
+	total := 0
+	res := make([]AdminCommentModel, 0)
+	for _, site := range sites {
+		siteTotal, comments, err := site.logic.FindComments(siteQuery)
+		if err != nil {
+			return 0, nil, err
+		}
+		total += siteTotal
+		for _, comment := range comments {
+			res = append(res, AdminCommentModel{Site: site.name, Comment: comment, Uri: comment.Uri})
+		}
+	}
+	if len(sites) <= 1 {
+		return total, res, nil
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Comment.Created > res[j].Comment.Created
+	})
+	if query.Offset >= len(res) {
+		return total, make([]AdminCommentModel, 0), nil
+	}
+	res = res[query.Offset:]
+	if query.Limit >= 0 && len(res) > query.Limit {
+		res = res[:query.Limit]
+	}
+	return total, res, nil
+}
+
+// getAdminThreads merges threads of sites, last commented first
+func getAdminThreads(sites []adminSite) ([]ThreadModel, error) {
+	res := make([]ThreadModel, 0)
+	for _, site := range sites {
+		threads, err := site.logic.GetThreads()
+		if err != nil {
+			return nil, err
+		}
+		for _, thread := range threads {
+			thread.Site = site.name
+			res = append(res, thread)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Latest > res[j].Latest
+	})
+	return res, nil
+}
+
+var adminPageTemplate = template.Must(template.New("admin").Funcs(template.FuncMap{
+	"status": getAdminStatusName,
+	"date": func(created float64) string {
+		return time.Unix(int64(created), 0).UTC().Format("2006-01-02 15:04")
+	},
+	"text": func(comment *CommentModelOutput) template.HTML {
+		// sanitized html of comment
+		return template.HTML(comment.Text)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="{{.Base}}/admin/css/isso.css">
+<link rel="stylesheet" href="{{.Base}}/admin/css/admin.css">
+<script src="{{.Base}}/admin/admin.js"></script>
+</head>
+<body>
+<div class="wrapper">
+<div class="header"><header><h1>{{.Title}}</h1>
+{{if not .Login}}<form method="post" action="{{.Base}}/admin/logout"><a href="{{.Base}}/admin?site={{.Site}}">Comments</a> <a href="{{.Base}}/admin/threads?site={{.Site}}">Threads</a> <button type="submit">Log out</button></form>{{end}}
+</header></div>
+<div class="outer">
+{{if .Error}}<p class="note">{{.Error}}</p>{{end}}
+{{if .Login}}
+<div id="login"><form method="post" action="{{.Base}}/admin">
+<input type="password" name="password" placeholder="Password" autofocus>
+<button type="submit">Log in</button>
+</form></div>
+{{else if .ShowThreads}}
+{{if .Sites}}<p class="filters">{{range .Sites}}<a class="label{{if eq . $.Site}} active{{end}}" href="{{$.Base}}/admin/threads?site={{.}}">{{.}}</a> {{end}}</p>{{end}}
+<table>
+<tr>{{if .Sites}}<th>Site</th>{{end}}<th>Page</th><th>Comments</th><th>Pending</th><th>Latest</th></tr>
+{{range .Threads}}<tr class="thread-title">{{if $.Sites}}<td>{{.Site}}</td>{{end}}<td><a href="{{$.Base}}/admin?site={{.Site}}&uri={{.Uri}}">{{.Uri}}</a></td><td>{{.Comments}}</td><td>{{.Pending}}</td><td>{{date .Latest}}</td></tr>
+{{end}}</table>
+{{else}}
+{{if .Sites}}<p class="filters">{{range .Sites}}<a class="label{{if eq . $.Site}} active{{end}}" href="{{$.Base}}/admin?site={{.}}&status={{$.Status}}">{{.}}</a> {{end}}</p>{{end}}
+<form class="filters" method="get" action="{{.Base}}/admin">
+{{range .Statuses}}<a class="label{{if eq . $.Status}} active{{end}}" href="{{$.Base}}/admin?site={{$.Site}}&status={{.}}&uri={{$.Uri}}">{{.}}</a> {{end}}
+<input type="hidden" name="site" value="{{.Site}}">
+<input type="hidden" name="status" value="{{.Status}}">
+<input type="text" name="uri" value="{{.Uri}}" placeholder="Page">
+<button type="submit">Filter</button>
+</form>
+<p class="note">{{.Total}} comments</p>
+{{range .Comments}}{{$id := .Comment.Id}}<div class="isso-comment group" id="isso-{{$id}}">
+<div class="isso-text-wrapper">
+<div class="isso-comment-header">
+<span class="label label-{{if eq (status .Comment.Mode) "pending"}}pending{{else}}valid{{end}}">{{status .Comment.Mode}}</span>
+{{if $.Sites}}<span class="label">{{.Site}}</span>{{end}}
+<a href="{{$.Base}}/admin?site={{.Site}}&uri={{.Uri}}">{{.Uri}}</a> #{{$id}},
+<span class="author" id="isso-author-{{$id}}">{{if .Comment.Author}}{{.Comment.Author}}{{end}}</span>
+<span id="isso-website-{{$id}}">{{if .Comment.Website}}{{.Comment.Website}}{{end}}</span>
+<span id="isso-email-{{$id}}" class="hidden"></span>
+<span class="note">{{date .Comment.Created}}</span>
+</div>
+<div class="isso-text" id="isso-text-{{$id}}">{{text .Comment}}</div>
+{{if ne (status .Comment.Mode) "deleted"}}<div class="isso-comment-footer">
+{{if eq (status .Comment.Mode) "pending"}}<a href="#" onclick="validate_com({{$id}}, {{.Key}}, {{.ActionBase}}); return false;">Approve</a>{{end}}
+<a href="#" id="edit-btn-{{$id}}" onclick="start_edit({{$id}}, {{.Key}}, {{.ActionBase}}); return false;">Edit</a>
+<a href="#" id="stop-edit-btn-{{$id}}" class="hidden" onclick="stop_edit({{$id}}, false); return false;">Cancel</a>
+<a href="#" id="send-edit-btn-{{$id}}" class="hidden" onclick="send_edit({{$id}}, {{.Key}}, {{.ActionBase}}); return false;">Save</a>
+<a href="#" onclick="delete_com({{$id}}, {{.Key}}, {{.ActionBase}}); return false;">Delete</a>
+</div>{{end}}
+</div>
+</div>
+{{end}}
+<div class="pagination">{{if .PrevUrl}}<a href="{{.PrevUrl}}">Previous</a>{{end}} {{if .NextUrl}}<a href="{{.NextUrl}}">Next</a>{{end}}</div>
+{{end}}
+</div>
+</div>
+</body>
+</html>
+`))
+
+type adminComment struct {
+	AdminCommentModel
+	Key        string // for admin.js
+	ActionBase string // admin.js appends /id/<id>/<action> to it
+}
+
+type adminPage struct {
+	Title string
+	Base  string // relative path to root, so console works behind proxy with path prefix
+	Error string
+	Login bool
+	Sites []string // for filters, empty with single site
+	Site  string
+
+	ShowThreads bool
+	Threads     []ThreadModel
+
+	Statuses []string
+	Status   string
+	Uri      string
+	Total    int
+	Comments []adminComment
+	PrevUrl  string
+	NextUrl  string
+}
+
+func renderAdminPage(c *gin.Context, status int, page adminPage) {
+	var buffer bytes.Buffer
+	if err := adminPageTemplate.Execute(&buffer, page); err != nil {
+		log.Printf("Unable to render admin page: %v\n", err.Error())
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(status, "text/html; charset=utf-8", buffer.Bytes())
+}
+
+// getAdminPageUrl returns link to other page of comments with same filters
+func getAdminPageUrl(base string, site string, status string, uri string, offset int) string {
+	values := url.Values{}
+	values.Set("site", site)
+	values.Set("status", status)
+	values.Set("uri", uri)
+	values.Set("offset", strconv.Itoa(offset))
+	return base + "/admin?" + values.Encode()
+}
+
+// redirectRelative keeps location relative, because gin makes it absolute without path prefix of proxy
+func redirectRelative(c *gin.Context, location string) {
+	c.Header("Location", location)
+	c.Status(http.StatusSeeOther)
+}
+
+// NewAdminApp serves console of site owner for all sites, SitesRouter passes requests of /admin to it
+func NewAdminApp(config ApplicationConfig, sites []adminSite) *gin.Engine {
+	r := gin.Default()
+	if err := r.SetTrustedProxies(config.Server.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err.Error())
+	}
+	sessionKey := config.SessionKey
+	if sessionKey == "" {
+		// admin logs in again after restart
+		sessionKey = GenerateSessionKey()
+	}
+	addAdminRoutes(r, NewAdminAuth(config, sessionKey), sites)
+	return r
+}
+
+// addAdminRoutes adds console of site owner, API for scripts and routes of isso's admin.js
+func addAdminRoutes(r *gin.Engine, auth *AdminAuth, sites []adminSite) {
+	siteNames := []string(nil)
+	if len(sites) > 1 {
+		siteNames = append(siteNames, ADMIN_ALL_SITES)
+		for _, site := range sites {
+			siteNames = append(siteNames, site.name)
+		}
+	}
+	// console pages are at /admin and /admin/<page>
+	requireAdmin := func(c *gin.Context, base string) bool {
+		if !auth.IsAdmin(c) {
+			renderAdminPage(c, http.StatusUnauthorized, adminPage{Title: "Log in", Base: base, Login: true})
+			return false
+		}
+		return true
+	}
+	newPage := func(c *gin.Context, title string, base string) adminPage {
+		page := adminPage{Title: title, Base: base, Sites: siteNames}
+		if len(sites) > 1 {
+			page.Site = c.DefaultQuery("site", ADMIN_ALL_SITES)
+		}
+		return page
+	}
+
+	r.StaticFile("/admin/admin.js", ADMIN_JS_FILE)
+	r.Static("/admin/css", "./static/css")
+	r.GET("/admin", func(c *gin.Context) {
+		if !requireAdmin(c, ".") {
+			return
+		}
+		page := newPage(c, "Comments", ".")
+		page.Statuses = []string{"all", "pending", "public", "deleted"}
+		page.Status = c.DefaultQuery("status", "all")
+		page.Uri = c.Query("uri")
+		selected, err := selectAdminSites(sites, page.Site)
+		if err != nil {
+			page.Error = err.Error()
+			renderAdminPage(c, http.StatusUnprocessableEntity, page)
+			return
+		}
+		query, err := parseAdminQuery(c)
+		if err != nil {
+			page.Error = err.Error()
+			renderAdminPage(c, http.StatusUnprocessableEntity, page)
+			return
+		}
+		total, comments, err := findAdminComments(selected, query)
+		if err != nil {
+			page.Error = "Unable to load comments"
+			renderAdminPage(c, http.StatusInternalServerError, page)
+			return
+		}
+		page.Total = total
+		for _, comment := range comments {
+			page.Comments = append(page.Comments, adminComment{
+				AdminCommentModel: comment,
+				Key:               auth.CommentKey(comment.Site, comment.Comment.Id),
+				ActionBase:        page.Base + "/admin/sites/" + url.PathEscape(comment.Site),
+			})
+		}
+		if query.Limit > 0 && query.Offset > 0 {
+			prevOffset := query.Offset - query.Limit
+			if prevOffset < 0 {
+				prevOffset = 0
+			}
+			page.PrevUrl = getAdminPageUrl(page.Base, page.Site, page.Status, page.Uri, prevOffset)
+		}
+		if query.Limit > 0 && query.Offset+query.Limit < total {
+			page.NextUrl = getAdminPageUrl(page.Base, page.Site, page.Status, page.Uri, query.Offset+query.Limit)
+		}
+		renderAdminPage(c, 200, page)
+	})
+	r.POST("/admin", func(c *gin.Context) {
+		if !auth.CheckPassword(c.PostForm("password")) {
+			log.Printf("Failed login to admin area from %v\n", c.ClientIP())
+			renderAdminPage(c, http.StatusForbidden, adminPage{Title: "Log in", Base: ".", Login: true, Error: "Wrong password"})
+			return
+		}
+		auth.setSessionCookie(c, auth.NewSession(time.Now()), int(auth.sessionTtl.Seconds()))
+		redirectRelative(c, "admin")
+	})
+	r.POST("/admin/logout", func(c *gin.Context) {
+		auth.setSessionCookie(c, "", -1)
+		redirectRelative(c, "../admin")
+	})
+	r.GET("/admin/threads", func(c *gin.Context) {
+		if !requireAdmin(c, "..") {
+			return
+		}
+		page := newPage(c, "Threads", "..")
+		page.ShowThreads = true
+		selected, err := selectAdminSites(sites, page.Site)
+		if err != nil {
+			page.Error = err.Error()
+			renderAdminPage(c, http.StatusUnprocessableEntity, page)
+			return
+		}
+		threads, err := getAdminThreads(selected)
+		if err != nil {
+			page.Error = "Unable to load threads"
+			renderAdminPage(c, http.StatusInternalServerError, page)
+			return
+		}
+		page.Threads = threads
+		if len(threads) == 0 {
+			page.Error = "No comments yet"
+		}
+		renderAdminPage(c, 200, page)
+	})
+
+	// siteHandler passes logic of site from path to handler of comment
+	siteHandler := func(handler func(c *gin.Context, site adminSite, commentId int64)) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			selected, err := selectAdminSites(sites, c.Param("site"))
+			if err != nil || c.Param("site") == ADMIN_ALL_SITES {
+				c.PureJSON(http.StatusNotFound, gin.H{
+					"error": "unknown site",
+				})
+				return
+			}
+			commentId, isValid := parseCommentId(c)
+			if !isValid {
+				return
+			}
+			handler(c, selected[0], commentId)
+		}
+	}
+
+	// NB: admin.js sends requests to paths of isso under /admin/sites/<site>, but hash of comment is replaced
+	// with its key in header, so keys are not written to access log
+	adminJsHandler := func(action func(c *gin.Context, site adminSite, commentId int64) (*CommentModelOutput, error)) gin.HandlerFunc {
+		return siteHandler(func(c *gin.Context, site adminSite, commentId int64) {
+			if !auth.IsAdmin(c) || !hmac.Equal([]byte(c.GetHeader(ADMIN_KEY_HEADER)), []byte(auth.CommentKey(site.name, commentId))) {
+				c.PureJSON(http.StatusForbidden, gin.H{
+					"error": "Not authorized to administrate comments",
+				})
+				return
+			}
+			comment, err := action(c, site, commentId)
+			if err != nil {
+				respondError(c, getModificationErrorStatus(err), err)
+				return
+			}
+			c.PureJSON(200, comment)
+		})
+	}
+	r.GET("/admin/sites/:site/id/:commentId", adminJsHandler(func(c *gin.Context, site adminSite, commentId int64) (*CommentModelOutput, error) {
+		// source of text for editing with plain=1
+		return site.logic.GetComment(commentId, c.Query("plain") == "1")
+	}))
+	r.POST("/admin/sites/:site/id/:commentId/activate", adminJsHandler(func(c *gin.Context, site adminSite, commentId int64) (*CommentModelOutput, error) {
+		return site.logic.ApproveComment(commentId)
+	}))
+	r.POST("/admin/sites/:site/id/:commentId/delete", adminJsHandler(func(c *gin.Context, site adminSite, commentId int64) (*CommentModelOutput, error) {
+		return site.logic.AdminDeleteComment(commentId)
+	}))
+	r.POST("/admin/sites/:site/id/:commentId/edit", adminJsHandler(func(c *gin.Context, site adminSite, commentId int64) (*CommentModelOutput, error) {
+		// email is sent by admin.js too, but it is not stored
+		editData := CommentModelEdit{}
+		if err := c.ShouldBindJSON(&editData); err != nil {
+			return nil, fmt.Errorf("invalid input model: %w", err)
+		}
+		return site.logic.AdminEditComment(commentId, &editData)
+	}))
+
+	api := r.Group("/admin/api", func(c *gin.Context) {
+		if !auth.IsApiClient(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "Not authorized to administrate comments",
+			})
+		}
+	})
+	api.GET("/comments", func(c *gin.Context) {
+		selected, err := selectAdminSites(sites, c.Query("site"))
+		if err != nil {
+			c.PureJSON(http.StatusUnprocessableEntity, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		query, err := parseAdminQuery(c)
+		if err != nil {
+			c.PureJSON(http.StatusUnprocessableEntity, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		total, comments, err := findAdminComments(selected, query)
+		if err != nil {
+			c.PureJSON(http.StatusInternalServerError, gin.H{
+				"error": "Unable to load comments",
+			})
+			return
+		}
+		c.PureJSON(200, AdminCommentsModel{Total: total, Comments: comments})
+	})
+	api.GET("/threads", func(c *gin.Context) {
+		selected, err := selectAdminSites(sites, c.Query("site"))
+		if err != nil {
+			c.PureJSON(http.StatusUnprocessableEntity, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		threads, err := getAdminThreads(selected)
+		if err != nil {
+			c.PureJSON(http.StatusInternalServerError, gin.H{
+				"error": "Unable to load threads",
+			})
+			return
+		}
+		c.PureJSON(200, threads)
+	})
+	api.POST("/sites/:site/comments/:commentId/approve", siteHandler(func(c *gin.Context, site adminSite, commentId int64) {
+		comment, err := site.logic.ApproveComment(commentId)
+		if err != nil {
+			respondError(c, getModificationErrorStatus(err), err)
+			return
+		}
+		c.PureJSON(200, comment)
+	}))
+	api.PUT("/sites/:site/comments/:commentId", siteHandler(func(c *gin.Context, site adminSite, commentId int64) {
+		editData := CommentModelEdit{}
+		if err := c.ShouldBindJSON(&editData); err != nil {
+			c.PureJSON(http.StatusUnprocessableEntity, gin.H{
+				"error": "Invalid input model",
+			})
+			return
+		}
+		comment, err := site.logic.AdminEditComment(commentId, &editData)
+		if err != nil {
+			respondError(c, getModificationErrorStatus(err), err)
+			return
+		}
+		c.PureJSON(200, comment)
+	}))
+	api.DELETE("/sites/:site/comments/:commentId", siteHandler(func(c *gin.Context, site adminSite, commentId int64) {
+		comment, err := site.logic.AdminDeleteComment(commentId)
+		if err != nil {
+			respondError(c, getModificationErrorStatus(err), err)
+			return
+		}
+		// null for completely removed comment
+		c.PureJSON(200, comment)
+	}))
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const TEST_ADMIN_PASSWORD = "admin-password-for-tests-only"
+
+func getAdminConfig() ApplicationConfig {
+	config := getModerationConfig()
+	config.Admin = AdminConfig{Enabled: true, Password: TEST_ADMIN_PASSWORD, SessionTtl: time.Hour}
+	return config
+}
+
+func TestAdminLogic(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	logic.policy.EditMaxAge = 0
+	var parentId int64 = 1
+	addStoredComment(t, logic, "example.com/first", 1, nil)
+	addStoredComment(t, logic, "example.com/first", 2, &parentId)
+	addStoredComment(t, logic, "example.com/second", 3, nil)
+	for commentId := int64(1); commentId <= 3; commentId++ {
+		modifyStoredComment(t, logic, commentId, func(comment *CommentModelOutput) {
+			comment.Created = float64(comment.Id)
+		})
+	}
+	modifyStoredComment(t, logic, 2, func(comment *CommentModelOutput) {
+		comment.Mode = MODE_PENDING
+	})
+
+	total, comments, err := logic.FindComments(AdminQuery{Limit: -1})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, total)
+	assert.Equal(t, int64(3), comments[0].Id)
+	total, comments, err = logic.FindComments(AdminQuery{Uri: "example.com/first", Limit: 1, Offset: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, total)
+	assert.Len(t, comments, 1)
+	assert.Equal(t, int64(1), comments[0].Id)
+	total, comments, err = logic.FindComments(AdminQuery{Mode: MODE_PENDING, Limit: -1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, int64(2), comments[0].Id)
+	total, comments, err = logic.FindComments(AdminQuery{Uri: "example.com/unknown", Limit: -1})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, total)
+	assert.Len(t, comments, 0)
+
+	threads, err := logic.GetThreads()
+	assert.Nil(t, err)
+	assert.Equal(t, []ThreadModel{
+		{Uri: "example.com/second", Comments: 1, Latest: 3},
+		{Uri: "example.com/first", Comments: 1, Pending: 1, Latest: 2},
+	}, threads)
+
+	// owner isn't limited by edit window
+	edited, err := logic.AdminEditComment(1, &CommentModelEdit{Text: "*edited*"})
+	assert.Nil(t, err)
+	assert.Equal(t, "<p><em>edited</em></p>\n", edited.Text)
+	_, err = logic.AdminEditComment(1, &CommentModelEdit{Text: ""})
+	assert.NotNil(t, err)
+
+	tombstone, err := logic.AdminDeleteComment(1)
+	assert.Nil(t, err)
+	assert.Equal(t, MODE_DELETED, tombstone.Mode)
+	_, err = logic.AdminDeleteComment(1)
+	assert.ErrorIs(t, err, ErrCommentNotFound)
+}
+
+func TestAdminSession(t *testing.T) {
+	auth := NewAdminAuth(getAdminConfig(), GenerateSessionKey())
+	now := time.Now()
+	session := auth.NewSession(now)
+	assert.True(t, auth.VerifySession(session, now))
+	assert.True(t, auth.VerifySession(session, now.Add(59*time.Minute)))
+	assert.False(t, auth.VerifySession(session, now.Add(2*time.Hour)))
+	assert.False(t, auth.VerifySession(session, now.Add(-2*ADMIN_CLOCK_SKEW)))
+	assert.False(t, auth.VerifySession(strings.Replace(session, ".", "0.", 1), now))
+	assert.False(t, auth.VerifySession("", now))
+	assert.NotEqual(t, session, auth.NewSession(now))
+	// keys of comments are not sessions, even for ids looking like future time
+	var commentId int64 = 1 << 62
+	assert.False(t, auth.VerifySession(fmt.Sprintf("%v.%v", commentId, auth.CommentKey(DEFAULT_SITE, commentId)), now))
+	assert.False(t, auth.VerifySession(fmt.Sprintf("%v.0.%v", commentId, auth.CommentKey(DEFAULT_SITE, commentId)), now))
+	assert.False(t, NewAdminAuth(getAdminConfig(), GenerateSessionKey()).VerifySession(session, now))
+
+	assert.True(t, auth.CheckPassword(TEST_ADMIN_PASSWORD))
+	assert.False(t, auth.CheckPassword(""))
+	assert.False(t, NewAdminAuth(ApplicationConfig{}, GenerateSessionKey()).CheckPassword(""))
+}
+
+func adminLogin(t *testing.T, app http.Handler) []*http.Cookie {
+	form := url.Values{"password": {TEST_ADMIN_PASSWORD}}
+	w := serveRequest(app, "POST", "/admin", form.Encode(), withHeader("Content-Type", FORM_CONTENT_TYPE))
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "admin", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.True(t, cookies[0].HttpOnly)
+	return cookies
+}
+
+func getAdminComments(t *testing.T, app http.Handler, query string) AdminCommentsModel {
+	w := serveRequest(app, "GET", "/admin/api/comments?"+query, "", withBearer(TEST_ADMIN_PASSWORD))
+	assert.Equal(t, 200, w.Code)
+	var res AdminCommentsModel
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+	return res
+}
+
+// testAdminScenario checks admin area of router with comments of site engine
+func testAdminScenario(t *testing.T, router http.Handler, app *gin.Engine, uri string) {
+	inputComment := getFakeInputComment()
+	pending := postComment(t, app, &inputComment, uri)
+	other := postComment(t, app, &inputComment, uri)
+
+	t.Run("TestAdminLogin", func(t *testing.T) {
+		w := serveRequest(router, "GET", "/admin", "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), `type="password"`)
+
+		form := url.Values{"password": {"wrong"}}
+		w = serveRequest(router, "POST", "/admin", form.Encode(), withHeader("Content-Type", FORM_CONTENT_TYPE))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Empty(t, w.Result().Cookies())
+
+		w = serveRequest(router, "POST", "/admin/logout", "")
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+	})
+
+	t.Run("TestAdminConsole", func(t *testing.T) {
+		cookies := adminLogin(t, router)
+		w := serveRequest(router, "GET", "/admin?status=pending&uri="+url.QueryEscape(uri), "", withCookies(cookies))
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), fmt.Sprintf(`id="isso-%v"`, pending.Id))
+		assert.Contains(t, w.Body.String(), "<em>world</em>")
+		assert.Contains(t, w.Body.String(), "validate_com(")
+		assert.Contains(t, w.Body.String(), `src="./admin/admin.js"`)
+		assert.Equal(t, 200, serveRequest(router, "GET", "/admin?status=public&uri="+url.QueryEscape(uri), "", withCookies(cookies)).Code)
+		assert.Equal(t, http.StatusUnprocessableEntity, serveRequest(router, "GET", "/admin?status=spam", "", withCookies(cookies)).Code)
+
+		w = serveRequest(router, "GET", "/admin/threads", "", withCookies(cookies))
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), uri)
+		assert.Equal(t, http.StatusUnauthorized, serveRequest(router, "GET", "/admin/threads", "").Code)
+	})
+
+	t.Run("TestAdminJs", func(t *testing.T) {
+		cookies := adminLogin(t, router)
+		auth := NewAdminAuth(getAdminConfig(), "")
+		activatePath := fmt.Sprintf("/admin/sites/default/id/%v/activate", pending.Id)
+		invalidKey := withHeader(ADMIN_KEY_HEADER, auth.CommentKey(DEFAULT_SITE, pending.Id))
+		assert.Equal(t, http.StatusForbidden, serveRequest(router, "POST", activatePath, "", withCookies(cookies), invalidKey).Code)
+
+		// key is taken from console page
+		w := serveRequest(router, "GET", "/admin?status=pending&uri="+url.QueryEscape(uri), "", withCookies(cookies))
+		keyRegexp := regexp.MustCompile(fmt.Sprintf(`validate_com\( ?%v ?, &#34;([0-9a-f]+)&#34;`, pending.Id))
+		match := keyRegexp.FindStringSubmatch(w.Body.String())
+		assert.Len(t, match, 2)
+		key := withHeader(ADMIN_KEY_HEADER, match[1])
+
+		assert.Equal(t, http.StatusForbidden, serveRequest(router, "POST", activatePath, "", key).Code)
+		assert.Equal(t, http.StatusForbidden, serveRequest(router, "POST", activatePath, "", withCookies(cookies)).Code)
+		assert.Equal(t, 200, serveRequest(router, "POST", activatePath, "", withCookies(cookies), key).Code)
+		assert.Equal(t, http.StatusConflict, serveRequest(router, "POST", activatePath, "", withCookies(cookies), key).Code)
+
+		editPath := fmt.Sprintf("/admin/sites/default/id/%v/edit", pending.Id)
+		w = serveRequest(router, "POST", editPath, `{"text": "**edited**\n\n[link](https://example.com)", "author": "Owner", "email": "", "website": ""}`, withCookies(cookies), key)
+		assert.Equal(t, 200, w.Code)
+		var edited CommentModelOutput
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &edited))
+		assert.Contains(t, edited.Text, "<strong>edited</strong>")
+		assert.Equal(t, "Owner", *edited.Author)
+
+		// next edit starts from markdown source
+		sourcePath := fmt.Sprintf("/admin/sites/default/id/%v?plain=1", pending.Id)
+		assert.Equal(t, http.StatusForbidden, serveRequest(router, "GET", sourcePath, "", withCookies(cookies)).Code)
+		w = serveRequest(router, "GET", sourcePath, "", withCookies(cookies), key)
+		assert.Equal(t, 200, w.Code)
+		var source CommentModelOutput
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &source))
+		assert.Equal(t, "**edited**\n\n[link](https://example.com)", source.Text)
+		assert.Equal(t, http.StatusBadRequest, serveRequest(router, "POST", editPath, `{"text": ""}`, withCookies(cookies), key).Code)
+
+		deletePath := fmt.Sprintf("/admin/sites/default/id/%v/delete", pending.Id)
+		assert.Equal(t, 200, serveRequest(router, "POST", deletePath, "", withCookies(cookies), key).Code)
+		assert.Equal(t, http.StatusNotFound, serveRequest(router, "POST", deletePath, "", withCookies(cookies), key).Code)
+	})
+
+	t.Run("TestAdminApi", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, serveRequest(router, "GET", "/admin/api/comments", "").Code)
+		assert.Equal(t, http.StatusForbidden, serveRequest(router, "GET", "/admin/api/threads", "", withCookies(adminLogin(t, router))).Code)
+		assert.Equal(t, http.StatusUnprocessableEntity, serveRequest(router, "GET", "/admin/api/comments?offset=-1", "", withBearer(TEST_ADMIN_PASSWORD)).Code)
+
+		res := getAdminComments(t, router, "status=pending&uri="+url.QueryEscape(uri))
+		assert.Equal(t, 1, res.Total)
+		assert.Equal(t, other.Id, res.Comments[0].Comment.Id)
+		assert.Equal(t, uri, res.Comments[0].Uri)
+		res = getAdminComments(t, router, "limit=0")
+		assert.Greater(t, res.Total, 0)
+		assert.Len(t, res.Comments, 0)
+
+		approvePath := fmt.Sprintf("/admin/api/sites/default/comments/%v/approve", other.Id)
+		assert.Equal(t, 200, serveRequest(router, "POST", approvePath, "", withBearer(TEST_ADMIN_PASSWORD)).Code)
+		assert.Equal(t, http.StatusConflict, serveRequest(router, "POST", approvePath, "", withBearer(TEST_ADMIN_PASSWORD)).Code)
+		assert.Equal(t, 1, getCommentsForPage(t, app, uri))
+
+		commentPath := fmt.Sprintf("/admin/api/sites/default/comments/%v", other.Id)
+		w := serveRequest(router, "PUT", commentPath, `{"text": "**edited**"}`, withBearer(TEST_ADMIN_PASSWORD))
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), "<strong>edited</strong>")
+		assert.Equal(t, http.StatusBadRequest, serveRequest(router, "PUT", commentPath, `{"text": ""}`, withBearer(TEST_ADMIN_PASSWORD)).Code)
+
+		w = serveRequest(router, "GET", "/admin/api/threads", "", withBearer(TEST_ADMIN_PASSWORD))
+		assert.Equal(t, 200, w.Code)
+		var threads []ThreadModel
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &threads))
+		assert.Contains(t, threads, ThreadModel{Site: DEFAULT_SITE, Uri: uri, Comments: 1, Latest: other.Created})
+
+		w = serveRequest(router, "DELETE", commentPath, "", withBearer(TEST_ADMIN_PASSWORD))
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "null", strings.TrimSpace(w.Body.String()))
+		assert.Equal(t, http.StatusNotFound, serveRequest(router, "DELETE", commentPath, "", withBearer(TEST_ADMIN_PASSWORD)).Code)
+		assert.Equal(t, 0, getAdminComments(t, router, "uri="+url.QueryEscape(uri)).Total)
+	})
+}
+
+func TestAdminWithMemoryStorage(t *testing.T) {
+	disabled := NewSitesRouter(getModerationConfig())
+	defer disabled.Close()
+	assert.Equal(t, http.StatusNotFound, serveRequest(disabled, "GET", "/admin", "").Code)
+
+	router := NewSitesRouter(getAdminConfig())
+	defer router.Close()
+	testAdminScenario(t, router, router.sites[0].engine, "example.com/memory-admin")
+}
+
+func TestAdminSites(t *testing.T) {
+	config := getTestSitesConfig()
+	config.Admin = getAdminConfig().Admin
+	router := NewSitesRouter(config)
+	defer router.Close()
+
+	inputComment := getFakeInputComment()
+	w := serveRequest(router, "POST", "/new?uri=shared", jsonBody(t, inputComment), withHost("blog.example.com"))
+	assert.Equal(t, 201, w.Code)
+	var blogComment CommentModelOutput
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &blogComment))
+	time.Sleep(time.Millisecond)
+	w = serveRequest(router, "POST", "/docs/new?uri=shared", jsonBody(t, inputComment), withHost("example.com"))
+	assert.Equal(t, 201, w.Code)
+
+	res := getAdminComments(t, router, "")
+	assert.Equal(t, 2, res.Total)
+	assert.Equal(t, "docs", res.Comments[0].Site)
+	assert.Equal(t, "blog", res.Comments[1].Site)
+	res = getAdminComments(t, router, "limit=1&offset=1")
+	assert.Equal(t, 2, res.Total)
+	assert.Equal(t, blogComment.Id, res.Comments[0].Comment.Id)
+	res = getAdminComments(t, router, "site=blog")
+	assert.Equal(t, 1, res.Total)
+	assert.Equal(t, "blog", res.Comments[0].Site)
+	assert.Equal(t, http.StatusUnprocessableEntity, serveRequest(router, "GET", "/admin/api/comments?site=wiki", "", withBearer(TEST_ADMIN_PASSWORD)).Code)
+
+	w = serveRequest(router, "GET", "/admin/api/threads", "", withBearer(TEST_ADMIN_PASSWORD))
+	assert.Equal(t, 200, w.Code)
+	var threads []ThreadModel
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &threads))
+	assert.Len(t, threads, 2)
+	assert.Equal(t, "docs", threads[0].Site)
+
+	// console is the same for every host
+	cookies := adminLogin(t, router)
+	w = serveRequest(router, "GET", "/admin", "", withCookies(cookies), withHost("blog.example.com"))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "./admin/sites/blog")
+	assert.Contains(t, w.Body.String(), "./admin/sites/docs")
+	w = serveRequest(router, "GET", "/admin/threads?site=docs", "", withCookies(cookies))
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "<td>blog</td>")
+
+	otherSitePath := fmt.Sprintf("/admin/api/sites/main/comments/%v", blogComment.Id)
+	assert.Equal(t, http.StatusNotFound, serveRequest(router, "DELETE", otherSitePath, "", withBearer(TEST_ADMIN_PASSWORD)).Code)
+	assert.Equal(t, http.StatusNotFound, serveRequest(router, "DELETE", "/admin/api/sites/all/comments/1", "", withBearer(TEST_ADMIN_PASSWORD)).Code)
+	commentPath := fmt.Sprintf("/admin/api/sites/blog/comments/%v", blogComment.Id)
+	assert.Equal(t, 200, serveRequest(router, "DELETE", commentPath, "", withBearer(TEST_ADMIN_PASSWORD)).Code)
+	assert.Equal(t, 1, getAdminComments(t, router, "").Total)
+}
+
+func TestAdminConfig(t *testing.T) {
+	_, err := LoadConfig(getTestEnv(map[string]string{
+		"ADMIN_ENABLED":     "true",
+		"ADMIN_SESSION_TTL": "0s",
+	}))
+	configErr, isConfigErr := err.(*ConfigError)
+	assert.True(t, isConfigErr)
+	assert.Len(t, configErr.Problems, 2)
+
+	config, err := LoadConfig(getTestEnv(map[string]string{
+		"ADMIN_ENABLED":  "true",
+		"ADMIN_PASSWORD": TEST_ADMIN_PASSWORD,
+	}))
+	assert.Nil(t, err)
+	assert.True(t, config.Admin.Enabled)
+	assert.NotContains(t, DumpConfig(config), TEST_ADMIN_PASSWORD)
+}
+
+func testCommentsIndex(t *testing.T, config MinioConfig) {
+	config.KeyPrefix = "index-test/"
+	backend, err := NewS3CommentsStorage(config)
+	assert.Nil(t, err)
+	for commentId, uri := range map[int64]string{1: "example.com/a", 2: "example.com/a", 3: "example.com/b", 4: ""} {
+		_, err := backend.AddComment(&CommentModelOutput{Id: commentId, Uri: uri, Mode: MODE_PUBLIC})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, backend.AddPendingComment(2, "example.com/a"))
+	assert.Nil(t, backend.UpdateComment(&CommentModelOutput{Id: 3, Uri: "example.com/b", Mode: MODE_DELETED}))
+
+	entries, err := backend.ListCommentsIndex()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4)
+	for ind, mode := range []int{MODE_PUBLIC, MODE_DELETED, MODE_PENDING, MODE_PUBLIC} {
+		assert.Equal(t, int64(4-ind), entries[ind].Id)
+		assert.Equal(t, mode, entries[ind].Mode)
+	}
+	assert.Equal(t, "", entries[0].Page)
+	assert.NotEqual(t, entries[1].Page, entries[2].Page)
+	assert.Equal(t, entries[2].Page, entries[3].Page)
+
+	assert.Nil(t, backend.DeleteComment(1))
+	assert.Nil(t, backend.removeIndexEntries(3))
+	entries, err = backend.ListCommentsIndex()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	// lost entries are written again by index-comments
+	indexedCount, err := backend.IndexComments()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, indexedCount)
+	entries, err = backend.ListCommentsIndex()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, MODE_DELETED, entries[1].Mode)
+}
+
+func TestAdminWithIntegrations(t *testing.T) {
+	if _, exists := os.LookupEnv("TESTS_ENABLE_INTEGRATIONS"); !exists {
+		t.Skipf("TESTS_ENABLE_INTEGRATIONS disabled")
+	}
+	config := ReadConfig()
+	config.Minio.Bucket = "test-admin"
+	config.Redis = nil
+	adminConfig := getAdminConfig()
+	config.Policy.Moderation = true
+	config.ModerationKey = adminConfig.ModerationKey
+	config.Admin = adminConfig.Admin
+	router := NewSitesRouter(config)
+	defer router.Close()
+	defer postDeleteS3Bucket(t, *config.Minio)
+
+	testAdminScenario(t, router, router.sites[0].engine, "example.com/s3-admin")
+	testCommentsIndex(t, *config.Minio)
+}
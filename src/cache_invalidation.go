@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// InvalidationEvent is sent by replica after modification of slowBackend,
+// other replicas drop listed entries from memory caches
+type InvalidationEvent struct {
+	Origin   string   `json:"origin"` // replica, which sent event
+	Sent     float64  `json:"sent"`   // unix time in seconds
+	Comments []int64  `json:"comments,omitempty"`
+	Pages    []string `json:"pages,omitempty"`
+	Counts   []string `json:"counts,omitempty"`
+}
+
+type CacheInvalidatorInterface interface {
+	Publish(event *InvalidationEvent) error
+	// Subscribe calls reset when events may be lost, so all cached data must be dropped
+	Subscribe(handler func(event *InvalidationEvent), reset func())
+	Close() error
+}
+
+var (
+	metricInvalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_invalidations",
+		Help: "Number of invalidated memory cache entries by source of event",
+	}, []string{"cache", "site", "source"})
+	metricInvalidationResets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_invalidation_resets",
+		Help: "Number of memory cache resets, because invalidation events may be lost",
+	}, []string{"site"})
+	metricInvalidationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_invalidation_errors",
+		Help: "Number of failed publications and receptions of invalidation events",
+	}, []string{"operation"})
+	// delay between modification and invalidation on other replica is staleness of their caches
+	metricInvalidationDelay = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cache_invalidation_delay_seconds",
+		Help:    "Time between publication and reception of invalidation event",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30},
+	})
+)
+
+func observeInvalidationDelay(event *InvalidationEvent) {
+	delay := float64(time.Now().UnixMilli())/1000 - event.Sent
+	if delay < 0 {
+		delay = 0 // clocks of replicas are not synchronized
+	}
+	metricInvalidationDelay.Observe(delay)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// RunCommand executes maintenance command instead of starting the server,
+// usage: s3-comment <command> [arguments]
+func RunCommand(config ApplicationConfig, args []string) error {
+	switch args[0] {
+	case "rerender":
+		// rendering options may be changed, so html of all comments must be rebuilt
+		sites := NewSitesRouter(config)
+		defer sites.Close()
+		for _, site := range sites.sites {
+			updatedCount, err := site.logic.RerenderComments()
+			log.Printf("Rerendered %v comments of site %v\n", updatedCount, site.config.Name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "migrate-pages":
+		// pages/<hash>.json lists from old versions to append-only layout
+		if config.Minio == nil {
+			return errors.New("migration requires S3 storage")
+		}
+		for _, siteConfig := range config.GetSiteConfigs() {
+			backend, err := NewSiteS3CommentsStorage(siteConfig.Name, *siteConfig.Apply(config).Minio)
+			if err != nil {
+				return err
+			}
+			migratedCount, err := backend.MigratePages()
+			log.Printf("Migrated %v pages of site %v\n", migratedCount, siteConfig.Name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "rehash-pages":
+		// pages of previous_page_secrets to current page_secret,
+		// arguments are uris of pages with comments of old versions only
+		if config.Minio == nil {
+			return errors.New("rehash requires S3 storage")
+		}
+		for _, siteConfig := range config.GetSiteConfigs() {
+			backend, err := NewSiteS3CommentsStorage(siteConfig.Name, *siteConfig.Apply(config).Minio)
+			if err != nil {
+				return err
+			}
+			rehashedCount, err := backend.RehashPages(args[1:])
+			log.Printf("Rehashed %v pages of site %v\n", rehashedCount, siteConfig.Name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "index-comments":
+		// comments of old versions to index of admin area
+		if config.Minio == nil {
+			return errors.New("index requires S3 storage")
+		}
+		for _, siteConfig := range config.GetSiteConfigs() {
+			backend, err := NewSiteS3CommentsStorage(siteConfig.Name, *siteConfig.Apply(config).Minio)
+			if err != nil {
+				return err
+			}
+			indexedCount, err := backend.IndexComments()
+			log.Printf("Indexed %v comments of site %v\n", indexedCount, siteConfig.Name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %v, available commands: rerender, migrate-pages, rehash-pages, index-comments", args[0])
+	}
+}
@@ -1,5 +1,14 @@
 package main
 
+import "encoding/json"
+
+// comment modes, same values as in isso
+const (
+	MODE_PUBLIC  = 1
+	MODE_PENDING = 2
+	MODE_DELETED = 4
+)
+
 type CommentModelInput struct {
 	Author       *string `json:"author"`
 	Email        *string `json:"email"`
@@ -12,7 +21,7 @@ type CommentModelInput struct {
 
 type CommentModelOutput struct {
 	Id            int64                `json:"id"`
-	Parent        *int                 `json:"parent"`
+	Parent        *int64               `json:"parent"`
 	Created       float64              `json:"created"`
 	Modified      *float64             `json:"modified"`
 	Mode          int                  `json:"mode"`
@@ -26,6 +35,140 @@ type CommentModelOutput struct {
 	TotalRelies   int                  `json:"total_replies"`
 	HiddenReplies int                  `json:"hidden_replies"`
 	Replies       []CommentModelOutput `json:"replies"`
+	GravatarImage string               `json:"gravatar_image,omitempty"`
+
+	// internal fields, persisted by storages via commentRecord
+	Uri         string      `json:"-"` // page of comment, empty for old comments
+	TextSource  string      `json:"-"` // markdown, empty for old comments
+	Voters      VoterFilter `json:"-"` // hashed addresses of clients voted for comment
+	AuthorVoter string      `json:"-"` // hashed address of author, who can't vote for own comment
+	// email of author subscribed to replies, encrypted with notifications.email_key
+	EncryptedEmail string `json:"-"`
+}
+
+// commentRecord is representation of comment in storages, including internal fields
+type commentRecord struct {
+	*CommentModelOutput
+	Uri         string      `json:"uri,omitempty"`
+	TextSource  string      `json:"text_source,omitempty"`
+	Voters      VoterFilter `json:"voters,omitempty"`
+	AuthorVoter string      `json:"author_voter,omitempty"`
+
+	EncryptedEmail string `json:"encrypted_email,omitempty"`
+}
+
+func MarshalCommentRecord(comment *CommentModelOutput) ([]byte, error) {
+	return json.Marshal(commentRecord{
+		CommentModelOutput: comment,
+		Uri:                comment.Uri,
+		TextSource:         comment.TextSource,
+		Voters:             comment.Voters,
+		AuthorVoter:        comment.AuthorVoter,
+		EncryptedEmail:     comment.EncryptedEmail,
+	})
+}
+
+func UnmarshalCommentRecord(data []byte) (*CommentModelOutput, error) {
+	record := commentRecord{CommentModelOutput: &CommentModelOutput{}}
+	err := json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+	record.CommentModelOutput.Uri = record.Uri
+	record.CommentModelOutput.TextSource = record.TextSource
+	record.CommentModelOutput.Voters = record.Voters
+	record.CommentModelOutput.AuthorVoter = record.AuthorVoter
+	record.CommentModelOutput.EncryptedEmail = record.EncryptedEmail
+	return record.CommentModelOutput, nil
+}
+
+// ClientInfo describes client of request, filled by http handlers
+type ClientInfo struct {
+	IsAuthorOf  func(commentId int64) bool // nil for unknown client
+	AuthoredIds func() []int64             // comments with valid author cookies, nil for unknown client
+	VoterId     string                     // hashed address, empty for unknown client
+}
+
+func (client ClientInfo) isAuthorOf(commentId int64) bool {
+	return client.IsAuthorOf != nil && client.IsAuthorOf(commentId)
+}
+
+func (client ClientInfo) authoredIds() []int64 {
+	if client.AuthoredIds == nil {
+		return nil
+	}
+	return client.AuthoredIds()
+}
+
+type CommentModelEdit struct {
+	Text    string  `json:"text"`
+	Author  *string `json:"author"`
+	Website *string `json:"website"`
+}
+
+// CommentsThread is response of GET /, list of replies for page or single comment
+type CommentsThread struct {
+	Id            *int64               `json:"id"`
+	TotalReplies  int                  `json:"total_replies"`
+	HiddenReplies int                  `json:"hidden_replies"`
+	Replies       []CommentModelOutput `json:"replies"`
+}
+
+const (
+	SORT_OLDEST  = "oldest"
+	SORT_NEWEST  = "newest"
+	SORT_UPVOTES = "upvotes"
+)
+
+// CommentsQuery is isso compatible set of GET / parameters
+type CommentsQuery struct {
+	Parent      *int64  // nil for top level comments
+	Limit       int     // negative for unlimited
+	NestedLimit int     // negative for unlimited
+	After       float64 // only comments created after this unix time
+	Plain       bool    // markdown instead of html
+	Sort        string
+}
+
+func DefaultCommentsQuery() CommentsQuery {
+	return CommentsQuery{
+		Parent:      nil,
+		Limit:       -1,
+		NestedLimit: -1,
+		After:       0,
+		Plain:       false,
+		Sort:        SORT_OLDEST,
+	}
+}
+
+// AdminQuery filters comments in admin area, zero values match everything
+type AdminQuery struct {
+	Mode   int    // one of comment modes
+	Uri    string // page of comments
+	Limit  int    // negative for unlimited
+	Offset int
+}
+
+// AdminCommentModel is comment with internal fields needed by owner
+type AdminCommentModel struct {
+	Site    string              `json:"site"`
+	Comment *CommentModelOutput `json:"comment"`
+	Uri     string              `json:"uri"`
+}
+
+// AdminCommentsModel is response of GET /admin/api/comments
+type AdminCommentsModel struct {
+	Total    int                 `json:"total"` // matching comments, including ones beyond limit
+	Comments []AdminCommentModel `json:"comments"`
+}
+
+// ThreadModel is summary of page with comments
+type ThreadModel struct {
+	Site     string  `json:"site"` // set by admin area
+	Uri      string  `json:"uri"`
+	Comments int     `json:"comments"` // public ones
+	Pending  int     `json:"pending"`
+	Latest   float64 `json:"latest"` // created time of last comment
 }
 
 type PreviewModel struct {
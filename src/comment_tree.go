@@ -0,0 +1,86 @@
+package main
+
+import "sort"
+
+// buildCommentsThread places replies inside of their parents, like isso does.
+// Replies with unknown parent are shown as top level comments
+func buildCommentsThread(pageComments []*CommentModelOutput, query CommentsQuery) *CommentsThread {
+	knownIds := make(map[int64]bool, len(pageComments))
+	for _, comment := range pageComments {
+		knownIds[comment.Id] = true
+	}
+
+	roots := make([]*CommentModelOutput, 0)
+	children := make(map[int64][]*CommentModelOutput)
+	for _, comment := range pageComments {
+		if comment.Created <= query.After {
+			continue
+		}
+		// storages may return shared objects, tree must not modify them
+		node := *comment
+		if query.Plain && node.TextSource != "" {
+			node.Text = node.TextSource
+		}
+		if node.Parent != nil && knownIds[*node.Parent] {
+			children[*node.Parent] = append(children[*node.Parent], &node)
+		} else {
+			roots = append(roots, &node)
+		}
+	}
+
+	level := roots
+	if query.Parent != nil {
+		level = children[*query.Parent]
+	}
+	shown := limitComments(level, query.Limit, query.Sort)
+
+	thread := CommentsThread{
+		Id:            query.Parent,
+		TotalReplies:  len(level),
+		HiddenReplies: len(level) - len(shown),
+		Replies:       make([]CommentModelOutput, 0, len(shown)),
+	}
+	for _, comment := range shown {
+		fillReplies(comment, children, query)
+		thread.Replies = append(thread.Replies, *comment)
+	}
+	return &thread
+}
+
+func fillReplies(node *CommentModelOutput, children map[int64][]*CommentModelOutput, query CommentsQuery) {
+	replies := children[node.Id]
+	shown := limitComments(replies, query.NestedLimit, query.Sort)
+
+	node.TotalRelies = len(replies)
+	node.HiddenReplies = len(replies) - len(shown)
+	node.Replies = make([]CommentModelOutput, 0, len(shown))
+	for _, reply := range shown {
+		fillReplies(reply, children, query)
+		node.Replies = append(node.Replies, *reply)
+	}
+}
+
+// limitComments sorts comments in place and returns first limit of them
+func limitComments(comments []*CommentModelOutput, limit int, sortOrder string) []*CommentModelOutput {
+	sortComments(comments, sortOrder)
+	if limit >= 0 && len(comments) > limit {
+		return comments[:limit]
+	}
+	return comments
+}
+
+func sortComments(comments []*CommentModelOutput, sortOrder string) {
+	sort.SliceStable(comments, func(i, j int) bool {
+		switch sortOrder {
+		case SORT_NEWEST:
+			return comments[i].Created > comments[j].Created
+		case SORT_UPVOTES:
+			karmaI := comments[i].Likes - comments[i].Dislikes
+			karmaJ := comments[j].Likes - comments[j].Dislikes
+			if karmaI != karmaJ {
+				return karmaI > karmaJ
+			}
+		}
+		return comments[i].Created < comments[j].Created
+	})
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"strings"
-
-	"github.com/gomarkdown/markdown"
 )
 
 const HASH_LEN = 12 // taken from isso
@@ -17,8 +20,34 @@ func CalculateUserHash(email string, secret string) string {
 	return fmt.Sprintf("%x", hash.Sum(nil))[:HASH_LEN]
 }
 
-func RenderMarkdown(input_md string) string {
-	md := []byte(input_md)
-	output := markdown.ToHTML(md, nil, nil)
-	return string(output)
+func GetGravatarUrl(email string, urlTemplate string) string {
+	hash := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return strings.ReplaceAll(urlTemplate, "{}", hex.EncodeToString(hash[:]))
+}
+
+func GenerateSessionKey() string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(key)
+}
+
+// SignCommentToken returns value for isso-<id> cookie, proof of comment authorship
+func SignCommentToken(commentId int64, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%v", commentId)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HashClientAddress identifies voter without storing raw address
+func HashClientAddress(address string, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(address))
+	return hex.EncodeToString(mac.Sum(nil))[:HASH_LEN]
+}
+
+func VerifyCommentToken(commentId int64, token string, key string) bool {
+	expected := SignCommentToken(commentId, key)
+	return hmac.Equal([]byte(expected), []byte(token))
 }
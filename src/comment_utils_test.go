@@ -29,3 +29,11 @@ func TestCalculateUserHash(t *testing.T) {
 		CalculateUserHash("demo2@example.com", "secret1"),
 	)
 }
+
+func TestCommentToken(t *testing.T) {
+	token := SignCommentToken(42, "key1")
+	assert.True(t, VerifyCommentToken(42, token, "key1"))
+	assert.False(t, VerifyCommentToken(43, token, "key1"))
+	assert.False(t, VerifyCommentToken(42, token, "key2"))
+	assert.False(t, VerifyCommentToken(42, "", "key1"))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ValidationError describes invalid field of comment, it is returned to client with 400 status
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("%v %v", err.Field, err.Message)
+}
+
+func newValidationError(field string, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// invisible characters, which may hide content or spoof author names
+func isInvisibleRune(r rune) bool {
+	switch r {
+	case '\u00ad', // soft hyphen
+		'\u180e',           // mongolian vowel separator
+		'\u200b',           // zero width space
+		'\u2060', '\ufeff', // word joiners
+		'\u202a', '\u202b', '\u202c', '\u202d', '\u202e', // bidi embeddings and overrides
+		'\u2066', '\u2067', '\u2068', '\u2069': // bidi isolates
+		return true
+	}
+	return false
+}
+
+// normalizeString returns NFC form of value without control and invisible characters.
+// NB: zero width (non-)joiners are kept in multiline text, they are part of emoji and some scripts
+func normalizeString(value string, multiline bool) string {
+	value = norm.NFC.String(strings.ToValidUTF8(value, ""))
+	if multiline {
+		value = strings.ReplaceAll(value, "\r\n", "\n")
+	}
+	value = strings.Map(func(r rune) rune {
+		if multiline && (r == '\n' || r == '\t') {
+			return r
+		}
+		if unicode.IsControl(r) || isInvisibleRune(r) {
+			return -1
+		}
+		if !multiline && (r == '\u200c' || r == '\u200d') {
+			return -1
+		}
+		return r
+	}, value)
+	return strings.TrimSpace(value)
+}
+
+// normalizeOptional returns nil for missing or blank value
+func normalizeOptional(value *string) *string {
+	if value == nil {
+		return nil
+	}
+	res := normalizeString(*value, false)
+	if res == "" {
+		return nil
+	}
+	return &res
+}
+
+func emptyIfNil(value *string) *string {
+	if value == nil {
+		return new(string)
+	}
+	return value
+}
+
+func checkMaxLength(field string, value *string, maxLength int) error {
+	if value != nil && maxLength > 0 && utf8.RuneCountInString(*value) > maxLength {
+		return newValidationError(field, "is too long (maximum length: %v)", maxLength)
+	}
+	return nil
+}
+
+// NormalizeWebsite returns absolute http(s) url, scheme is added if it is missing like in isso
+func NormalizeWebsite(website string) (string, error) {
+	if !strings.Contains(website, "://") {
+		website = "http://" + website
+	}
+	parsed, err := url.Parse(website)
+	if err != nil {
+		return "", errors.New("is not valid url")
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", errors.New("must be http or https url")
+	}
+	// NB: user info is used to disguise links, like https://trusted.com@evil.com
+	if parsed.Hostname() == "" || parsed.User != nil || strings.ContainsAny(parsed.Host, " <>\"") {
+		return "", errors.New("is not valid url")
+	}
+	parsed.Host = strings.ToLower(parsed.Host)
+	return parsed.String(), nil
+}
+
+func ValidateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	// display names and comments are not emails
+	if err != nil || address.Address != email {
+		return errors.New("is not valid email")
+	}
+	return nil
+}
+
+// CommentValidator normalizes fields of new and edited comments and checks them by policy
+type CommentValidator struct {
+	policy PolicyConfig
+}
+
+func NewCommentValidator(policy PolicyConfig) *CommentValidator {
+	return &CommentValidator{policy: policy}
+}
+
+func (validator *CommentValidator) normalizeText(text string) (string, error) {
+	text = normalizeString(text, true)
+	length := utf8.RuneCountInString(text)
+	if length < validator.policy.MinTextLength {
+		return "", newValidationError("text", "is too short (minimum length: %v)", validator.policy.MinTextLength)
+	}
+	if validator.policy.MaxTextLength > 0 && length > validator.policy.MaxTextLength {
+		return "", newValidationError("text", "is too long (maximum length: %v)", validator.policy.MaxTextLength)
+	}
+	return text, nil
+}
+
+func (validator *CommentValidator) normalizeAuthor(author *string) (*string, error) {
+	author = normalizeOptional(author)
+	return author, checkMaxLength("author", author, validator.policy.MaxAuthorLength)
+}
+
+func (validator *CommentValidator) normalizeWebsite(website *string) (*string, error) {
+	website = normalizeOptional(website)
+	if err := checkMaxLength("website", website, validator.policy.MaxWebsiteLength); err != nil || website == nil {
+		return website, err
+	}
+	normalized, err := NormalizeWebsite(*website)
+	if err != nil {
+		return nil, newValidationError("website", err.Error())
+	}
+	return &normalized, nil
+}
+
+// ValidateInput normalizes new comment in place, returns *ValidationError for invalid one
+func (validator *CommentValidator) ValidateInput(input *CommentModelInput) error {
+	var err error
+	if input.Text, err = validator.normalizeText(input.Text); err != nil {
+		return err
+	}
+	if input.Author, err = validator.normalizeAuthor(input.Author); err != nil {
+		return err
+	}
+	if validator.policy.RequireAuthor && input.Author == nil {
+		return newValidationError("author", "is required")
+	}
+	input.Email = normalizeOptional(input.Email)
+	if validator.policy.RequireEmail && input.Email == nil {
+		return newValidationError("email", "is required")
+	}
+	if input.Email != nil {
+		if err := checkMaxLength("email", input.Email, validator.policy.MaxEmailLength); err != nil {
+			return err
+		}
+		if err := ValidateEmail(*input.Email); err != nil {
+			return newValidationError("email", err.Error())
+		}
+	}
+	input.Website, err = validator.normalizeWebsite(input.Website)
+	return err
+}
+
+// ValidateEdit normalizes edit in place, missing author and website are not changed by edit
+func (validator *CommentValidator) ValidateEdit(edit *CommentModelEdit) error {
+	var err error
+	if edit.Text, err = validator.normalizeText(edit.Text); err != nil {
+		return err
+	}
+	// NB: blank author or website removes it, so it is kept as empty string
+	if edit.Author != nil {
+		author, err := validator.normalizeAuthor(edit.Author)
+		if err != nil {
+			return err
+		}
+		if validator.policy.RequireAuthor && author == nil {
+			return newValidationError("author", "is required")
+		}
+		edit.Author = emptyIfNil(author)
+	}
+	if edit.Website != nil {
+		website, err := validator.normalizeWebsite(edit.Website)
+		if err != nil {
+			return err
+		}
+		edit.Website = emptyIfNil(website)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeString(t *testing.T) {
+	// decomposed e with acute accent is composed
+	assert.Equal(t, "caf\u00e9", normalizeString("cafe\u0301", false))
+	assert.Equal(t, "admin", normalizeString("\u202eadm\u200bin\u00ad\x00", false))
+	assert.Equal(t, "a\nb\tc", normalizeString(" a\r\nb\tc\x1b \n", true))
+	// emoji sequences are kept in text only
+	family := "\U0001F468\u200d\U0001F469"
+	assert.Equal(t, family, normalizeString(family, true))
+	assert.Equal(t, "\U0001F468\U0001F469", normalizeString(family, false))
+	assert.Equal(t, "", normalizeString("\xff", false))
+}
+
+func TestNormalizeWebsite(t *testing.T) {
+	for input, expected := range map[string]string{
+		"example.com":                "http://example.com",
+		"HTTPS://Example.com/Path?q": "https://example.com/Path?q",
+		"example.com:8080/blog":      "http://example.com:8080/blog",
+	} {
+		normalized, err := NormalizeWebsite(input)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, normalized)
+	}
+	for _, input := range []string{
+		"javascript:alert(1)",
+		"ftp://example.com",
+		"https://example.com@evil.com",
+		"http://",
+		"http://exa mple.com",
+	} {
+		_, err := NormalizeWebsite(input)
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	assert.Nil(t, ValidateEmail("john@example.com"))
+	for _, email := range []string{"john", "john@", "John <john@example.com>", "a@b@c"} {
+		assert.NotNil(t, ValidateEmail(email), email)
+	}
+}
+
+func TestCommentValidator(t *testing.T) {
+	policy := DefaultPolicyConfig()
+	policy.MaxTextLength = 10
+	validator := NewCommentValidator(policy)
+
+	input := CommentModelInput{Text: strings.Repeat("\u00e9", 10)}
+	assert.Nil(t, validator.ValidateInput(&input), "length is in characters")
+	input = CommentModelInput{Text: "hello world"}
+	err := validator.ValidateInput(&input)
+	assert.Equal(t, "text", err.(*ValidationError).Field)
+
+	policy.RequireAuthor = true
+	validator = NewCommentValidator(policy)
+	input = CommentModelInput{Text: "hello", Author: s("\u200b")}
+	err = validator.ValidateInput(&input)
+	assert.Equal(t, "author", err.(*ValidationError).Field)
+
+	edit := CommentModelEdit{Text: "hello", Author: s("  "), Website: s(" ")}
+	err = validator.ValidateEdit(&edit)
+	assert.Equal(t, "author", err.(*ValidationError).Field)
+	policy.RequireAuthor = false
+	validator = NewCommentValidator(policy)
+	assert.Nil(t, validator.ValidateEdit(&edit))
+	// blank values remove fields
+	assert.Equal(t, "", *edit.Author)
+	assert.Equal(t, "", *edit.Website)
+}
@@ -1,70 +1,239 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"time"
 )
 
+var (
+	ErrCommentNotFound   = errors.New("comment not found")
+	ErrEditWindowExpired = errors.New("comment can not be modified anymore")
+	ErrAlreadyVoted      = errors.New("already voted for comment")
+	ErrSelfVote          = errors.New("unable to vote for own comment")
+)
+
 type CommentsLogicInterface interface {
-	AddComment(uri string, inputComment *CommentModelInput) (*CommentModelOutput, error)
-	GetComments(uri string, nestedLimit int) []*CommentModelOutput
-	Like(commentId int64) (int64, int64, error)
-	Dislike(commentId int64) (int64, int64, error)
+	AddComment(uri string, inputComment *CommentModelInput, client ClientInfo) (*CommentModelOutput, error)
+	EditComment(commentId int64, edit *CommentModelEdit) (*CommentModelOutput, error)
+	DeleteComment(commentId int64) (*CommentModelOutput, error) // nil if comment removed completely
+	GetComment(commentId int64, plain bool) (*CommentModelOutput, error)
+	GetComments(uri string, query CommentsQuery, client ClientInfo) *CommentsThread // pending only for author
+	CountComments(uris []string, client ClientInfo) ([]int, error)                  // pending only for author
+	GetLatestComments(uri string, limit int) []*CommentModelOutput
+	Like(commentId int64, client ClientInfo) (int64, int64, error)
+	Dislike(commentId int64, client ClientInfo) (int64, int64, error)
+	GetPendingComments() ([]*CommentModelOutput, error) // oldest first
+	ApproveComment(commentId int64) (*CommentModelOutput, error)
+	RejectComment(commentId int64) (*CommentModelOutput, error)        // nil if comment removed completely
+	FindComments(query AdminQuery) (int, []*CommentModelOutput, error) // total count and newest comments
+	GetThreads() ([]ThreadModel, error)                                // last commented first
+	AdminEditComment(commentId int64, edit *CommentModelEdit) (*CommentModelOutput, error)
+	AdminDeleteComment(commentId int64) (*CommentModelOutput, error)
+	Unsubscribe(commentId int64) error // stops notifications about replies
+	Close() error
 }
 
 type SimpleCommentsLogic struct {
 	storageS3     CommentsStorageInterface
 	storageMemory CommentsStorageInterface
 	storage       CommentsStorageInterface
+	policy        PolicyConfig
+	renderer      *MarkupRenderer
+	hashSecret    string
+	ids           IdGeneratorInterface
+	votes         *VoteProcessor
+	invalidator   CacheInvalidatorInterface // nil without Redis
+	moderation    ModerationStorageInterface
+	signer        *ModerationSigner
+	notifier      *Notifier     // nil if notifications are disabled
+	nodeKeeper    *NodeIdKeeper // nil if node id is not claimed by this logic
 }
 
-func GetCommentsLogic(config ApplicationConfig) *SimpleCommentsLogic {
-	var storageS3 *S3CommentsBackend = nil
-	var err error
-	if config.Minio != nil {
-		storageS3, err = NewS3CommentsStorage(*config.Minio)
-	} else {
+// getIdGenerator returns keeper of claimed node id, nil for node id from config
+func getIdGenerator(config ApplicationConfig, storageS3 *S3CommentsBackend) (*SnowflakeIdGenerator, *NodeIdKeeper) {
+	nodeId := config.NodeId
+	owner := ""
+	if nodeId < 0 {
+		if storageS3 == nil {
+			log.Fatalf("Node id can be claimed only with S3 storage")
+		}
+		owner = GetNodeOwnerName()
+		var err error
+		nodeId, err = storageS3.ClaimNodeId(owner)
+		if err != nil {
+			log.Fatalf("Unable to claim node id: %v", err.Error())
+		}
+	}
+	generator, err := NewSnowflakeIdGenerator(nodeId)
+	if err != nil {
+		log.Fatalf("Unable to init id generator: %v", err.Error())
+	}
+	if owner == "" {
+		return generator, nil
+	}
+	return generator, NewNodeIdKeeper(storageS3, generator, nodeId, owner)
+}
+
+// getS3Backend returns nil without Minio
+func getS3Backend(site string, config ApplicationConfig) *S3CommentsBackend {
+	if config.Minio == nil {
 		log.Printf("Minio disabled")
+		return nil
 	}
-	storageMemory, _ := NewMemoryStorageLinked(storageS3)
+	backend, err := NewSiteS3CommentsStorage(site, *config.Minio)
 	if err != nil {
 		log.Fatalf("Unable to init comments storage, error: %v", err.Error())
 	}
+	return backend
+}
+
+func GetCommentsLogic(config ApplicationConfig) *SimpleCommentsLogic {
+	backend := getS3Backend(DEFAULT_SITE, config)
+	ids, nodeKeeper := getIdGenerator(config, backend)
+	logic := newSiteCommentsLogic(DEFAULT_SITE, config, backend, ids)
+	logic.nodeKeeper = nodeKeeper
+	return logic
+}
+
+// newSiteCommentsLogic creates storages of site, ids are shared by all sites
+func newSiteCommentsLogic(site string, config ApplicationConfig, backend *S3CommentsBackend, ids *SnowflakeIdGenerator) *SimpleCommentsLogic {
+	// NB: typed nil pointer in interface is not nil, so slowBackend stays nil without Minio
+	var storageS3 CommentsStorageInterface = nil
+	var voteStorage VoteStorageInterface = NewMemoryVoteStorage()
+	var moderationStorage ModerationStorageInterface = NewMemoryModerationStorage()
+	if backend != nil {
+		storageS3 = backend
+		voteStorage = backend
+		moderationStorage = backend
+	}
+	slowStorage := storageS3
+	cacheConfig := config.Cache
+	var invalidator CacheInvalidatorInterface = nil
+	if config.Redis != nil && storageS3 != nil {
+		storageRedis, err := NewSiteRedisCommentsStorage(site, *config.Redis, storageS3)
+		if err != nil {
+			log.Fatalf("Unable to init redis storage, error: %v", err.Error())
+		}
+		slowStorage = storageRedis
+		invalidator = NewRedisInvalidator(*config.Redis)
+	} else if storageS3 != nil && cacheConfig.MaxStaleness > 0 {
+		if cacheConfig.Ttl == 0 || cacheConfig.Ttl > cacheConfig.MaxStaleness {
+			log.Printf("Redis disabled, memory cache ttl is limited to %v\n", cacheConfig.MaxStaleness)
+			cacheConfig.Ttl = cacheConfig.MaxStaleness
+		}
+	}
+	storageMemory, _ := NewSiteMemoryStorage(site, slowStorage, cacheConfig)
+	if invalidator != nil {
+		storageMemory.LinkInvalidator(invalidator)
+	}
+	notifier, err := NewNotifier(site, config, NewSmtpMailer(config.Notify.Smtp))
+	if err != nil {
+		log.Fatalf("Unable to init notifications, error: %v", err.Error())
+	}
+	if notifier == nil && config.Policy.ReplyNotifications {
+		log.Printf("Notifications disabled, authors of comments are not notified about replies\n")
+	}
+	// without S3 memory storage is the only one
+	var freshStorage CommentsStorageInterface = storageMemory
+	if storageS3 != nil {
+		freshStorage = storageS3
+	}
+	hashSecret := config.HashSecret
+	if hashSecret == "" {
+		hashSecret = DefaultApplicationConfig().HashSecret
+	}
 	return &SimpleCommentsLogic{
 		storageS3:     storageS3,
 		storageMemory: storageMemory,
 		storage:       storageMemory,
+		policy:        config.Policy,
+		renderer:      NewMarkupRenderer(config.Markup),
+		hashSecret:    hashSecret,
+		ids:           ids,
+		votes:         NewVoteProcessor(voteStorage, storageMemory, freshStorage, ids.NodeId, config.VotesFlushInterval),
+		invalidator:   invalidator,
+		moderation:    moderationStorage,
+		signer:        NewModerationSigner(config),
+		notifier:      notifier,
 	}
 }
 
-func (logic *SimpleCommentsLogic) AddComment(uri string, inputComment *CommentModelInput) (*CommentModelOutput, error) {
+func (logic *SimpleCommentsLogic) AddComment(uri string, inputComment *CommentModelInput, client ClientInfo) (*CommentModelOutput, error) {
+	if err := NewCommentValidator(logic.policy).ValidateInput(inputComment); err != nil {
+		return nil, err
+	}
+	email := ""
+	if inputComment.Email != nil {
+		email = *inputComment.Email
+	}
+	if inputComment.Parent != nil && !logic.policy.ReplyToSelf && client.isAuthorOf(*inputComment.Parent) {
+		return nil, errors.New("replies to own comments are disabled")
+	}
+	var parentComment *CommentModelOutput = nil
 	if inputComment.Parent != nil {
-		parentComment, _ := logic.storage.GetComment(*inputComment.Parent)
-		if parentComment == nil {
+		parentComment, _ = logic.storage.GetComment(*inputComment.Parent)
+		if parentComment == nil || parentComment.Mode == MODE_PENDING {
 			return nil, fmt.Errorf("parent comment id: %v is unknown", *inputComment.Parent)
 		}
+		if parentComment.Uri != "" && parentComment.Uri != uri {
+			return nil, fmt.Errorf("parent comment id: %v is from another page", *inputComment.Parent)
+		}
+	}
+	newId, err := logic.ids.NextId()
+	if err != nil {
+		log.Printf("Unable to generate comment id: %v\n", err.Error())
+		return nil, err
+	}
+
+	// without email, author is the best available identity for avatar
+	identity := email
+	if identity == "" && inputComment.Author != nil {
+		identity = *inputComment.Author
+	}
+	notification := 0
+	if logic.policy.ReplyNotifications && email != "" {
+		notification = inputComment.Notification
+	}
+	// NB: gravatar of empty email is the same for everyone, so it is not an avatar at all
+	gravatarImage := ""
+	if logic.policy.Gravatar && email != "" {
+		gravatarImage = GetGravatarUrl(email, logic.policy.GravatarUrl)
+	}
+	mode := MODE_PUBLIC
+	if logic.policy.Moderation {
+		mode = MODE_PENDING
 	}
-	newId := time.Now().UnixMilli()
 
 	res := CommentModelOutput{
 		Id:            newId,
-		Parent:        nil,
+		Parent:        inputComment.Parent,
 		Created:       float64(time.Now().UnixMilli()) / 1000,
 		Modified:      nil,
-		Mode:          1,
-		Text:          RenderMarkdown(inputComment.Text),
+		Mode:          mode,
+		Text:          logic.renderer.Render(inputComment.Text),
+		TextSource:    inputComment.Text,
 		Author:        inputComment.Author,
 		Website:       inputComment.Website,
 		Likes:         0,
 		Dislikes:      0,
-		Notification:  1,
-		Hash:          CalculateUserHash(*inputComment.Email, "SECRET_KEY"),
+		Notification:  notification,
+		Hash:          CalculateUserHash(identity, logic.hashSecret),
 		TotalRelies:   0,
 		HiddenReplies: 0,
 		Replies:       []CommentModelOutput{},
+		GravatarImage: gravatarImage,
+		Uri:           uri,
+		AuthorVoter:   client.VoterId,
+	}
+	if notification == 1 && logic.notifier != nil {
+		if err := logic.notifier.Subscribe(&res, email); err != nil {
+			log.Printf("Unable to subscribe author of comment %v to replies: %v\n", res.Id, err.Error())
+			res.Notification = 0
+		}
 	}
-	_, err := logic.storage.AddComment(&res)
+	_, err = logic.storage.AddComment(&res)
 	if err != nil {
 		log.Printf("Unable to add comment to storage: %v\n", err.Error())
 		return nil, err
@@ -74,53 +243,567 @@ func (logic *SimpleCommentsLogic) AddComment(uri string, inputComment *CommentMo
 		log.Printf("Unable to add comment %v to page %v in storage, eror: %v\n", res.Id, uri, err.Error())
 		return nil, err
 	}
-	log.Printf("new comment: %v\n", res)
-	return &res, nil
+	if res.Mode == MODE_PENDING {
+		err = logic.moderation.AddPendingComment(res.Id, uri)
+		if err != nil {
+			log.Printf("Unable to add comment %v to pending comments: %v\n", res.Id, err.Error())
+			return nil, err
+		}
+		// NB: links are capabilities to moderate, so they are not logged
+		log.Printf("comment %v is pending moderation\n", res.Id)
+	}
+	// NB: comment has encrypted email and hashed address of author, so only its id is logged
+	log.Printf("new comment %v on page %v\n", res.Id, uri)
+	if logic.notifier != nil {
+		logic.notifier.NotifyNewComment(&res, parentComment)
+		if res.Mode == MODE_PUBLIC {
+			logic.notifyReply(&res)
+		}
+	}
+	return logic.withAvatars(&res), nil
+}
+
+// withAvatars hides avatars disabled by policy. Hash is kept in storage, it is needed to
+// recognize authors, so returns copy if something is hidden
+func (logic *SimpleCommentsLogic) withAvatars(comment *CommentModelOutput) *CommentModelOutput {
+	hideHash := !logic.policy.Avatar && comment.Hash != ""
+	hideGravatar := !logic.policy.Gravatar && comment.GravatarImage != ""
+	if !hideHash && !hideGravatar {
+		return comment
+	}
+	res := *comment
+	if hideHash {
+		res.Hash = ""
+	}
+	if hideGravatar {
+		res.GravatarImage = ""
+	}
+	return &res
+}
+
+func nilIfEmpty(value *string) *string {
+	if value == nil || *value == "" {
+		return nil
+	}
+	return value
+}
+
+// getModifiableComment returns comment only if its author still can change it
+func (logic *SimpleCommentsLogic) getModifiableComment(commentId int64, now time.Time) (*CommentModelOutput, error) {
+	comment, err := logic.storage.GetComment(commentId)
+	if comment == nil || err != nil || comment.Mode == MODE_DELETED {
+		return nil, fmt.Errorf("%w: %v", ErrCommentNotFound, commentId)
+	}
+	created := time.UnixMilli(int64(comment.Created * 1000))
+	if now.Sub(created) > logic.policy.EditMaxAge {
+		return nil, fmt.Errorf("%w: %v", ErrEditWindowExpired, commentId)
+	}
+	return comment, nil
+}
+
+func (logic *SimpleCommentsLogic) EditComment(commentId int64, edit *CommentModelEdit) (*CommentModelOutput, error) {
+	if err := NewCommentValidator(logic.policy).ValidateEdit(edit); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	comment, err := logic.getModifiableComment(commentId, now)
+	if err != nil {
+		return nil, err
+	}
+	return logic.editComment(comment, edit, now)
+}
+
+// editComment saves validated edit
+func (logic *SimpleCommentsLogic) editComment(comment *CommentModelOutput, edit *CommentModelEdit, now time.Time) (*CommentModelOutput, error) {
+	// memory storage returns shared pointer, so modify a copy until it is saved
+	updated := *comment
+	updated.Text = logic.renderer.Render(edit.Text)
+	updated.TextSource = edit.Text
+	// empty values remove fields
+	if edit.Author != nil {
+		updated.Author = nilIfEmpty(edit.Author)
+	}
+	if edit.Website != nil {
+		updated.Website = nilIfEmpty(edit.Website)
+	}
+	modified := float64(now.UnixMilli()) / 1000
+	updated.Modified = &modified
+
+	err := logic.storage.UpdateComment(&updated)
+	if err != nil {
+		log.Printf("Unable to update comment %v in storage: %v\n", comment.Id, err.Error())
+		return nil, err
+	}
+	return logic.withAvatars(&updated), nil
+}
+
+func (logic *SimpleCommentsLogic) hasReplies(uri string, commentId int64) (bool, error) {
+	commentIds, err := logic.storage.GetPageComments(uri)
+	if err != nil {
+		return false, err
+	}
+	for _, pageCommentId := range commentIds {
+		reply, err := logic.storage.GetComment(pageCommentId)
+		if reply == nil || err != nil {
+			continue
+		}
+		if reply.Parent != nil && *reply.Parent == commentId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeComment deletes comment without replies and its deleted parents, which became useless
+func (logic *SimpleCommentsLogic) removeComment(comment *CommentModelOutput) error {
+	err := logic.storage.RemoveCommentFromPage(comment.Uri, comment.Id)
+	if err != nil {
+		log.Printf("Unable to remove comment %v from page %v: %v\n", comment.Id, comment.Uri, err.Error())
+		return err
+	}
+	err = logic.storage.DeleteComment(comment.Id)
+	if err != nil {
+		log.Printf("Unable to delete comment %v: %v\n", comment.Id, err.Error())
+		return err
+	}
+	if comment.Parent == nil {
+		return nil
+	}
+	parent, err := logic.storage.GetComment(*comment.Parent)
+	if parent == nil || err != nil || parent.Mode != MODE_DELETED {
+		return nil
+	}
+	parentHasReplies, err := logic.hasReplies(parent.Uri, parent.Id)
+	if err != nil || parentHasReplies {
+		return nil
+	}
+	return logic.removeComment(parent)
+}
+
+func (logic *SimpleCommentsLogic) DeleteComment(commentId int64) (*CommentModelOutput, error) {
+	comment, err := logic.getModifiableComment(commentId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	res, err := logic.deleteComment(comment)
+	if err == nil && comment.Mode == MODE_PENDING {
+		logic.removePendingMark(commentId)
+	}
+	return res, err
+}
+
+// deleteComment removes comment without replies or replaces it with tombstone
+func (logic *SimpleCommentsLogic) deleteComment(comment *CommentModelOutput) (*CommentModelOutput, error) {
+	commentId := comment.Id
+	// comments without uri are created before it was stored, keep them as tombstones
+	isLeaf := false
+	if comment.Uri != "" {
+		commentHasReplies, err := logic.hasReplies(comment.Uri, commentId)
+		if err != nil {
+			log.Printf("Unable to load replies for comment %v: %v\n", commentId, err.Error())
+			return nil, err
+		}
+		isLeaf = !commentHasReplies
+	}
+	if isLeaf {
+		return nil, logic.removeComment(comment)
+	}
+
+	tombstone := *comment
+	tombstoneModifier(&tombstone)
+	err := logic.storage.UpdateComment(&tombstone)
+	if err != nil {
+		log.Printf("Unable to mark comment %v as deleted: %v\n", commentId, err.Error())
+		return nil, err
+	}
+	return logic.withAvatars(&tombstone), nil
+}
+
+func (logic *SimpleCommentsLogic) GetComment(commentId int64, plain bool) (*CommentModelOutput, error) {
+	comment, err := logic.storage.GetComment(commentId)
+	if comment == nil || err != nil || comment.Mode == MODE_DELETED {
+		return nil, fmt.Errorf("%w: %v", ErrCommentNotFound, commentId)
+	}
+	res := *comment
+	// old comments have no source, so rendered text is the best what we have
+	if plain && res.TextSource != "" {
+		res.Text = res.TextSource
+	}
+	return logic.withAvatars(&res), nil
+}
+
+// RerenderComments rebuilds html of all stored comments from their markdown source,
+// html of old comments without source is sanitized. Returns number of updated comments
+func (logic *SimpleCommentsLogic) RerenderComments() (int, error) {
+	commentIds, err := logic.storage.ListComments()
+	if err != nil {
+		return 0, err
+	}
+	updatedCount := 0
+	for _, commentId := range commentIds {
+		comment, err := logic.storage.GetComment(commentId)
+		if comment == nil || err != nil {
+			log.Printf("Unable to load comment %v for rerender\n", commentId)
+			continue
+		}
+		if comment.Mode == MODE_DELETED {
+			continue
+		}
+		rendered := logic.renderer.Sanitize(comment.Text)
+		if comment.TextSource != "" {
+			rendered = logic.renderer.Render(comment.TextSource)
+		}
+		if rendered == comment.Text {
+			continue
+		}
+		updated := *comment
+		updated.Text = rendered
+		err = logic.storage.UpdateComment(&updated)
+		if err != nil {
+			return updatedCount, err
+		}
+		updatedCount += 1
+	}
+	return updatedCount, nil
 }
 
-func (logic *SimpleCommentsLogic) GetComments(uri string, nestedLimit int) []*CommentModelOutput {
+// GetComments returns comments of page with their replies inside,
+// only replies of query.Parent if it is set
+func (logic *SimpleCommentsLogic) GetComments(uri string, query CommentsQuery, client ClientInfo) *CommentsThread {
 	commentIds, error := logic.storage.GetPageComments(uri)
 	if error != nil {
 		log.Printf("Unable to load comments for %v\n", uri)
-		return make([]*CommentModelOutput, 0)
+		return buildCommentsThread(make([]*CommentModelOutput, 0), query)
 	}
 
-	res := make([]*CommentModelOutput, 0, len(commentIds))
+	pageComments := make([]*CommentModelOutput, 0, len(commentIds))
 	for _, comment := range commentIds {
 		commentData, err := logic.storage.GetComment(int64(comment))
 		if commentData == nil || err != nil {
 			log.Printf("Unable to load comment %v from page %v\n", comment, uri)
 			continue
 		}
-		res = append(res, commentData)
+		if commentData.Mode == MODE_PENDING && !client.isAuthorOf(commentData.Id) {
+			continue
+		}
+		pageComments = append(pageComments, logic.withAvatars(commentData))
+	}
+	return buildCommentsThread(pageComments, query)
+}
+
+// GetLatestComments returns flat list of public comments, newest first
+func (logic *SimpleCommentsLogic) GetLatestComments(uri string, limit int) []*CommentModelOutput {
+	commentIds, err := logic.storage.GetPageComments(uri)
+	if err != nil {
+		log.Printf("Unable to load comments for %v\n", uri)
+		return make([]*CommentModelOutput, 0)
+	}
+	res := make([]*CommentModelOutput, 0, len(commentIds))
+	for _, commentId := range commentIds {
+		comment, err := logic.storage.GetComment(commentId)
+		if comment == nil || err != nil || comment.Mode != MODE_PUBLIC {
+			continue
+		}
+		res = append(res, comment)
+	}
+	return limitComments(res, limit, SORT_NEWEST)
+}
+
+func (logic *SimpleCommentsLogic) CountComments(uris []string, client ClientInfo) ([]int, error) {
+	counts, err := logic.storage.GetCommentsCounts(uris)
+	if err != nil {
+		log.Printf("Unable to count comments for %v pages: %v\n", len(uris), err.Error())
+		return nil, err
+	}
+	// NB: counts are cached for everyone, so own pending comments are added after
+	for _, commentId := range client.authoredIds() {
+		comment, err := logic.storage.GetComment(commentId)
+		if comment == nil || err != nil || comment.Mode != MODE_PENDING {
+			continue
+		}
+		for ind, uri := range uris {
+			if uri == comment.Uri {
+				counts[ind] += 1
+			}
+		}
+	}
+	return counts, nil
+}
+
+// getPendingComment returns comment only if it still waits for moderation
+func (logic *SimpleCommentsLogic) getPendingComment(commentId int64) (*CommentModelOutput, error) {
+	comment, err := logic.storage.GetComment(commentId)
+	if comment == nil || err != nil || comment.Mode == MODE_DELETED {
+		return nil, fmt.Errorf("%w: %v", ErrCommentNotFound, commentId)
+	}
+	if comment.Mode != MODE_PENDING {
+		return nil, fmt.Errorf("%w: %v", ErrCommentNotPending, commentId)
+	}
+	return comment, nil
+}
+
+// removePendingMark is not critical, comments from list are checked by their mode
+func (logic *SimpleCommentsLogic) removePendingMark(commentId int64) {
+	if err := logic.moderation.RemovePendingComment(commentId); err != nil {
+		log.Printf("Unable to remove comment %v from pending comments: %v\n", commentId, err.Error())
+	}
+}
+
+func (logic *SimpleCommentsLogic) GetPendingComments() ([]*CommentModelOutput, error) {
+	commentIds, err := logic.moderation.ListPendingComments()
+	if err != nil {
+		log.Printf("Unable to list pending comments: %v\n", err.Error())
+		return nil, err
+	}
+	res := make([]*CommentModelOutput, 0, len(commentIds))
+	for _, commentId := range commentIds {
+		comment, err := logic.storage.GetComment(commentId)
+		if comment == nil || err != nil || comment.Mode != MODE_PENDING {
+			log.Printf("Comment %v is not pending anymore\n", commentId)
+			continue
+		}
+		res = append(res, comment)
+	}
+	sortComments(res, SORT_OLDEST)
+	return res, nil
+}
+
+// ApproveComment publishes pending comment
+func (logic *SimpleCommentsLogic) ApproveComment(commentId int64) (*CommentModelOutput, error) {
+	comment, err := logic.getPendingComment(commentId)
+	if err != nil {
+		return nil, err
+	}
+	approved := *comment
+	approved.Mode = MODE_PUBLIC
+	err = logic.storage.UpdateComment(&approved)
+	if err != nil {
+		log.Printf("Unable to approve comment %v: %v\n", commentId, err.Error())
+		return nil, err
+	}
+	logic.removePendingMark(commentId)
+	log.Printf("comment %v is approved\n", commentId)
+	logic.notifyReply(&approved)
+	return &approved, nil
+}
+
+// notifyReply sends published reply to subscribed author of parent, except replies to own comments
+func (logic *SimpleCommentsLogic) notifyReply(comment *CommentModelOutput) {
+	if logic.notifier == nil || comment.Parent == nil {
+		return
+	}
+	parent, err := logic.storage.GetComment(*comment.Parent)
+	if parent == nil || err != nil || parent.Mode != MODE_PUBLIC || parent.Hash == comment.Hash {
+		return
+	}
+	logic.notifier.NotifyReply(comment, parent)
+}
+
+func (logic *SimpleCommentsLogic) Unsubscribe(commentId int64) error {
+	comment, err := logic.storage.GetComment(commentId)
+	if comment == nil || err != nil || comment.Mode == MODE_DELETED {
+		return fmt.Errorf("%w: %v", ErrCommentNotFound, commentId)
 	}
+	if comment.Notification == 0 && comment.EncryptedEmail == "" {
+		return nil
+	}
+	updated := *comment
+	updated.Notification = 0
+	updated.EncryptedEmail = ""
+	err = logic.storage.UpdateComment(&updated)
+	if err != nil {
+		log.Printf("Unable to unsubscribe comment %v: %v\n", commentId, err.Error())
+	}
+	return err
+}
+
+// RejectComment deletes pending comment regardless of edit window
+func (logic *SimpleCommentsLogic) RejectComment(commentId int64) (*CommentModelOutput, error) {
+	comment, err := logic.getPendingComment(commentId)
+	if err != nil {
+		return nil, err
+	}
+	res, err := logic.deleteComment(comment)
+	if err != nil {
+		return nil, err
+	}
+	logic.removePendingMark(commentId)
+	log.Printf("comment %v is rejected\n", commentId)
+	return res, nil
+}
+
+// Like returns current counts even if vote is rejected
+func (logic *SimpleCommentsLogic) Like(commentId int64, client ClientInfo) (int64, int64, error) {
+	votes, err := logic.votes.Vote(commentId, client, likeModifier)
+	return int64(votes.Likes), int64(votes.Dislikes), err
+}
+
+func (logic *SimpleCommentsLogic) Dislike(commentId int64, client ClientInfo) (int64, int64, error) {
+	votes, err := logic.votes.Vote(commentId, client, dislikeModifier)
+	return int64(votes.Likes), int64(votes.Dislikes), err
+}
+
+// Close saves all buffered data, logic can't be used after it
+func (logic *SimpleCommentsLogic) Close() error {
+	err := logic.votes.Close()
+	if logic.invalidator != nil {
+		logic.invalidator.Close()
+	}
+	if logic.notifier != nil {
+		logic.notifier.Close()
+	}
+	// votes are flushed above with claimed node id
+	if logic.nodeKeeper != nil {
+		logic.nodeKeeper.Close()
+	}
+	return err
+}
+
+// loadPageComments returns comments of page, newest first
+func (logic *SimpleCommentsLogic) loadPageComments(uri string) []*CommentModelOutput {
+	commentIds, err := logic.storage.GetPageComments(uri)
+	if err != nil {
+		// unknown page without slow storage
+		log.Printf("Unable to load comments for %v\n", uri)
+		commentIds = nil
+	}
+	res := make([]*CommentModelOutput, 0, len(commentIds))
+	for _, commentId := range commentIds {
+		comment, err := logic.storage.GetComment(commentId)
+		if comment == nil || err != nil {
+			log.Printf("Unable to load comment %v\n", commentId)
+			continue
+		}
+		res = append(res, comment)
+	}
+	sortComments(res, SORT_NEWEST)
 	return res
 }
 
-func likeDislikeProcessorLogic(
-	logic *SimpleCommentsLogic,
-	commentId int64,
-	modifier func(*CommentModelOutput),
-) (int64, int64, error) {
-	comment, error := logic.storage.GetComment(commentId)
-	if error != nil {
-		return 0, 0, error
+// FindComments returns comments for admin area, including pending and deleted ones.
+// Without page only shown comments are loaded, others are filtered by index of storage
+func (logic *SimpleCommentsLogic) FindComments(query AdminQuery) (int, []*CommentModelOutput, error) {
+	var entries []CommentIndexEntry
+	loaded := make(map[int64]*CommentModelOutput)
+	if query.Uri != "" {
+		// comments of page are loaded anyway
+		for _, comment := range logic.loadPageComments(query.Uri) {
+			entries = append(entries, CommentIndexEntry{Id: comment.Id, Page: comment.Uri, Mode: comment.Mode})
+			loaded[comment.Id] = comment
+		}
+	} else {
+		var err error
+		entries, err = logic.storage.ListCommentsIndex()
+		if err != nil {
+			log.Printf("Unable to list comments: %v\n", err.Error())
+			return 0, nil, err
+		}
 	}
-	if comment == nil {
-		return 0, 0, fmt.Errorf("comment with id: %v not found", commentId)
+	filtered := make([]CommentIndexEntry, 0, len(entries))
+	for _, entry := range entries {
+		if query.Mode == 0 || entry.Mode == query.Mode {
+			filtered = append(filtered, entry)
+		}
 	}
-	modifier(comment)
-	error = logic.storage.UpdateComment(comment)
-	if error != nil {
-		return 0, 0, error
+	if query.Offset >= len(filtered) {
+		return len(filtered), make([]*CommentModelOutput, 0), nil
 	}
-	return int64(comment.Likes), int64(comment.Dislikes), nil
+	shown := filtered[query.Offset:]
+	if query.Limit >= 0 && len(shown) > query.Limit {
+		shown = shown[:query.Limit]
+	}
+	res := make([]*CommentModelOutput, 0, len(shown))
+	for _, entry := range shown {
+		comment, exists := loaded[entry.Id]
+		if !exists {
+			var err error
+			comment, err = logic.storage.GetComment(entry.Id)
+			if comment == nil || err != nil {
+				log.Printf("Unable to load comment %v\n", entry.Id)
+				continue
+			}
+		}
+		res = append(res, comment)
+	}
+	return len(filtered), res, nil
 }
 
-func (logic *SimpleCommentsLogic) Like(commentId int64) (int64, int64, error) {
-	return likeDislikeProcessorLogic(logic, commentId, likeModifier)
+// GetThreads groups index of comments by pages, only the latest comment of page is loaded.
+// Old comments without uri are skipped
+func (logic *SimpleCommentsLogic) GetThreads() ([]ThreadModel, error) {
+	entries, err := logic.storage.ListCommentsIndex()
+	if err != nil {
+		log.Printf("Unable to list comments: %v\n", err.Error())
+		return nil, err
+	}
+	type pageSummary struct {
+		latest   int64
+		comments int
+		pending  int
+	}
+	pages := make(map[string]*pageSummary)
+	order := make([]string, 0)
+	for _, entry := range entries {
+		if entry.Page == "" {
+			continue
+		}
+		page, exists := pages[entry.Page]
+		if !exists {
+			// entries are sorted, so first one is the latest
+			page = &pageSummary{latest: entry.Id}
+			pages[entry.Page] = page
+			order = append(order, entry.Page)
+		}
+		switch entry.Mode {
+		case MODE_PUBLIC:
+			page.comments += 1
+		case MODE_PENDING:
+			page.pending += 1
+		}
+	}
+	// NB: page of S3 has other hash after change of page secret, so pages are joined by uri
+	threads := make(map[string]int)
+	res := make([]ThreadModel, 0, len(order))
+	for _, pageKey := range order {
+		page := pages[pageKey]
+		latest, err := logic.storage.GetComment(page.latest)
+		if latest == nil || err != nil || latest.Uri == "" {
+			log.Printf("Unable to load comment %v\n", page.latest)
+			continue
+		}
+		ind, exists := threads[latest.Uri]
+		if !exists {
+			ind = len(res)
+			threads[latest.Uri] = ind
+			res = append(res, ThreadModel{Uri: latest.Uri, Latest: latest.Created})
+		}
+		res[ind].Comments += page.comments
+		res[ind].Pending += page.pending
+	}
+	return res, nil
 }
 
-func (logic *SimpleCommentsLogic) Dislike(commentId int64) (int64, int64, error) {
-	return likeDislikeProcessorLogic(logic, commentId, dislikeModifier)
+// AdminEditComment changes comment of any author regardless of edit window
+func (logic *SimpleCommentsLogic) AdminEditComment(commentId int64, edit *CommentModelEdit) (*CommentModelOutput, error) {
+	if err := NewCommentValidator(logic.policy).ValidateEdit(edit); err != nil {
+		return nil, err
+	}
+	comment, err := logic.storage.GetComment(commentId)
+	if comment == nil || err != nil || comment.Mode == MODE_DELETED {
+		return nil, fmt.Errorf("%w: %v", ErrCommentNotFound, commentId)
+	}
+	return logic.editComment(comment, edit, time.Now())
+}
+
+// AdminDeleteComment deletes comment of any author regardless of edit window
+func (logic *SimpleCommentsLogic) AdminDeleteComment(commentId int64) (*CommentModelOutput, error) {
+	comment, err := logic.storage.GetComment(commentId)
+	if comment == nil || err != nil || comment.Mode == MODE_DELETED {
+		return nil, fmt.Errorf("%w: %v", ErrCommentNotFound, commentId)
+	}
+	res, err := logic.deleteComment(comment)
+	if err == nil && comment.Mode == MODE_PENDING {
+		logic.removePendingMark(commentId)
+	}
+	return res, err
 }
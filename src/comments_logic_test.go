@@ -0,0 +1,291 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getMemoryCommentsLogic() *SimpleCommentsLogic {
+	return GetCommentsLogic(ApplicationConfig{Policy: DefaultPolicyConfig()})
+}
+
+func addStoredComment(t *testing.T, logic *SimpleCommentsLogic, uri string, commentId int64, parent *int64) {
+	comment := CommentModelOutput{
+		Id:      commentId,
+		Parent:  parent,
+		Created: float64(time.Now().UnixMilli()) / 1000,
+		Mode:    MODE_PUBLIC,
+		Text:    "<p>text</p>",
+		Author:  s("author"),
+		Uri:     uri,
+	}
+	_, err := logic.storage.AddComment(&comment)
+	assert.Nil(t, err)
+	assert.Nil(t, logic.storage.AddCommentToPage(uri, commentId))
+}
+
+func modifyStoredComment(t *testing.T, logic *SimpleCommentsLogic, commentId int64, modifier func(*CommentModelOutput)) {
+	comment, err := logic.storage.GetComment(commentId)
+	assert.Nil(t, err)
+	modifier(comment)
+	assert.Nil(t, logic.storage.UpdateComment(comment))
+}
+
+func TestDeleteCommentWithReplies(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	uri := "example.com/thread"
+	var parentId int64 = 1
+	addStoredComment(t, logic, uri, 1, nil)
+	addStoredComment(t, logic, uri, 2, &parentId)
+
+	tombstone, err := logic.DeleteComment(1)
+	assert.Nil(t, err)
+	assert.NotNil(t, tombstone)
+	assert.Equal(t, MODE_DELETED, tombstone.Mode)
+	assert.Equal(t, "", tombstone.Text)
+	assert.Nil(t, tombstone.Author)
+
+	pageComments, _ := logic.storage.GetPageComments(uri)
+	assert.Equal(t, []int64{1, 2}, pageComments)
+	counts, err := logic.CountComments([]string{uri}, ClientInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, counts)
+
+	// last reply removes tombstone of its parent too
+	removed, err := logic.DeleteComment(2)
+	assert.Nil(t, err)
+	assert.Nil(t, removed)
+	pageComments, _ = logic.storage.GetPageComments(uri)
+	assert.Equal(t, []int64{}, pageComments)
+	_, err = logic.storage.GetComment(1)
+	assert.NotNil(t, err)
+}
+
+func TestDeleteCommentAfterEditWindow(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	logic.policy.EditMaxAge = 0
+	addStoredComment(t, logic, "example.com/old", 1, nil)
+
+	_, err := logic.DeleteComment(1)
+	assert.ErrorIs(t, err, ErrEditWindowExpired)
+}
+
+func TestRerenderComments(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	addStoredComment(t, logic, "example.com/rerender", 1, nil)
+	addStoredComment(t, logic, "example.com/rerender", 2, nil)
+	modifyStoredComment(t, logic, 1, func(comment *CommentModelOutput) {
+		comment.TextSource = "*new* text"
+	})
+
+	updatedCount, err := logic.RerenderComments()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, updatedCount)
+	rerendered, _ := logic.GetComment(1, false)
+	assert.Equal(t, "<p><em>new</em> text</p>\n", rerendered.Text)
+	withoutSource, _ := logic.GetComment(2, true)
+	assert.Equal(t, "<p>text</p>", withoutSource.Text)
+}
+
+func TestCommentRecord(t *testing.T) {
+	comment := CommentModelOutput{Id: 1, Text: "<p>text</p>", Uri: "example.com", TextSource: "text", EncryptedEmail: "encrypted"}
+	data, err := MarshalCommentRecord(&comment)
+	assert.Nil(t, err)
+	loaded, err := UnmarshalCommentRecord(data)
+	assert.Nil(t, err)
+	assert.Equal(t, comment, *loaded)
+}
+
+func TestGetCommentsTree(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	uri := "example.com/tree"
+	var rootId, replyId, unknownId int64 = 1, 2, 100
+	addStoredComment(t, logic, uri, rootId, nil)
+	addStoredComment(t, logic, uri, replyId, &rootId)
+	addStoredComment(t, logic, uri, 3, &rootId)
+	addStoredComment(t, logic, uri, 4, &replyId)
+	addStoredComment(t, logic, uri, 5, &unknownId)
+
+	thread := logic.GetComments(uri, DefaultCommentsQuery(), ClientInfo{})
+	assert.Nil(t, thread.Id)
+	assert.Equal(t, 2, thread.TotalReplies)
+	comments := thread.Replies
+	root := comments[0]
+	assert.Equal(t, rootId, root.Id)
+	assert.Equal(t, 2, root.TotalRelies)
+	assert.Equal(t, 0, root.HiddenReplies)
+	assert.Equal(t, replyId, root.Replies[0].Id)
+	assert.Equal(t, 1, root.Replies[0].TotalRelies)
+	assert.Equal(t, int64(4), root.Replies[0].Replies[0].Id)
+	assert.Equal(t, int64(5), comments[1].Id)
+
+	query := DefaultCommentsQuery()
+	query.NestedLimit = 1
+	limited := logic.GetComments(uri, query, ClientInfo{}).Replies
+	assert.Equal(t, 2, limited[0].TotalRelies)
+	assert.Equal(t, 1, limited[0].HiddenReplies)
+	assert.Equal(t, 1, len(limited[0].Replies))
+
+	// stored comments are not modified by tree building
+	stored, _ := logic.storage.GetComment(rootId)
+	assert.Equal(t, 0, len(stored.Replies))
+}
+
+func TestGetCommentsQuery(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	uri := "example.com/query"
+	var rootId int64 = 1
+	for commentId := int64(1); commentId <= 4; commentId++ {
+		addStoredComment(t, logic, uri, commentId, nil)
+	}
+	for commentId := int64(5); commentId <= 7; commentId++ {
+		addStoredComment(t, logic, uri, commentId, &rootId)
+	}
+	for ind, commentId := range []int64{1, 2, 3, 4, 5, 6, 7} {
+		modifyStoredComment(t, logic, commentId, func(comment *CommentModelOutput) {
+			comment.Created = float64(100 + ind)
+		})
+	}
+	modifyStoredComment(t, logic, 3, func(comment *CommentModelOutput) {
+		comment.Likes = 5
+	})
+	modifyStoredComment(t, logic, 2, func(comment *CommentModelOutput) {
+		comment.TextSource = "plain"
+	})
+
+	getIds := func(thread *CommentsThread) []int64 {
+		res := make([]int64, 0)
+		for _, comment := range thread.Replies {
+			res = append(res, comment.Id)
+		}
+		return res
+	}
+
+	t.Run("TestLimit", func(t *testing.T) {
+		query := DefaultCommentsQuery()
+		query.Limit = 2
+		query.NestedLimit = 0
+		thread := logic.GetComments(uri, query, ClientInfo{})
+		assert.Equal(t, []int64{1, 2}, getIds(thread))
+		assert.Equal(t, 4, thread.TotalReplies)
+		assert.Equal(t, 2, thread.HiddenReplies)
+		assert.Equal(t, 3, thread.Replies[0].HiddenReplies)
+	})
+	t.Run("TestParent", func(t *testing.T) {
+		query := DefaultCommentsQuery()
+		query.Parent = &rootId
+		query.Limit = 1
+		thread := logic.GetComments(uri, query, ClientInfo{})
+		assert.Equal(t, rootId, *thread.Id)
+		assert.Equal(t, []int64{5}, getIds(thread))
+		assert.Equal(t, 2, thread.HiddenReplies)
+	})
+	t.Run("TestAfter", func(t *testing.T) {
+		query := DefaultCommentsQuery()
+		query.After = 102
+		thread := logic.GetComments(uri, query, ClientInfo{})
+		assert.Equal(t, []int64{4}, getIds(thread))
+
+		query.Parent = &rootId
+		thread = logic.GetComments(uri, query, ClientInfo{})
+		assert.Equal(t, []int64{5, 6, 7}, getIds(thread))
+	})
+	t.Run("TestSort", func(t *testing.T) {
+		query := DefaultCommentsQuery()
+		query.Sort = SORT_NEWEST
+		assert.Equal(t, []int64{4, 3, 2, 1}, getIds(logic.GetComments(uri, query, ClientInfo{})))
+		query.Sort = SORT_UPVOTES
+		assert.Equal(t, []int64{3, 1, 2, 4}, getIds(logic.GetComments(uri, query, ClientInfo{})))
+	})
+	t.Run("TestPlain", func(t *testing.T) {
+		query := DefaultCommentsQuery()
+		query.Plain = true
+		thread := logic.GetComments(uri, query, ClientInfo{})
+		assert.Equal(t, "plain", thread.Replies[1].Text)
+		assert.Equal(t, "<p>text</p>", thread.Replies[2].Text)
+	})
+}
+
+func TestAddCommentPolicy(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	uri := "example.com/policy"
+
+	t.Run("TestRequireFields", func(t *testing.T) {
+		logic.policy.RequireEmail = true
+		logic.policy.RequireAuthor = true
+		defer func() { logic.policy = DefaultPolicyConfig() }()
+
+		withoutEmail := getFakeInputComment()
+		withoutEmail.Email = nil
+		_, err := logic.AddComment(uri, &withoutEmail, ClientInfo{})
+		assert.NotNil(t, err)
+
+		withoutAuthor := getFakeInputComment()
+		withoutAuthor.Author = s("")
+		_, err = logic.AddComment(uri, &withoutAuthor, ClientInfo{})
+		assert.NotNil(t, err)
+	})
+	t.Run("TestOptionalEmail", func(t *testing.T) {
+		withoutEmail := getFakeInputComment()
+		withoutEmail.Email = nil
+		withoutEmail.Notification = 1
+		comment, err := logic.AddComment(uri, &withoutEmail, ClientInfo{})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, comment.Notification)
+	})
+	t.Run("TestReplyToSelf", func(t *testing.T) {
+		addStoredComment(t, logic, uri, 1, nil)
+		reply := getFakeInputComment()
+		var parentId int64 = 1
+		reply.Parent = &parentId
+		author := ClientInfo{IsAuthorOf: func(commentId int64) bool { return commentId == parentId }}
+
+		_, err := logic.AddComment(uri, &reply, author)
+		assert.NotNil(t, err)
+
+		logic.policy.ReplyToSelf = true
+		defer func() { logic.policy = DefaultPolicyConfig() }()
+		_, err = logic.AddComment(uri, &reply, author)
+		assert.Nil(t, err)
+	})
+	t.Run("TestGravatarAndNotifications", func(t *testing.T) {
+		logic.policy.Gravatar = true
+		logic.policy.ReplyNotifications = true
+		defer func() { logic.policy = DefaultPolicyConfig() }()
+
+		input := getFakeInputComment()
+		input.Notification = 1
+		comment, err := logic.AddComment(uri, &input, ClientInfo{})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, comment.Notification)
+		assert.Contains(t, comment.GravatarImage, "https://www.gravatar.com/avatar/")
+
+		withoutEmail := getFakeInputComment()
+		withoutEmail.Email = nil
+		comment, err = logic.AddComment(uri, &withoutEmail, ClientInfo{})
+		assert.Nil(t, err)
+		assert.Equal(t, "", comment.GravatarImage)
+	})
+	t.Run("TestAvatarDisabled", func(t *testing.T) {
+		input := getFakeInputComment()
+		comment, err := logic.AddComment(uri, &input, ClientInfo{})
+		assert.Nil(t, err)
+		assert.NotEqual(t, "", comment.Hash)
+
+		logic.policy.Avatar = false
+		defer func() { logic.policy = DefaultPolicyConfig() }()
+		output, err := logic.GetComment(comment.Id, false)
+		assert.Nil(t, err)
+		assert.Equal(t, "", output.Hash)
+		thread := logic.GetComments(uri, DefaultCommentsQuery(), ClientInfo{})
+		assert.NotEmpty(t, thread.Replies)
+		for _, reply := range thread.Replies {
+			assert.Equal(t, "", reply.Hash)
+		}
+		// hash is kept in storage to recognize authors
+		stored, _ := logic.storage.GetComment(comment.Id)
+		assert.NotEqual(t, "", stored.Hash)
+	})
+}
@@ -1,17 +1,98 @@
 package main
 
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+const COUNT_WORKERS = 8 // parallel page loads for /count
+
+// CommentIndexEntry is summary of stored comment, enough to filter and group comments without loading them
+type CommentIndexEntry struct {
+	Id   int64
+	Page string // same for comments of one uri, empty for old comments without uri
+	Mode int
+}
+
 type CommentsStorageInterface interface {
 	GetPageComments(uri string) ([]int64, error)
 	AddCommentToPage(uri string, commentId int64) error
+	RemoveCommentFromPage(uri string, commentId int64) error
 	AddComment(commentData *CommentModelOutput) (int64, error) // comment id
 	UpdateComment(commentData *CommentModelOutput) error
 	GetComment(commentId int64) (*CommentModelOutput, error)
+	DeleteComment(commentId int64) error
+	ListComments() ([]int64, error)                  // ids of all stored comments
+	ListCommentsIndex() ([]CommentIndexEntry, error) // all stored comments, newest first
+	GetCommentsCounts(uris []string) ([]int, error)  // public comments for each uri, same order
+}
+
+// sortIndexEntries orders entries newest first, ids grow with time
+func sortIndexEntries(entries []CommentIndexEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Id > entries[j].Id })
 }
 
-func likeModifier(comment *CommentModelOutput) {
-	comment.Likes += 1
+func isCountedComment(comment *CommentModelOutput) bool {
+	return comment != nil && comment.Mode == MODE_PUBLIC
+}
+
+// countPageComments loads page and its comments through storage,
+// so every cache layer counts with its own cached comments
+func countPageComments(storage CommentsStorageInterface, uri string) (int, error) {
+	commentIds, err := storage.GetPageComments(uri)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, commentId := range commentIds {
+		comment, err := storage.GetComment(commentId)
+		if err != nil {
+			log.Printf("Unable to load comment %v from page %v for count\n", commentId, uri)
+			continue
+		}
+		if isCountedComment(comment) {
+			count += 1
+		}
+	}
+	return count, nil
+}
+
+// countPages runs countPage for every uri in parallel, counts are in same order
+func countPages(uris []string, countPage func(uri string) (int, error)) ([]int, error) {
+	res := make([]int, len(uris))
+	errs := make([]error, len(uris))
+
+	var wg sync.WaitGroup
+	tasks := make(chan int)
+	for worker := 0; worker < COUNT_WORKERS; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ind := range tasks {
+				res[ind], errs[ind] = countPage(uris[ind])
+			}
+		}()
+	}
+	for ind := range uris {
+		tasks <- ind
+	}
+	close(tasks)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
 }
 
-func dislikeModifier(comment *CommentModelOutput) {
-	comment.Dislikes += 1
+func tombstoneModifier(comment *CommentModelOutput) {
+	comment.Mode = MODE_DELETED
+	comment.Text = ""
+	comment.Author = nil
+	comment.Website = nil
+	comment.Notification = 0
+	comment.EncryptedEmail = ""
 }
@@ -1,32 +1,310 @@
 package main
 
-import "os"
+import (
+	"time"
+)
 
 type ApplicationConfig struct {
-	Minio *MinioConfig
+	Server     ServerConfig `yaml:"server"`
+	Minio      *MinioConfig `yaml:"s3"`
+	Redis      *RedisConfig `yaml:"redis"` // optional cache shared by replicas, used only with Minio
+	Cache      CacheConfig  `yaml:"cache"`
+	Policy     PolicyConfig `yaml:"policy"`
+	Markup     MarkupConfig `yaml:"markup"`
+	Feed       FeedConfig   `yaml:"feed"`
+	Admin      AdminConfig  `yaml:"admin"` // shared by all sites
+	Notify     NotifyConfig `yaml:"notifications"`
+	SessionKey string       `yaml:"session_key"` // signs isso-<id> cookies, random on every start if empty
+	HashSecret string       `yaml:"hash_secret"` // salt of author hashes, used only for new comments
+	NodeId     int64        `yaml:"node_id"`     // unique for each replica, negative to claim it through S3
+	Sites      []SiteConfig `yaml:"sites"`       // single default site with settings above if empty
+
+	VotesFlushInterval time.Duration `yaml:"votes_flush_interval"` // votes are saved immediately if zero
+	ModerationKey      string        `yaml:"moderation_key"`       // owner's key for moderation API, signs moderation links
+	VoterSecret        string        `yaml:"voter_secret"`         // salt of hashed client addresses, hash_secret if empty
+}
+
+type ServerConfig struct {
+	Host            string        `yaml:"host"`
+	Port            int           `yaml:"port"`
+	CorsOrigins     []string      `yaml:"cors_origins"` // sites with isso frontend
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	PublicUrl       string        `yaml:"public_url"` // of API, like https://comments.example.com, for links in messages
+	// addresses or CIDRs of reverse proxies, X-Forwarded-For of other clients is ignored
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Host:            "0.0.0.0",
+		Port:            8123,
+		CorsOrigins:     []string{"http://127.0.0.1:8800"},
+		ShutdownTimeout: 10 * time.Second,
+	}
 }
 
 type MinioConfig struct {
-	Endpoint  string
-	AccessKey string
-	SecretKey string
-	Secure    bool
-	Bucket    string
+	Endpoint  string `yaml:"endpoint"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	Secure    bool   `yaml:"secure"`
+	Bucket    string `yaml:"bucket"`
+	KeyPrefix string `yaml:"key_prefix"` // allows to share bucket, e.g. between sites
+	// salt of page object names, pages of previous secrets are read until rehash-pages command
+	PageSecret          string   `yaml:"page_secret"`
+	PreviousPageSecrets []string `yaml:"previous_page_secrets"`
+}
+
+// secrets of first versions, defaults keep existing data readable but are known to everyone
+const DEFAULT_PAGE_SECRET = "fakeTODO"
+const DEFAULT_HASH_SECRET = "SECRET_KEY"
+
+// credentials of demo Minio, known to everyone
+const DEFAULT_S3_ACCESS_KEY = "root"
+const DEFAULT_S3_SECRET_KEY = "topsecret"
+
+func DefaultMinioConfig() MinioConfig {
+	return MinioConfig{
+		Endpoint:  "minio:9000",
+		AccessKey: DEFAULT_S3_ACCESS_KEY,
+		SecretKey: DEFAULT_S3_SECRET_KEY,
+		Secure:    false,
+		Bucket:    "s3-comment",
+
+		PageSecret: DEFAULT_PAGE_SECRET,
+	}
 }
 
-func ReadConfigFromEnvs() ApplicationConfig {
-	minioEndpoint := os.Getenv("S3_ENDPOINT")
-	if minioEndpoint == "" {
-		minioEndpoint = "minio:9000"
+type RedisConfig struct {
+	Enabled    bool          `yaml:"enabled"` // only for config file, disabled Redis is nil
+	Endpoint   string        `yaml:"endpoint"`
+	Password   string        `yaml:"password"`
+	Db         int           `yaml:"db"`
+	KeyPrefix  string        `yaml:"key_prefix"` // allows to share one Redis between applications
+	CommentTtl time.Duration `yaml:"comment_ttl"`
+	PageTtl    time.Duration `yaml:"page_ttl"`
+	CountTtl   time.Duration `yaml:"count_ttl"`
+}
+
+func DefaultRedisConfig() RedisConfig {
+	return RedisConfig{
+		Endpoint:   "redis:6379",
+		KeyPrefix:  "s3-comment:",
+		CommentTtl: 24 * time.Hour,
+		PageTtl:    time.Hour,
+		CountTtl:   time.Hour,
 	}
-	return ApplicationConfig{
-		Minio: &MinioConfig{
+}
+
+// CacheConfig limits memory cache in front of S3, zero values for unlimited
+type CacheConfig struct {
+	MaxComments int           `yaml:"max_comments"`
+	MaxPages    int           `yaml:"max_pages"` // for both comment lists and counts
+	Ttl         time.Duration `yaml:"ttl"`
+	// without Redis replicas are not notified about changes, so ttl is limited by it
+	MaxStaleness time.Duration `yaml:"max_staleness"`
+}
+
+func DefaultCacheConfig() CacheConfig {
+	return CacheConfig{
+		MaxComments: 100000,
+		MaxPages:    10000,
+		Ttl:         time.Hour,
+
+		MaxStaleness: time.Minute,
+	}
+}
+
+// PolicyConfig is server side part of isso client configuration, see /config
+type PolicyConfig struct {
+	EditMaxAge         time.Duration `yaml:"edit_max_age"` // isso's max-age, zero disables editing
+	ReplyToSelf        bool          `yaml:"reply_to_self"`
+	RequireAuthor      bool          `yaml:"require_author"`
+	RequireEmail       bool          `yaml:"require_email"`
+	ReplyNotifications bool          `yaml:"reply_notifications"`
+	Gravatar           bool          `yaml:"gravatar"`
+	GravatarUrl        string        `yaml:"gravatar_url"` // {} is replaced with md5 of email
+	Avatar             bool          `yaml:"avatar"`
+	Moderation         bool          `yaml:"moderation"` // new comments are pending until owner approves them
+	// limits of comment fields in characters, zero for unlimited
+	MinTextLength    int `yaml:"min_text_length"`
+	MaxTextLength    int `yaml:"max_text_length"`
+	MaxAuthorLength  int `yaml:"max_author_length"`
+	MaxEmailLength   int `yaml:"max_email_length"`
+	MaxWebsiteLength int `yaml:"max_website_length"`
+}
+
+func DefaultPolicyConfig() PolicyConfig {
+	return PolicyConfig{
+		EditMaxAge:         15 * time.Minute,
+		ReplyToSelf:        false,
+		RequireAuthor:      false,
+		RequireEmail:       false,
+		ReplyNotifications: false,
+		Gravatar:           false,
+		GravatarUrl:        "https://www.gravatar.com/avatar/{}?d=identicon&s=55",
+		Avatar:             true,
+		Moderation:         false,
+		// same as in isso
+		MinTextLength:    3,
+		MaxTextLength:    65535,
+		MaxAuthorLength:  254,
+		MaxEmailLength:   254,
+		MaxWebsiteLength: 254,
+	}
+}
+
+// year of first versions, when it was hard-coded in ids of feeds
+const DEFAULT_FEED_TAG_DATE = "2022"
+
+// FeedConfig sets ids of Atom feeds, they must not be changed after feeds are published
+type FeedConfig struct {
+	TagAuthority string `yaml:"tag_authority"` // domain or email, Host of request if empty
+	TagDate      string `yaml:"tag_date"`      // YYYY, YYYY-MM or YYYY-MM-DD when authority was owned
+}
+
+func DefaultFeedConfig() FeedConfig {
+	return FeedConfig{
+		TagAuthority: "",
+		TagDate:      DEFAULT_FEED_TAG_DATE,
+	}
+}
+
+// AdminConfig protects /admin area of site owner
+type AdminConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Password   string        `yaml:"password"`    // of login form, also Bearer token of /admin/api
+	SessionTtl time.Duration `yaml:"session_ttl"` // of login cookie
+}
+
+func DefaultAdminConfig() AdminConfig {
+	return AdminConfig{
+		Enabled:    false,
+		SessionTtl: 12 * time.Hour,
+	}
+}
+
+// SmtpConfig is mail server of notifications
+type SmtpConfig struct {
+	Host     string        `yaml:"host"`
+	Port     int           `yaml:"port"`
+	Username string        `yaml:"username"` // authentication is skipped if empty
+	Password string        `yaml:"password"`
+	Security string        `yaml:"security"` // none, starttls or tls
+	From     string        `yaml:"from"`     // like Comments <comments@example.com>
+	Timeout  time.Duration `yaml:"timeout"`  // of whole delivery of one message
+}
+
+// NotifyConfig controls emails to owners about new comments and to authors about replies
+type NotifyConfig struct {
+	Enabled      bool       `yaml:"enabled"`
+	Smtp         SmtpConfig `yaml:"smtp"`
+	OwnerEmails  []string   `yaml:"owner_emails"`  // notified about every new comment
+	EmailKey     string     `yaml:"email_key"`     // hex of 32 bytes, subkeys encrypt stored emails and sign unsubscribe links
+	TemplatesDir string     `yaml:"templates_dir"` // new_comment.txt and reply.txt replace default templates
+	// failed messages are retried with doubled interval, queue is lost on restart
+	QueueSize     int           `yaml:"queue_size"`
+	MaxAttempts   int           `yaml:"max_attempts"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
 
-			Endpoint:  minioEndpoint,
-			AccessKey: "root",
-			SecretKey: "topsecret",
-			Secure:    false,
-			Bucket:    "s3-comment",
+func DefaultNotifyConfig() NotifyConfig {
+	return NotifyConfig{
+		Enabled: false,
+		Smtp: SmtpConfig{
+			Port:     587,
+			Security: SMTP_STARTTLS,
+			Timeout:  30 * time.Second,
 		},
+		QueueSize:     1000,
+		MaxAttempts:   5,
+		RetryInterval: time.Minute,
+	}
+}
+
+// MarkupConfig controls rendering of comments, everything not allowed is removed from html
+type MarkupConfig struct {
+	Mode       string   `yaml:"mode"`       // markdown or plain
+	Extensions []string `yaml:"extensions"` // of markdown, see MARKDOWN_EXTENSIONS
+	HardWrap   bool     `yaml:"hard_wrap"`  // every newline is line break
+	Headings   bool     `yaml:"headings"`   // headings are rendered as paragraphs if disabled
+	Images     bool     `yaml:"images"`     // images are rendered as links if disabled
+
+	AllowedElements   []string `yaml:"allowed_elements"`
+	AllowedAttributes []string `yaml:"allowed_attributes"`  // for all allowed elements
+	AllowedUrlSchemes []string `yaml:"allowed_url_schemes"` // of href and src, relative urls are allowed
+	LinkRel           string   `yaml:"link_rel"`            // replaces rel of every link
+
+	HighlightLanguages []string `yaml:"highlight_languages"` // of fenced code, empty list disables highlighting
+	HighlightMaxSize   int      `yaml:"highlight_max_size"`  // bytes of highlighted code in comment, rest is plain
+}
+
+// DefaultMarkupConfig allows same html as isso
+func DefaultMarkupConfig() MarkupConfig {
+	return MarkupConfig{
+		Mode: MARKUP_MARKDOWN,
+		Extensions: []string{
+			"no_intra_emphasis", "tables", "fenced_code", "autolink", "strikethrough",
+			"space_headings", "backslash_line_break", "definition_lists",
+		},
+		HardWrap: false,
+		Headings: true,
+		Images:   false,
+
+		AllowedElements: []string{
+			"a", "blockquote", "br", "code", "dd", "del", "dl", "dt", "em", "h1", "h2", "h3", "h4", "h5", "h6",
+			"hr", "ins", "li", "ol", "p", "pre", "strong", "table", "tbody", "td", "th", "thead", "tr", "ul",
+		},
+		AllowedAttributes: []string{"align", "href"},
+		AllowedUrlSchemes: []string{"http", "https", "mailto"},
+		LinkRel:           "nofollow noopener ugc",
+
+		HighlightLanguages: []string{
+			"bash", "c", "cpp", "css", "diff", "docker", "go", "html", "ini", "java", "javascript", "json",
+			"python", "rust", "shell", "sql", "toml", "typescript", "yaml",
+		},
+		HighlightMaxSize: 16384,
+	}
+}
+
+// SiteConfig describes one of many sites served by application.
+// Site is selected by API key, then by path prefix, then by Host header,
+// empty fields are taken from global settings
+type SiteConfig struct {
+	Name        string        `yaml:"name"` // used in metrics and Redis keys
+	Hosts       []string      `yaml:"hosts"`
+	PathPrefix  string        `yaml:"path_prefix"` // like /blog, API of site is served under it
+	ApiKeys     []string      `yaml:"api_keys"`    // values of X-Api-Key header
+	Bucket      string        `yaml:"bucket"`
+	KeyPrefix   string        `yaml:"key_prefix"` // S3 objects of site, like blog/
+	CorsOrigins []string      `yaml:"cors_origins"`
+	HashSecret  string        `yaml:"hash_secret"`
+	Policy      *PolicyConfig `yaml:"policy"` // replaces global policy, missing fields are taken from it
+	Markup      *MarkupConfig `yaml:"markup"` // same as policy
+
+	PublicUrl     string   `yaml:"public_url"` // same as server.public_url, including path prefix
+	ModerationKey string   `yaml:"moderation_key"`
+	OwnerEmails   []string `yaml:"owner_emails"` // replace notifications.owner_emails
+}
+
+// DefaultApplicationConfig is used as base for config file and environment variables
+func DefaultApplicationConfig() ApplicationConfig {
+	minioConfig := DefaultMinioConfig()
+	redisConfig := DefaultRedisConfig()
+	return ApplicationConfig{
+		Server:     DefaultServerConfig(),
+		Minio:      &minioConfig,
+		Redis:      &redisConfig,
+		Cache:      DefaultCacheConfig(),
+		Policy:     DefaultPolicyConfig(),
+		Markup:     DefaultMarkupConfig(),
+		Feed:       DefaultFeedConfig(),
+		Admin:      DefaultAdminConfig(),
+		Notify:     DefaultNotifyConfig(),
+		SessionKey: "",
+		HashSecret: DEFAULT_HASH_SECRET,
+		NodeId:     -1,
+
+		VotesFlushInterval: 5 * time.Second,
 	}
 }
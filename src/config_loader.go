@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is loaded from defaults, then YAML file from CONFIG_FILE, then environment variables.
+// Secrets may be read from files, path is in variable with _FILE suffix, e.g. S3_SECRET_KEY_FILE
+const CONFIG_FILE_ENV = "CONFIG_FILE"
+const SECRET_FILE_SUFFIX = "_FILE"
+const REDACTED = "<redacted>"
+const MIN_SESSION_KEY_LEN = 16
+
+var bucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+var siteNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+var markupNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+var tagAuthorityRegexp = regexp.MustCompile(`^([^@\s,/:]+@)?[a-zA-Z0-9.-]+$`)
+var tagDateRegexp = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// ConfigError contains all problems of config, so they may be fixed at once
+type ConfigError struct {
+	Problems []string
+}
+
+func (err *ConfigError) Error() string {
+	return "invalid config:\n  " + strings.Join(err.Problems, "\n  ")
+}
+
+func (err *ConfigError) add(format string, args ...interface{}) {
+	err.Problems = append(err.Problems, fmt.Sprintf(format, args...))
+}
+
+type envOverride struct {
+	name   string
+	target interface{} // pointer to field of config
+	secret bool        // may be read from file
+}
+
+func getEnvOverrides(config *ApplicationConfig) []envOverride {
+	return []envOverride{
+		{name: "SERVER_HOST", target: &config.Server.Host},
+		{name: "SERVER_PORT", target: &config.Server.Port},
+		{name: "CORS_ORIGINS", target: &config.Server.CorsOrigins},
+		{name: "SHUTDOWN_TIMEOUT", target: &config.Server.ShutdownTimeout},
+		{name: "PUBLIC_URL", target: &config.Server.PublicUrl},
+		{name: "TRUSTED_PROXIES", target: &config.Server.TrustedProxies},
+
+		{name: "S3_ENDPOINT", target: &config.Minio.Endpoint},
+		{name: "S3_ACCESS_KEY", target: &config.Minio.AccessKey, secret: true},
+		{name: "S3_SECRET_KEY", target: &config.Minio.SecretKey, secret: true},
+		{name: "S3_SECURE", target: &config.Minio.Secure},
+		{name: "S3_BUCKET", target: &config.Minio.Bucket},
+		{name: "S3_KEY_PREFIX", target: &config.Minio.KeyPrefix},
+		{name: "S3_PAGE_SECRET", target: &config.Minio.PageSecret, secret: true},
+		{name: "S3_PREVIOUS_PAGE_SECRETS", target: &config.Minio.PreviousPageSecrets, secret: true},
+
+		{name: "REDIS_ENABLED", target: &config.Redis.Enabled},
+		{name: "REDIS_ENDPOINT", target: &config.Redis.Endpoint},
+		{name: "REDIS_PASSWORD", target: &config.Redis.Password, secret: true},
+		{name: "REDIS_DB", target: &config.Redis.Db},
+		{name: "REDIS_PREFIX", target: &config.Redis.KeyPrefix},
+		{name: "REDIS_COMMENT_TTL", target: &config.Redis.CommentTtl},
+		{name: "REDIS_PAGE_TTL", target: &config.Redis.PageTtl},
+		{name: "REDIS_COUNT_TTL", target: &config.Redis.CountTtl},
+
+		{name: "CACHE_MAX_COMMENTS", target: &config.Cache.MaxComments},
+		{name: "CACHE_MAX_PAGES", target: &config.Cache.MaxPages},
+		{name: "CACHE_TTL", target: &config.Cache.Ttl},
+		{name: "CACHE_MAX_STALENESS", target: &config.Cache.MaxStaleness},
+
+		{name: "POLICY_EDIT_MAX_AGE", target: &config.Policy.EditMaxAge},
+		{name: "POLICY_REPLY_TO_SELF", target: &config.Policy.ReplyToSelf},
+		{name: "POLICY_REQUIRE_AUTHOR", target: &config.Policy.RequireAuthor},
+		{name: "POLICY_REQUIRE_EMAIL", target: &config.Policy.RequireEmail},
+		{name: "POLICY_REPLY_NOTIFICATIONS", target: &config.Policy.ReplyNotifications},
+		{name: "POLICY_GRAVATAR", target: &config.Policy.Gravatar},
+		{name: "POLICY_GRAVATAR_URL", target: &config.Policy.GravatarUrl},
+		{name: "POLICY_AVATAR", target: &config.Policy.Avatar},
+		{name: "POLICY_MODERATION", target: &config.Policy.Moderation},
+		{name: "POLICY_MIN_TEXT_LENGTH", target: &config.Policy.MinTextLength},
+		{name: "POLICY_MAX_TEXT_LENGTH", target: &config.Policy.MaxTextLength},
+		{name: "POLICY_MAX_AUTHOR_LENGTH", target: &config.Policy.MaxAuthorLength},
+		{name: "POLICY_MAX_EMAIL_LENGTH", target: &config.Policy.MaxEmailLength},
+		{name: "POLICY_MAX_WEBSITE_LENGTH", target: &config.Policy.MaxWebsiteLength},
+
+		{name: "MARKUP_MODE", target: &config.Markup.Mode},
+		{name: "MARKUP_EXTENSIONS", target: &config.Markup.Extensions},
+		{name: "MARKUP_HARD_WRAP", target: &config.Markup.HardWrap},
+		{name: "MARKUP_HEADINGS", target: &config.Markup.Headings},
+		{name: "MARKUP_IMAGES", target: &config.Markup.Images},
+		{name: "MARKUP_ALLOWED_ELEMENTS", target: &config.Markup.AllowedElements},
+		{name: "MARKUP_ALLOWED_ATTRIBUTES", target: &config.Markup.AllowedAttributes},
+		{name: "MARKUP_ALLOWED_URL_SCHEMES", target: &config.Markup.AllowedUrlSchemes},
+		{name: "MARKUP_LINK_REL", target: &config.Markup.LinkRel},
+		{name: "MARKUP_HIGHLIGHT_LANGUAGES", target: &config.Markup.HighlightLanguages},
+		{name: "MARKUP_HIGHLIGHT_MAX_SIZE", target: &config.Markup.HighlightMaxSize},
+
+		{name: "FEED_TAG_AUTHORITY", target: &config.Feed.TagAuthority},
+		{name: "FEED_TAG_DATE", target: &config.Feed.TagDate},
+
+		{name: "ADMIN_ENABLED", target: &config.Admin.Enabled},
+		{name: "ADMIN_PASSWORD", target: &config.Admin.Password, secret: true},
+		{name: "ADMIN_SESSION_TTL", target: &config.Admin.SessionTtl},
+
+		{name: "NOTIFY_ENABLED", target: &config.Notify.Enabled},
+		{name: "SMTP_HOST", target: &config.Notify.Smtp.Host},
+		{name: "SMTP_PORT", target: &config.Notify.Smtp.Port},
+		{name: "SMTP_USERNAME", target: &config.Notify.Smtp.Username},
+		{name: "SMTP_PASSWORD", target: &config.Notify.Smtp.Password, secret: true},
+		{name: "SMTP_SECURITY", target: &config.Notify.Smtp.Security},
+		{name: "SMTP_FROM", target: &config.Notify.Smtp.From},
+		{name: "SMTP_TIMEOUT", target: &config.Notify.Smtp.Timeout},
+		{name: "NOTIFY_OWNER_EMAILS", target: &config.Notify.OwnerEmails},
+		{name: "NOTIFY_EMAIL_KEY", target: &config.Notify.EmailKey, secret: true},
+		{name: "NOTIFY_TEMPLATES_DIR", target: &config.Notify.TemplatesDir},
+		{name: "NOTIFY_QUEUE_SIZE", target: &config.Notify.QueueSize},
+		{name: "NOTIFY_MAX_ATTEMPTS", target: &config.Notify.MaxAttempts},
+		{name: "NOTIFY_RETRY_INTERVAL", target: &config.Notify.RetryInterval},
+
+		{name: "SESSION_KEY", target: &config.SessionKey, secret: true},
+		{name: "HASH_SECRET", target: &config.HashSecret, secret: true},
+		{name: "VOTER_SECRET", target: &config.VoterSecret, secret: true},
+		{name: "NODE_ID", target: &config.NodeId},
+		{name: "VOTES_FLUSH_INTERVAL", target: &config.VotesFlushInterval},
+		{name: "MODERATION_KEY", target: &config.ModerationKey, secret: true},
+	}
+}
+
+func setConfigValue(target interface{}, value string) error {
+	var err error = nil
+	switch target := target.(type) {
+	case *string:
+		*target = value
+	case *int:
+		*target, err = strconv.Atoi(value)
+	case *int64:
+		*target, err = strconv.ParseInt(value, 10, 64)
+	case *bool:
+		*target, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*target, err = time.ParseDuration(value)
+	case *[]string:
+		values := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+		*target = values
+	default:
+		panic(fmt.Sprintf("unsupported config field %T", target))
+	}
+	return err
+}
+
+func applyEnvOverrides(config *ApplicationConfig, getenv func(string) (string, bool), problems *ConfigError) {
+	for _, override := range getEnvOverrides(config) {
+		value, exists := getenv(override.name)
+		if override.secret {
+			if path, fromFile := getenv(override.name + SECRET_FILE_SUFFIX); fromFile {
+				if exists {
+					problems.add("both %v and %v%v are set", override.name, override.name, SECRET_FILE_SUFFIX)
+					continue
+				}
+				secret, err := os.ReadFile(path)
+				if err != nil {
+					problems.add("%v%v: %v", override.name, SECRET_FILE_SUFFIX, err.Error())
+					continue
+				}
+				// files created by editors and kubectl usually end with newline
+				value, exists = strings.TrimRight(string(secret), "\r\n"), true
+			}
+		}
+		if !exists {
+			continue
+		}
+		if err := setConfigValue(override.target, value); err != nil {
+			problems.add("%v: invalid value %q", override.name, value)
+		}
+	}
+	// Redis was enabled only by endpoint in older versions
+	if endpoint, exists := getenv("REDIS_ENDPOINT"); exists && endpoint != "" {
+		if _, exists := getenv("REDIS_ENABLED"); !exists {
+			config.Redis.Enabled = true
+		}
+	}
+}
+
+func validateConfig(config *ApplicationConfig, problems *ConfigError) {
+	if config.Server.Port <= 0 || config.Server.Port > 65535 {
+		problems.add("server.port must be in [1, 65535], got %v", config.Server.Port)
+	}
+	if config.Server.ShutdownTimeout < 0 {
+		problems.add("server.shutdown_timeout must not be negative")
+	}
+	validateCorsOrigins("server.cors_origins", config.Server.CorsOrigins, problems)
+	for _, proxy := range config.Server.TrustedProxies {
+		_, _, cidrErr := net.ParseCIDR(proxy)
+		if net.ParseIP(proxy) == nil && cidrErr != nil {
+			problems.add("server.trusted_proxies must contain ip addresses or CIDRs, got %q", proxy)
+		}
+	}
+
+	if config.Minio.Endpoint == "" || strings.Contains(config.Minio.Endpoint, "://") {
+		problems.add("s3.endpoint must be host:port without scheme, got %q", config.Minio.Endpoint)
+	}
+	if config.Minio.AccessKey == "" || config.Minio.SecretKey == "" {
+		problems.add("s3.access_key and s3.secret_key are required")
+	}
+	if !bucketNameRegexp.MatchString(config.Minio.Bucket) {
+		problems.add("s3.bucket %q is not valid bucket name", config.Minio.Bucket)
+	}
+	if config.Minio.PageSecret == "" {
+		problems.add("s3.page_secret is required")
+	}
+	for _, previous := range config.Minio.PreviousPageSecrets {
+		if previous == config.Minio.PageSecret {
+			problems.add("s3.previous_page_secrets must not contain current page_secret")
+		}
+	}
+
+	if config.Redis.Enabled {
+		if config.Redis.Endpoint == "" {
+			problems.add("redis.endpoint is required for enabled Redis")
+		}
+		if config.Redis.Db < 0 {
+			problems.add("redis.db must not be negative")
+		}
+		if config.Redis.CommentTtl <= 0 || config.Redis.PageTtl <= 0 || config.Redis.CountTtl <= 0 {
+			problems.add("redis ttls must be positive")
+		}
+	}
+
+	if config.Cache.MaxComments < 0 || config.Cache.MaxPages < 0 {
+		problems.add("cache limits must not be negative, use zero for unlimited")
+	}
+	if config.Cache.Ttl < 0 || config.Cache.MaxStaleness < 0 {
+		problems.add("cache.ttl and cache.max_staleness must not be negative")
+	}
+
+	validatePolicy("policy", config.Policy, problems)
+
+	validateMarkup("markup", config.Markup, problems)
+
+	validateFeed(config.Feed, problems)
+
+	if config.Admin.Enabled && len(config.Admin.Password) < MIN_SESSION_KEY_LEN {
+		problems.add("admin.password must be at least %v characters when admin is enabled", MIN_SESSION_KEY_LEN)
+	}
+	if config.Admin.SessionTtl <= 0 {
+		problems.add("admin.session_ttl must be positive")
+	}
+
+	validateNotify(config, problems)
+
+	if config.HashSecret == "" {
+		problems.add("hash_secret is required")
+	}
+	if config.VoterSecret != "" && len(config.VoterSecret) < MIN_SESSION_KEY_LEN {
+		problems.add("voter_secret must be at least %v characters", MIN_SESSION_KEY_LEN)
+	}
+	if config.SessionKey != "" && len(config.SessionKey) < MIN_SESSION_KEY_LEN {
+		problems.add("session_key must be at least %v characters", MIN_SESSION_KEY_LEN)
+	}
+	if config.NodeId > MAX_NODE_ID {
+		problems.add("node_id must be in [0, %v] or negative to claim it automatically", MAX_NODE_ID)
+	}
+	if config.VotesFlushInterval < 0 {
+		problems.add("votes_flush_interval must not be negative")
+	}
+	validatePublicUrl("server.public_url", config.Server.PublicUrl, problems)
+	if config.ModerationKey != "" && len(config.ModerationKey) < MIN_SESSION_KEY_LEN {
+		problems.add("moderation_key must be at least %v characters", MIN_SESSION_KEY_LEN)
+	}
+	if len(config.Sites) == 0 && config.Policy.Moderation && config.ModerationKey == "" {
+		problems.add("moderation_key is required for policy.moderation, pending comments can't be approved without it")
+	}
+	validateSites(config, problems)
+}
+
+func validateEmails(field string, emails []string, problems *ConfigError) {
+	for _, email := range emails {
+		if err := ValidateEmail(email); err != nil {
+			problems.add("%v: %q is not valid email", field, email)
+		}
+	}
+}
+
+func validateNotify(config *ApplicationConfig, problems *ConfigError) {
+	notify := config.Notify
+	validateEmails("notifications.owner_emails", notify.OwnerEmails, problems)
+	if notify.EmailKey != "" {
+		if _, err := NewEmailCipher(notify.EmailKey); err != nil {
+			problems.add("notifications.email_key: %v", err.Error())
+		}
+	}
+	if !notify.Enabled {
+		return
+	}
+	if notify.Smtp.Host == "" {
+		problems.add("notifications.smtp.host is required")
+	}
+	if notify.Smtp.Port <= 0 || notify.Smtp.Port > 65535 {
+		problems.add("notifications.smtp.port must be in [1, 65535]")
+	}
+	if !smtpSecurityModes[notify.Smtp.Security] {
+		problems.add("notifications.smtp.security must be one of none, starttls and tls")
+	}
+	if _, err := mail.ParseAddress(notify.Smtp.From); err != nil {
+		problems.add("notifications.smtp.from: %q is not valid address", notify.Smtp.From)
+	}
+	if notify.Smtp.Timeout <= 0 {
+		problems.add("notifications.smtp.timeout must be positive")
+	}
+	if notify.QueueSize <= 0 || notify.MaxAttempts <= 0 || notify.RetryInterval < 0 {
+		problems.add("notifications.queue_size and max_attempts must be positive, retry_interval must not be negative")
+	}
+	if _, err := LoadNotifyTemplates(notify.TemplatesDir); err != nil {
+		problems.add("notifications.templates_dir: %v", err.Error())
+	}
+	replyNotifications := config.Policy.ReplyNotifications
+	for _, site := range config.Sites {
+		replyNotifications = replyNotifications || site.Apply(*config).Policy.ReplyNotifications
+	}
+	if replyNotifications && notify.EmailKey == "" {
+		problems.add("notifications.email_key is required for policy.reply_notifications, emails of subscribers are stored encrypted")
+	}
+}
+
+// validateFeed checks parts of tag URI, see RFC 4151
+func validateFeed(feed FeedConfig, problems *ConfigError) {
+	if feed.TagAuthority != "" && !tagAuthorityRegexp.MatchString(feed.TagAuthority) {
+		problems.add("feed.tag_authority %q must be domain name or email", feed.TagAuthority)
+	}
+	validDate := false
+	for _, layout := range []string{"2006", "2006-01", "2006-01-02"} {
+		if _, err := time.Parse(layout, feed.TagDate); err == nil && tagDateRegexp.MatchString(feed.TagDate) {
+			validDate = true
+		}
+	}
+	if !validDate {
+		problems.add("feed.tag_date must be YYYY, YYYY-MM or YYYY-MM-DD, got %q", feed.TagDate)
+	}
+}
+
+func validatePublicUrl(field string, publicUrl string, problems *ConfigError) {
+	if publicUrl == "" {
+		return
+	}
+	parsed, err := url.Parse(publicUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.RawQuery != "" {
+		problems.add("%v: %q is not url like https://comments.example.com", field, publicUrl)
+	}
+}
+
+func validateCorsOrigins(field string, origins []string, problems *ConfigError) {
+	for _, origin := range origins {
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || strings.Trim(parsed.Path, "/") != "" {
+			problems.add("%v: %q is not origin like https://example.com", field, origin)
+		}
+	}
+}
+
+func validatePolicy(field string, policy PolicyConfig, problems *ConfigError) {
+	if policy.EditMaxAge < 0 {
+		problems.add("%v.edit_max_age must not be negative", field)
+	}
+	if policy.Gravatar && !strings.Contains(policy.GravatarUrl, "{}") {
+		problems.add("%v.gravatar_url must contain {} for email hash", field)
+	}
+	if policy.MinTextLength < 0 || policy.MaxTextLength < 0 || policy.MaxAuthorLength < 0 ||
+		policy.MaxEmailLength < 0 || policy.MaxWebsiteLength < 0 {
+		problems.add("%v length limits must not be negative, use zero for unlimited", field)
+	}
+	if policy.MaxTextLength > 0 && policy.MinTextLength > policy.MaxTextLength {
+		problems.add("%v.min_text_length must not be greater than max_text_length", field)
+	}
+}
+
+// validateMarkup rejects settings, which allow scripts in comments
+func validateMarkup(field string, markup MarkupConfig, problems *ConfigError) {
+	if markup.Mode != MARKUP_MARKDOWN && markup.Mode != MARKUP_PLAIN {
+		problems.add("%v.mode must be %v or %v", field, MARKUP_MARKDOWN, MARKUP_PLAIN)
+	}
+	allowedElements := make(map[string]bool, len(markup.AllowedElements))
+	for _, element := range markup.AllowedElements {
+		allowedElements[element] = true
+	}
+	for _, extension := range markup.Extensions {
+		if _, exists := MARKDOWN_EXTENSIONS[extension]; !exists {
+			problems.add("%v.extensions: unknown extension %q", field, extension)
+			continue
+		}
+		if markup.Mode != MARKUP_MARKDOWN {
+			continue
+		}
+		missing := make([]string, 0)
+		for _, element := range MARKDOWN_EXTENSION_ELEMENTS[extension] {
+			if !allowedElements[element] {
+				missing = append(missing, element)
+			}
+		}
+		if len(missing) > 0 {
+			problems.add("%v.allowed_elements: %v required for extension %v", field, strings.Join(missing, ", "), extension)
+		}
+	}
+	for _, element := range markup.AllowedElements {
+		if !markupNameRegexp.MatchString(element) {
+			problems.add("%v.allowed_elements: %q is not element name in lowercase", field, element)
+		} else if sanitizerDroppedContent[element] {
+			problems.add("%v.allowed_elements: %v is unsafe", field, element)
+		}
+	}
+	for _, attribute := range markup.AllowedAttributes {
+		if !markupNameRegexp.MatchString(attribute) {
+			problems.add("%v.allowed_attributes: %q is not attribute name in lowercase", field, attribute)
+		} else if strings.HasPrefix(attribute, "on") || attribute == "style" || attribute == "srcdoc" || attribute == "formaction" {
+			problems.add("%v.allowed_attributes: %v is unsafe", field, attribute)
+		}
+	}
+	for _, scheme := range markup.AllowedUrlSchemes {
+		switch strings.ToLower(scheme) {
+		case "javascript", "vbscript", "data":
+			problems.add("%v.allowed_url_schemes: %v is unsafe", field, scheme)
+		}
+	}
+	if markup.LinkRel == "" {
+		problems.add("%v.link_rel is required", field)
+	}
+	for _, language := range markup.HighlightLanguages {
+		if !IsKnownLanguage(language) {
+			problems.add("%v.highlight_languages: unknown language %q", field, language)
+		}
+	}
+	if markup.HighlightMaxSize < 0 {
+		problems.add("%v.highlight_max_size must not be negative", field)
+	}
+}
+
+// validateSites checks that every request and every S3 object belong to single site
+func validateSites(config *ApplicationConfig, problems *ConfigError) {
+	names := make(map[string]bool)
+	selectors := make(map[string]string) // selector -> site name
+	locations := make(map[string]string)
+	withoutSelectors := 0
+	claim := func(selector string, site string) {
+		if other, exists := selectors[selector]; exists {
+			problems.add("sites %v and %v have same %v", other, site, selector)
+			return
+		}
+		selectors[selector] = site
+	}
+	for ind, site := range config.Sites {
+		field := fmt.Sprintf("sites[%v]", ind)
+		if !siteNameRegexp.MatchString(site.Name) {
+			problems.add("%v.name %q must contain only a-z, 0-9, _ and -", field, site.Name)
+		} else if names[site.Name] {
+			problems.add("%v.name %q is not unique", field, site.Name)
+		}
+		names[site.Name] = true
+
+		for _, host := range site.Hosts {
+			claim("host "+strings.ToLower(host), site.Name)
+		}
+		for _, apiKey := range site.ApiKeys {
+			// NB: key itself must not be printed
+			if other, exists := selectors["api key "+apiKey]; exists {
+				problems.add("sites %v and %v have same api key", other, site.Name)
+			}
+			selectors["api key "+apiKey] = site.Name
+		}
+		if site.PathPrefix != "" {
+			if !strings.HasPrefix(site.PathPrefix, "/") || strings.HasSuffix(site.PathPrefix, "/") {
+				problems.add("%v.path_prefix must start and must not end with /, like /blog", field)
+			}
+			claim("path prefix "+site.PathPrefix, site.Name)
+		}
+		if !site.hasSelectors() {
+			withoutSelectors += 1
+		}
+
+		if site.Bucket != "" && !bucketNameRegexp.MatchString(site.Bucket) {
+			problems.add("%v.bucket %q is not valid bucket name", field, site.Bucket)
+		}
+		siteMinio := site.Apply(*config).Minio
+		location := siteMinio.Bucket + "/" + siteMinio.KeyPrefix
+		if other, exists := locations[location]; exists {
+			problems.add("sites %v and %v are stored in same bucket with same key_prefix", other, site.Name)
+		}
+		locations[location] = site.Name
+
+		validateCorsOrigins(field+".cors_origins", site.CorsOrigins, problems)
+		validatePublicUrl(field+".public_url", site.PublicUrl, problems)
+		if site.ModerationKey != "" && len(site.ModerationKey) < MIN_SESSION_KEY_LEN {
+			problems.add("%v.moderation_key must be at least %v characters", field, MIN_SESSION_KEY_LEN)
+		}
+		if siteConfig := site.Apply(*config); siteConfig.Policy.Moderation && siteConfig.ModerationKey == "" {
+			problems.add("%v: moderation_key is required for policy.moderation", field)
+		}
+		validateEmails(field+".owner_emails", site.OwnerEmails, problems)
+		if site.Policy != nil {
+			validatePolicy(field+".policy", *site.Policy, problems)
+		}
+		if site.Markup != nil {
+			validateMarkup(field+".markup", *site.Markup, problems)
+		}
+	}
+	if withoutSelectors > 1 {
+		problems.add("only one site may be without hosts, path_prefix and api_keys")
+	}
+}
+
+// siteOverridesFile is second pass over config file, settings of site are decoded over global ones
+type siteOverridesFile struct {
+	Sites []struct {
+		Policy yaml.Node `yaml:"policy"`
+		Markup yaml.Node `yaml:"markup"`
+	} `yaml:"sites"`
+}
+
+func applySiteOverrides(config *ApplicationConfig, data []byte, problems *ConfigError) {
+	var file siteOverridesFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		problems.add("sites: %v", err.Error())
+		return
+	}
+	for ind, site := range file.Sites {
+		if ind >= len(config.Sites) {
+			break
+		}
+		if site.Policy.Kind != 0 {
+			policy := config.Policy
+			if err := site.Policy.Decode(&policy); err != nil {
+				problems.add("sites[%v].policy: %v", ind, err.Error())
+			}
+			config.Sites[ind].Policy = &policy
+		}
+		if site.Markup.Kind != 0 {
+			markup := config.Markup
+			if err := site.Markup.Decode(&markup); err != nil {
+				problems.add("sites[%v].markup: %v", ind, err.Error())
+			}
+			config.Sites[ind].Markup = &markup
+		}
+	}
+}
+
+// LoadConfig returns *ConfigError with all problems, getenv is os.LookupEnv outside of tests
+func LoadConfig(getenv func(string) (string, bool)) (ApplicationConfig, error) {
+	config := DefaultApplicationConfig()
+	var data []byte
+	if path, exists := getenv(CONFIG_FILE_ENV); exists && path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return config, fmt.Errorf("unable to read config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true) // typos must not be ignored silently
+		if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+			return config, fmt.Errorf("invalid config file %v: %w", path, err)
+		}
+		// empty sections are decoded as nil
+		if config.Minio == nil {
+			minioConfig := DefaultMinioConfig()
+			config.Minio = &minioConfig
+		}
+		if config.Redis == nil {
+			redisConfig := DefaultRedisConfig()
+			config.Redis = &redisConfig
+		}
+	}
+
+	problems := &ConfigError{}
+	applyEnvOverrides(&config, getenv, problems)
+	if data != nil {
+		// after overrides, so POLICY_* and MARKUP_* variables are inherited by sites too
+		applySiteOverrides(&config, data, problems)
+	}
+	validateConfig(&config, problems)
+	if len(problems.Problems) > 0 {
+		return config, problems
+	}
+	if !config.Redis.Enabled {
+		config.Redis = nil
+	}
+	return config, nil
+}
+
+// ReadConfig loads config of application and stops it on errors
+func ReadConfig() ApplicationConfig {
+	config, err := LoadConfig(os.LookupEnv)
+	if err != nil {
+		log.Fatalf("Unable to load config: %v", err.Error())
+	}
+	return config
+}
+
+// ConfigWarnings returns insecure settings, which are allowed for compatibility
+func ConfigWarnings(config ApplicationConfig) []string {
+	warnings := make([]string, 0)
+	hashSecrets := []string{config.HashSecret}
+	for _, site := range config.Sites {
+		hashSecrets = append(hashSecrets, site.HashSecret)
+	}
+	for _, secret := range hashSecrets {
+		if secret == DEFAULT_HASH_SECRET {
+			warnings = append(warnings, "default hash_secret is used, emails of authors may be guessed by their hashes")
+			break
+		}
+	}
+	if config.Minio != nil && config.Minio.PageSecret == DEFAULT_PAGE_SECRET {
+		warnings = append(warnings, "default s3.page_secret is used, see rehash-pages command for rotation")
+	}
+	if config.Minio != nil && config.Minio.SecretKey == DEFAULT_S3_SECRET_KEY {
+		warnings = append(warnings, "default s3.secret_key of demo Minio is used, set own credentials")
+	}
+	return warnings
+}
+
+// Redacted returns copy of config without secrets, safe for logs
+func (config ApplicationConfig) Redacted() ApplicationConfig {
+	redact := func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return REDACTED
+	}
+	if config.Minio != nil {
+		minioConfig := *config.Minio
+		minioConfig.AccessKey = redact(minioConfig.AccessKey)
+		minioConfig.SecretKey = redact(minioConfig.SecretKey)
+		minioConfig.PageSecret = redact(minioConfig.PageSecret)
+		if minioConfig.PreviousPageSecrets != nil {
+			previous := make([]string, len(minioConfig.PreviousPageSecrets))
+			for ind := range previous {
+				previous[ind] = REDACTED
+			}
+			minioConfig.PreviousPageSecrets = previous
+		}
+		config.Minio = &minioConfig
+	}
+	if config.Redis != nil {
+		redisConfig := *config.Redis
+		redisConfig.Password = redact(redisConfig.Password)
+		config.Redis = &redisConfig
+	}
+	config.SessionKey = redact(config.SessionKey)
+	config.HashSecret = redact(config.HashSecret)
+	config.VoterSecret = redact(config.VoterSecret)
+	config.ModerationKey = redact(config.ModerationKey)
+	config.Admin.Password = redact(config.Admin.Password)
+	config.Notify.Smtp.Password = redact(config.Notify.Smtp.Password)
+	config.Notify.EmailKey = redact(config.Notify.EmailKey)
+	if config.Sites != nil {
+		sites := make([]SiteConfig, len(config.Sites))
+		for ind, site := range config.Sites {
+			if site.ApiKeys != nil {
+				site.ApiKeys = make([]string, len(site.ApiKeys))
+				for keyInd := range site.ApiKeys {
+					site.ApiKeys[keyInd] = REDACTED
+				}
+			}
+			site.HashSecret = redact(site.HashSecret)
+			site.ModerationKey = redact(site.ModerationKey)
+			sites[ind] = site
+		}
+		config.Sites = sites
+	}
+	return config
+}
+
+func DumpConfig(config ApplicationConfig) string {
+	data, err := yaml.Marshal(config.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
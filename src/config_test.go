@@ -0,0 +1,193 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestEnv(envs map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, exists := envs[name]
+		return value, exists
+	}
+}
+
+func writeTestFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config, err := LoadConfig(getTestEnv(map[string]string{}))
+	assert.Nil(t, err)
+	assert.Equal(t, 8123, config.Server.Port)
+	assert.Equal(t, "minio:9000", config.Minio.Endpoint)
+	assert.Nil(t, config.Redis)
+	assert.Equal(t, int64(-1), config.NodeId)
+	assert.Equal(t, DefaultPolicyConfig(), config.Policy)
+}
+
+func TestConfigFileAndEnvs(t *testing.T) {
+	configPath := writeTestFile(t, "config.yaml", `
+server:
+  port: 9000
+  cors_origins: ["https://blog.example.com"]
+s3:
+  endpoint: s3.example.com
+  bucket: comments
+  secure: true
+redis:
+  enabled: true
+  page_ttl: 10m
+cache:
+  max_comments: 10
+policy:
+  edit_max_age: 1h
+  require_email: true
+node_id: 3
+`)
+	secretPath := writeTestFile(t, "secret", "from-file\n")
+	config, err := LoadConfig(getTestEnv(map[string]string{
+		CONFIG_FILE_ENV:      configPath,
+		"S3_BUCKET":          "overridden",
+		"S3_KEY_PREFIX":      "blog/",
+		"S3_SECRET_KEY_FILE": secretPath,
+		"CORS_ORIGINS":       "https://a.example.com, https://b.example.com",
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, 9000, config.Server.Port)
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, config.Server.CorsOrigins)
+	assert.Equal(t, "s3.example.com", config.Minio.Endpoint)
+	assert.Equal(t, "overridden", config.Minio.Bucket)
+	assert.Equal(t, "blog/", config.Minio.KeyPrefix)
+	assert.Equal(t, "from-file", config.Minio.SecretKey)
+	assert.Equal(t, "root", config.Minio.AccessKey) // defaults are kept for missing fields
+	assert.True(t, config.Minio.Secure)
+	assert.Equal(t, 10*time.Minute, config.Redis.PageTtl)
+	assert.Equal(t, time.Hour, config.Redis.CountTtl)
+	assert.Equal(t, 10, config.Cache.MaxComments)
+	assert.Equal(t, time.Hour, config.Policy.EditMaxAge)
+	assert.True(t, config.Policy.RequireEmail)
+	assert.True(t, config.Policy.Avatar)
+	assert.Equal(t, int64(3), config.NodeId)
+}
+
+func TestConfigRedisEndpointEnablesRedis(t *testing.T) {
+	config, err := LoadConfig(getTestEnv(map[string]string{"REDIS_ENDPOINT": "127.0.0.1:6379"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:6379", config.Redis.Endpoint)
+}
+
+func TestConfigErrors(t *testing.T) {
+	configPath := writeTestFile(t, "config.yaml", "server:\n  prot: 80\n")
+	_, err := LoadConfig(getTestEnv(map[string]string{CONFIG_FILE_ENV: configPath}))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "prot")
+
+	_, err = LoadConfig(getTestEnv(map[string]string{
+		"SERVER_PORT":   "0",
+		"S3_BUCKET":     "Bad_Bucket",
+		"NODE_ID":       "many",
+		"SESSION_KEY":   "short",
+		"S3_ACCESS_KEY": "key", "S3_ACCESS_KEY_FILE": "/dev/null",
+	}))
+	configErr, isConfigErr := err.(*ConfigError)
+	assert.True(t, isConfigErr)
+	assert.Len(t, configErr.Problems, 5)
+	for _, name := range []string{"server.port", "s3.bucket", "NODE_ID", "session_key", "S3_ACCESS_KEY_FILE"} {
+		assert.Contains(t, err.Error(), name)
+	}
+}
+
+func TestConfigDump(t *testing.T) {
+	config, err := LoadConfig(getTestEnv(map[string]string{
+		"SESSION_KEY":    "session-key-with-enough-length",
+		"REDIS_ENDPOINT": "redis:6379",
+		"REDIS_PASSWORD": "redis-password",
+	}))
+	assert.Nil(t, err)
+	dump := DumpConfig(config)
+	for _, secret := range []string{"session-key-with-enough-length", "redis-password", "topsecret"} {
+		assert.False(t, strings.Contains(dump, secret))
+	}
+	assert.Contains(t, dump, REDACTED)
+	assert.Contains(t, dump, "edit_max_age: 15m0s")
+	// original config is not changed
+	assert.Equal(t, "redis-password", config.Redis.Password)
+}
+
+func TestConfigSecrets(t *testing.T) {
+	config, err := LoadConfig(getTestEnv(map[string]string{}))
+	assert.Nil(t, err)
+	warnings := ConfigWarnings(config)
+	assert.Len(t, warnings, 3)
+	assert.Contains(t, strings.Join(warnings, "\n"), "s3.secret_key")
+
+	config, err = LoadConfig(getTestEnv(map[string]string{
+		"S3_SECRET_KEY":            "new-s3-secret-key",
+		"HASH_SECRET":              "new-hash-secret",
+		"S3_PAGE_SECRET":           "new-page-secret",
+		"S3_PREVIOUS_PAGE_SECRETS": "fakeTODO,older-page-secret",
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fakeTODO", "older-page-secret"}, config.Minio.PreviousPageSecrets)
+	assert.Len(t, ConfigWarnings(config), 0)
+	dump := DumpConfig(config)
+	for _, secret := range []string{"new-hash-secret", "new-page-secret", "older-page-secret"} {
+		assert.NotContains(t, dump, secret)
+	}
+
+	_, err = LoadConfig(getTestEnv(map[string]string{
+		"S3_PAGE_SECRET":           "page-secret",
+		"S3_PREVIOUS_PAGE_SECRETS": "page-secret",
+		"HASH_SECRET":              "",
+	}))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "previous_page_secrets")
+	assert.Contains(t, err.Error(), "hash_secret")
+}
+
+func TestConfigVoters(t *testing.T) {
+	config, err := LoadConfig(getTestEnv(map[string]string{
+		"TRUSTED_PROXIES": "10.0.0.1, 172.16.0.0/12",
+		"VOTER_SECRET":    "voter-secret-with-enough-length",
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "172.16.0.0/12"}, config.Server.TrustedProxies)
+	assert.NotContains(t, DumpConfig(config), "voter-secret-with-enough-length")
+
+	_, err = LoadConfig(getTestEnv(map[string]string{
+		"TRUSTED_PROXIES": "proxy.example.com",
+		"VOTER_SECRET":    "short",
+	}))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "server.trusted_proxies")
+	assert.Contains(t, err.Error(), "voter_secret")
+}
+
+func TestConfigFeed(t *testing.T) {
+	config, err := LoadConfig(getTestEnv(map[string]string{}))
+	assert.Nil(t, err)
+	assert.Equal(t, "tag:example.com,2022:/s3-comment/%2Fpost", getFeedTag(config.Feed, "example.com", "/post"))
+
+	config, err = LoadConfig(getTestEnv(map[string]string{
+		"FEED_TAG_AUTHORITY": "comments.example.org",
+		"FEED_TAG_DATE":      "2023-05",
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, "tag:comments.example.org,2023-05:/s3-comment/%2Fpost", getFeedTag(config.Feed, "example.com", "/post"))
+
+	_, err = LoadConfig(getTestEnv(map[string]string{
+		"FEED_TAG_AUTHORITY": "https://example.com",
+		"FEED_TAG_DATE":      "2023-13",
+	}))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "feed.tag_authority")
+	assert.Contains(t, err.Error(), "feed.tag_date")
+}
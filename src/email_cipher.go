@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const EMAIL_KEY_LEN = 32 // bytes of AES-256 key
+
+// email_key is not used directly, every primitive has own subkey of it
+const (
+	EMAIL_CIPHER_KEY_INFO = "s3-comment email encryption"
+	UNSUBSCRIBE_KEY_INFO  = "s3-comment unsubscribe links"
+)
+
+// deriveEmailKey returns subkey of hex email key for purpose described by info, with HKDF-SHA256
+func deriveEmailKey(hexKey string, info string) ([]byte, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != EMAIL_KEY_LEN {
+		return nil, fmt.Errorf("key must be hex of %v bytes", EMAIL_KEY_LEN)
+	}
+	res := make([]byte, EMAIL_KEY_LEN)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(info)), res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// EmailCipher encrypts emails of reply subscribers before they are stored with comments
+type EmailCipher struct {
+	aead cipher.AEAD
+}
+
+// NewEmailCipher accepts hex of key, like output of openssl rand -hex 32
+func NewEmailCipher(hexKey string) (*EmailCipher, error) {
+	key, err := deriveEmailKey(hexKey, EMAIL_CIPHER_KEY_INFO)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EmailCipher{aead: aead}, nil
+}
+
+// Encrypt returns base64 of random nonce and sealed email
+func (emailCipher *EmailCipher) Encrypt(email string) (string, error) {
+	nonce := make([]byte, emailCipher.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := emailCipher.aead.Seal(nonce, nonce, []byte(email), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (emailCipher *EmailCipher) Decrypt(encrypted string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	nonceSize := emailCipher.aead.NonceSize()
+	if err != nil || len(sealed) < nonceSize {
+		return "", errors.New("invalid encrypted email")
+	}
+	email, err := emailCipher.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		// usually email_key was changed
+		return "", err
+	}
+	return string(email), nil
+}
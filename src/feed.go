@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const FEED_LIMIT = 100 // taken from isso
+const FEED_MAX_AGE = 5 * time.Minute
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Id        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Link      atomLink    `xml:"link"`
+	Author    atomAuthor  `xml:"author"`
+	Content   atomContent `xml:"content"`
+}
+
+// AtomFeed is rendered feed with data for http caching
+type AtomFeed struct {
+	Body    []byte
+	ETag    string
+	Updated time.Time
+}
+
+func unixFloatToTime(value float64) time.Time {
+	return time.UnixMilli(int64(value * 1000)).UTC()
+}
+
+// getFeedTag returns tag URI of RFC 4151, ids must not depend on replica or time of request.
+// Authority is Host of request if it is not configured
+func getFeedTag(config FeedConfig, host string, uri string) string {
+	authority := config.TagAuthority
+	if authority == "" {
+		authority = host
+	}
+	date := config.TagDate
+	if date == "" {
+		date = DEFAULT_FEED_TAG_DATE
+	}
+	return fmt.Sprintf("tag:%v,%v:/s3-comment/%v", authority, date, url.PathEscape(uri))
+}
+
+// BuildAtomFeed renders comments in given order, they must be already filtered
+func BuildAtomFeed(feedTag string, uri string, selfUrl string, comments []*CommentModelOutput) (*AtomFeed, error) {
+	updated := time.Unix(0, 0).UTC()
+	entries := make([]atomEntry, 0, len(comments))
+	for _, comment := range comments {
+		entryUpdated := unixFloatToTime(comment.Created)
+		if comment.Modified != nil {
+			entryUpdated = unixFloatToTime(*comment.Modified)
+		}
+		if entryUpdated.After(updated) {
+			updated = entryUpdated
+		}
+		author := "Anonymous"
+		if comment.Author != nil && *comment.Author != "" {
+			author = *comment.Author
+		}
+		entries = append(entries, atomEntry{
+			Id:        fmt.Sprintf("%v/%v", feedTag, comment.Id),
+			Title:     fmt.Sprintf("Comment #%v", comment.Id),
+			Updated:   entryUpdated.Format(time.RFC3339),
+			Published: unixFloatToTime(comment.Created).Format(time.RFC3339),
+			Link:      atomLink{Href: fmt.Sprintf("%v#isso-%v", uri, comment.Id)},
+			Author:    atomAuthor{Name: author},
+			Content:   atomContent{Type: "html", Body: comment.Text},
+		})
+	}
+
+	feed := atomFeed{
+		Id:      feedTag,
+		Title:   fmt.Sprintf("Comments for %v", uri),
+		Updated: updated.Format(time.RFC3339),
+		Link:    atomLink{Href: selfUrl, Rel: "self"},
+		Entries: entries,
+	}
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	body = append([]byte(xml.Header), body...)
+	return &AtomFeed{
+		Body:    body,
+		ETag:    fmt.Sprintf("\"%x\"", sha1.Sum(body)),
+		Updated: updated,
+	}, nil
+}
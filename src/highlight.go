@@ -0,0 +1,104 @@
+package main
+
+import (
+	"html"
+	"io"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/lexers"
+)
+
+// class of highlighted pre, token classes are same as in pygments, so css themes of pygments and chroma may be used
+const HIGHLIGHT_CLASS = "highlight"
+
+// elements of highlighted code with class attribute
+var highlightClassElements = []string{"pre", "code", "span"}
+
+// Highlighter renders fenced code blocks of allowed languages with spans by token types
+type Highlighter struct {
+	languages map[string]bool // names of lexers, so their aliases are allowed too
+	maxSize   int             // total size of highlighted code in comment, 0 is unlimited
+}
+
+// NewHighlighter ignores unknown languages, they are rejected by config validation
+func NewHighlighter(languages []string, maxSize int) *Highlighter {
+	highlighter := &Highlighter{
+		languages: make(map[string]bool),
+		maxSize:   maxSize,
+	}
+	for _, language := range languages {
+		if lexer := lexers.Get(language); lexer != nil {
+			highlighter.languages[lexer.Config().Name] = true
+		}
+	}
+	return highlighter
+}
+
+// IsKnownLanguage is used for validation of config
+func IsKnownLanguage(language string) bool {
+	return lexers.Get(language) != nil
+}
+
+func getTokenClass(tokenType chroma.TokenType) string {
+	for _, candidate := range []chroma.TokenType{tokenType, tokenType.SubCategory(), tokenType.Category()} {
+		if class := chroma.StandardTypes[candidate]; class != "" {
+			return class
+		}
+	}
+	return ""
+}
+
+// getCodeLanguage returns first word of fenced code info, like go in ```go {.class}
+func getCodeLanguage(info []byte) string {
+	fields := strings.Fields(string(info))
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(fields[0])
+}
+
+// highlightSession limits size of highlighted code in single comment
+type highlightSession struct {
+	highlighter *Highlighter
+	budget      int
+}
+
+func (highlighter *Highlighter) Enabled() bool {
+	return len(highlighter.languages) > 0
+}
+
+func (highlighter *Highlighter) newSession() *highlightSession {
+	return &highlightSession{highlighter: highlighter, budget: highlighter.maxSize}
+}
+
+// writeCodeBlock returns false if code must be rendered without highlighting
+func (session *highlightSession) writeCodeBlock(w io.Writer, info []byte, code []byte) bool {
+	language := getCodeLanguage(info)
+	if language == "" || (session.highlighter.maxSize > 0 && len(code) > session.budget) {
+		return false
+	}
+	lexer := lexers.Get(language)
+	if lexer == nil || !session.highlighter.languages[lexer.Config().Name] {
+		return false
+	}
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, string(code))
+	if err != nil {
+		return false
+	}
+	session.budget -= len(code)
+
+	var builder strings.Builder
+	builder.WriteString(`<pre class="` + HIGHLIGHT_CLASS + `"><code class="language-` + html.EscapeString(language) + `">`)
+	for _, token := range iterator.Tokens() {
+		value := html.EscapeString(token.Value)
+		if class := getTokenClass(token.Type); class != "" {
+			builder.WriteString(`<span class="` + class + `">` + value + "</span>")
+		} else {
+			builder.WriteString(value)
+		}
+	}
+	builder.WriteString("</code></pre>\n")
+	io.WriteString(w, builder.String())
+	return true
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// content of these elements is removed together with them, not only tags
+var sanitizerDroppedContent = map[string]bool{
+	"script": true, "style": true, "iframe": true, "frame": true, "frameset": true,
+	"object": true, "embed": true, "applet": true, "noscript": true, "noembed": true,
+	"noframes": true, "template": true, "textarea": true, "select": true, "title": true,
+	"xmp": true, "plaintext": true, "svg": true, "math": true,
+}
+
+var sanitizerVoidElements = map[string]bool{
+	"area": true, "br": true, "col": true, "hr": true, "img": true, "wbr": true,
+}
+
+// attributes with urls, they are checked by allowed schemes
+var sanitizerUrlAttributes = map[string]bool{
+	"href": true, "src": true, "cite": true, "longdesc": true,
+}
+
+// only plain class names, e.g. of highlighted code
+var sanitizerClassRegexp = regexp.MustCompile(`^[a-zA-Z0-9_ -]*$`)
+
+// HtmlSanitizer removes everything except allowed elements and attributes from html of comments.
+// Unknown elements are unwrapped, their text is kept
+type HtmlSanitizer struct {
+	elements   map[string]bool
+	attributes map[string]bool
+	schemes    map[string]bool
+	classes    map[string]bool // elements with allowed class attribute
+	linkRel    string
+}
+
+func toSet(values []string) map[string]bool {
+	res := make(map[string]bool, len(values))
+	for _, value := range values {
+		res[strings.ToLower(value)] = true
+	}
+	return res
+}
+
+func NewHtmlSanitizer(config MarkupConfig) *HtmlSanitizer {
+	defaults := DefaultMarkupConfig()
+	if config.AllowedElements == nil {
+		config.AllowedElements = defaults.AllowedElements
+	}
+	if config.AllowedAttributes == nil {
+		config.AllowedAttributes = defaults.AllowedAttributes
+	}
+	if config.AllowedUrlSchemes == nil {
+		config.AllowedUrlSchemes = defaults.AllowedUrlSchemes
+	}
+	if config.LinkRel == "" {
+		config.LinkRel = defaults.LinkRel
+	}
+	return &HtmlSanitizer{
+		elements:   toSet(config.AllowedElements),
+		attributes: toSet(config.AllowedAttributes),
+		schemes:    toSet(config.AllowedUrlSchemes),
+		classes:    make(map[string]bool),
+		linkRel:    config.LinkRel,
+	}
+}
+
+// allowClasses keeps class attribute of elements, if they are allowed
+func (sanitizer *HtmlSanitizer) allowClasses(elements ...string) {
+	for _, element := range elements {
+		sanitizer.classes[element] = true
+	}
+}
+
+// isAllowedUrl accepts relative urls and urls with allowed schemes
+func (sanitizer *HtmlSanitizer) isAllowedUrl(value string) bool {
+	// browsers ignore whitespaces and control characters in scheme, like "java\tscript:"
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value)
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+	return parsed.Scheme == "" || sanitizer.schemes[strings.ToLower(parsed.Scheme)]
+}
+
+func (sanitizer *HtmlSanitizer) writeStartTag(builder *strings.Builder, token html.Token) {
+	builder.WriteString("<" + token.Data)
+	for _, attr := range token.Attr {
+		name := strings.ToLower(attr.Key)
+		if attr.Namespace != "" {
+			continue
+		}
+		if name == "class" && sanitizer.classes[token.Data] && sanitizerClassRegexp.MatchString(attr.Val) {
+			builder.WriteString(` class="` + attr.Val + `"`)
+			continue
+		}
+		if !sanitizer.attributes[name] {
+			continue
+		}
+		if token.Data == "a" && (name == "rel" || name == "target") {
+			continue
+		}
+		if sanitizerUrlAttributes[name] && !sanitizer.isAllowedUrl(attr.Val) {
+			continue
+		}
+		builder.WriteString(" " + name + `="` + html.EscapeString(attr.Val) + `"`)
+	}
+	if token.Data == "a" {
+		builder.WriteString(` rel="` + html.EscapeString(sanitizer.linkRel) + `"`)
+	}
+	builder.WriteString(">")
+}
+
+// Sanitize returns well-formed html with allowed elements only
+func (sanitizer *HtmlSanitizer) Sanitize(source string) string {
+	var builder strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(source))
+	openElements := make([]string, 0)
+	droppedDepth := 0 // inside of element with dropped content
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break // io.EOF, input is in memory
+		}
+		token := tokenizer.Token()
+		switch tokenType {
+		case html.TextToken:
+			if droppedDepth == 0 {
+				builder.WriteString(html.EscapeString(token.Data))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if sanitizerDroppedContent[token.Data] {
+				if tokenType == html.StartTagToken {
+					droppedDepth += 1
+				}
+				continue
+			}
+			if droppedDepth > 0 || !sanitizer.elements[token.Data] {
+				continue
+			}
+			sanitizer.writeStartTag(&builder, token)
+			if tokenType == html.StartTagToken && !sanitizerVoidElements[token.Data] {
+				openElements = append(openElements, token.Data)
+			}
+		case html.EndTagToken:
+			if sanitizerDroppedContent[token.Data] {
+				if droppedDepth > 0 {
+					droppedDepth -= 1
+				}
+				continue
+			}
+			if droppedDepth > 0 {
+				continue
+			}
+			// closes unclosed children too, end tags without start are dropped
+			for ind := len(openElements) - 1; ind >= 0; ind-- {
+				if openElements[ind] != token.Data {
+					continue
+				}
+				for len(openElements) > ind {
+					builder.WriteString("</" + openElements[len(openElements)-1] + ">")
+					openElements = openElements[:len(openElements)-1]
+				}
+				break
+			}
+		}
+		// comments and doctypes are dropped
+	}
+	for ind := len(openElements) - 1; ind >= 0; ind-- {
+		builder.WriteString("</" + openElements[ind] + ">")
+	}
+	return builder.String()
+}
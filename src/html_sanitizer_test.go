@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/html"
+)
+
+// known XSS payloads, mostly from OWASP filter evasion cheat sheet
+var xssCorpus = []string{
+	`<script>alert(1)</script>`,
+	`<SCRIPT SRC=http://xss.example.com/xss.js></SCRIPT>`,
+	`<scr<script>ipt>alert(1)</scr</script>ipt>`,
+	`<img src=x onerror=alert(1)>`,
+	`<IMG SRC="javascript:alert('XSS');">`,
+	`<IMG SRC=JaVaScRiPt:alert('XSS')>`,
+	`<img src=x onerror="&#0000106&#0000097&#0000118&#0000097&#0000115&#0000099&#0000114&#0000105&#0000112&#0000116&#0000058alert(1)">`,
+	`<a href="javascript:alert(1)">click</a>`,
+	`<a href="JAVASCRIPT:alert(1)">click</a>`,
+	`<a href="jav&#x09;ascript:alert(1)">click</a>`,
+	`<a href="java
+script:alert(1)">click</a>`,
+	`<a href=" &#14;  javascript:alert(1)">click</a>`,
+	`<a href="&#106;&#97;&#118;&#97;&#115;&#99;&#114;&#105;&#112;&#116;&#58;alert(1)">click</a>`,
+	`<a href="vbscript:msgbox(1)">click</a>`,
+	`<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">click</a>`,
+	`<a href="#" onclick="alert(1)">click</a>`,
+	`<a href="#" onmouseover=alert(1)>hover</a>`,
+	`<p style="background:url(javascript:alert(1))">styled</p>`,
+	`<svg onload=alert(1)>`,
+	`<svg><script>alert(1)</script></svg>`,
+	`<math><mtext><table><mglyph><style><img src=x onerror=alert(1)>`,
+	`<iframe src="javascript:alert(1)"></iframe>`,
+	`<iframe srcdoc="<script>alert(1)</script>"></iframe>`,
+	`<object data="javascript:alert(1)"></object>`,
+	`<embed src="javascript:alert(1)">`,
+	`<body onload=alert(1)>`,
+	`<details open ontoggle=alert(1)>`,
+	`<input autofocus onfocus=alert(1)>`,
+	`<form action="javascript:alert(1)"><button>x</button></form>`,
+	`<button formaction="javascript:alert(1)">x</button>`,
+	`<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`,
+	`<base href="javascript:alert(1)//">`,
+	`<link rel=stylesheet href="javascript:alert(1)">`,
+	`<style>@import 'javascript:alert(1)';</style>`,
+	`<div style="width: expression(alert(1));">x</div>`,
+	`<noscript><p title="</noscript><img src=x onerror=alert(1)>">`,
+	`<textarea><script>alert(1)</script></textarea>`,
+	`<title><script>alert(1)</script></title>`,
+	`<xmp><script>alert(1)</script></xmp>`,
+	`<!--<script>alert(1)</script>-->`,
+	`<![CDATA[<script>alert(1)</script>]]>`,
+	`<p/onclick=alert(1)>x</p>`,
+	`<p onclick
+=alert(1)>x</p>`,
+	`<a href=https://example.com onclick=alert(1) target=_self rel=opener>x</a>`,
+	`<img """><script>alert(1)</script>">`,
+	`<a href="https://example.com"x=">"onmouseover=alert(1)>x</a>`,
+	`<<script>alert(1);//<</script>`,
+	`<script/src=data:,alert(1)>`,
+	`[click](javascript:alert(1))`,
+	`[click](JaVaScRiPt:alert(1))`,
+	`[click](javascript&#58;alert(1))`,
+	`![x](javascript:alert(1))`,
+	`[x](data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==)`,
+	"<javascript:alert(1)>",
+	"```\n</code></pre><script>alert(1)</script>\n```",
+	"```html\n</code></pre><script>alert(1)</script>\n```",
+	`<span class="k" onclick="alert(1)">x</span><code class="a&quot;onclick=&quot;alert(1)">y</code>`,
+	`<a href="https://example.com">unclosed <em>tags`,
+}
+
+// assertSafeHtml checks tags of result, text may contain anything
+func assertSafeHtml(t *testing.T, rendered string, payload string) {
+	allowed := toSet(append(DefaultMarkupConfig().AllowedElements, "span"))
+	tokenizer := html.NewTokenizer(strings.NewReader(rendered))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return
+		}
+		token := tokenizer.Token()
+		switch tokenType {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			assert.True(t, allowed[token.Data], "payload: %v, element: %v", payload, token.Data)
+			for _, attr := range token.Attr {
+				assert.Contains(t, []string{"align", "href", "rel", "class"}, attr.Key, "payload: %v", payload)
+				value := strings.ToLower(attr.Val)
+				for _, scheme := range []string{"javascript", "vbscript", "data"} {
+					assert.NotContains(t, value, scheme+":", "payload: %v", payload)
+				}
+			}
+		case html.CommentToken, html.DoctypeToken:
+			assert.Fail(t, "unexpected token", "payload: %v", payload)
+		}
+	}
+}
+
+func TestSanitizerXssCorpus(t *testing.T) {
+	renderer := NewMarkupRenderer(DefaultMarkupConfig())
+	for _, payload := range xssCorpus {
+		assertSafeHtml(t, renderer.Render(payload), payload)
+		assertSafeHtml(t, renderer.Sanitize(payload), payload)
+	}
+}
+
+func TestSanitizerKeepsMarkup(t *testing.T) {
+	sanitizer := NewHtmlSanitizer(DefaultMarkupConfig())
+	for source, expected := range map[string]string{
+		"<p>Hello, <em>world</em></p>\n":                         "<p>Hello, <em>world</em></p>\n",
+		`<p>a &lt; b &amp;&amp; c</p>`:                           `<p>a &lt; b &amp;&amp; c</p>`,
+		`<a href="https://example.com/?a=1&amp;b=2">x</a>`:       `<a href="https://example.com/?a=1&amp;b=2" rel="nofollow noopener ugc">x</a>`,
+		`<a href="/relative" rel="opener" target="_blank">x</a>`: `<a href="/relative" rel="nofollow noopener ugc">x</a>`,
+		`<a href="mailto:john@example.com">x</a>`:                `<a href="mailto:john@example.com" rel="nofollow noopener ugc">x</a>`,
+		`<td align="left" class="x">cell</td>`:                   `<td align="left">cell</td>`,
+		`<p>line<br/>break</p>`:                                  `<p>line<br>break</p>`,
+		`<unknown>text</unknown>`:                                `text`,
+		`<p><strong>unclosed</p>`:                                `<p><strong>unclosed</strong></p>`,
+		`<p>orphan</em> end</p>`:                                 `<p>orphan end</p>`,
+		`<script>alert(1)</script>after`:                         `after`,
+	} {
+		assert.Equal(t, expected, sanitizer.Sanitize(source))
+	}
+}
+
+func TestSanitizerConfig(t *testing.T) {
+	sanitizer := NewHtmlSanitizer(MarkupConfig{
+		AllowedElements:   []string{"img"},
+		AllowedAttributes: []string{"src", "alt"},
+		AllowedUrlSchemes: []string{"https"},
+		LinkRel:           "nofollow",
+	})
+	assert.Equal(t, `<img src="https://example.com/a.png" alt="a">`,
+		sanitizer.Sanitize(`<p><img src="https://example.com/a.png" alt="a" onerror="alert(1)"></p>`))
+	assert.Equal(t, `<img alt="a">`, sanitizer.Sanitize(`<img src="http://example.com/a.png" alt="a">`))
+
+	renderer := NewMarkupRenderer(DefaultMarkupConfig())
+	assert.Equal(t, "<p><a href=\"https://example.com\" rel=\"nofollow noopener ugc\">link</a></p>\n",
+		renderer.Render("[link](https://example.com)"))
+	assert.Contains(t, renderer.Render("Term\n: definition"), "<dl>\n<dt>Term</dt>")
+	assert.Contains(t, renderer.Render("| a |\n|---|\n| b |"), "<tr>")
+
+	_, err := LoadConfig(getTestEnv(map[string]string{
+		"MARKUP_EXTENSIONS":          "no_intra_emphasis",
+		"MARKUP_ALLOWED_ELEMENTS":    "p,script",
+		"MARKUP_ALLOWED_ATTRIBUTES":  "href,onclick,style",
+		"MARKUP_ALLOWED_URL_SCHEMES": "https,javascript",
+	}))
+	configErr, isConfigErr := err.(*ConfigError)
+	assert.True(t, isConfigErr)
+	assert.Len(t, configErr.Problems, 4)
+
+	// html of extensions is removed if it is not allowed
+	_, err = LoadConfig(getTestEnv(map[string]string{
+		"MARKUP_EXTENSIONS":       "tables,definition_lists",
+		"MARKUP_ALLOWED_ELEMENTS": "p,table,thead,tbody,td,dl",
+	}))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "tr, th required for extension tables")
+	assert.Contains(t, err.Error(), "dt, dd required for extension definition_lists")
+	_, err = LoadConfig(getTestEnv(map[string]string{
+		"MARKUP_MODE":             "plain",
+		"MARKUP_ALLOWED_ELEMENTS": "p",
+	}))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Ids are like twitter snowflake, but fit into 53 bits, because isso frontend
+// works with them as javascript numbers: | 41 bits ms | 6 bits node | 6 bits sequence |
+const (
+	ID_EPOCH_MS      = 1640995200000 // 2022-01-01, new ids are greater than old UnixMilli ones
+	ID_NODE_BITS     = 6
+	ID_SEQUENCE_BITS = 6
+	MAX_NODE_ID      = 1<<ID_NODE_BITS - 1
+	MAX_SEQUENCE     = 1<<ID_SEQUENCE_BITS - 1
+)
+
+var ErrNodeIdLost = errors.New("node id is claimed by another instance")
+
+type IdGeneratorInterface interface {
+	NextId() (int64, error)
+}
+
+type SnowflakeIdGenerator struct {
+	mutex    sync.Mutex
+	nodeId   int64
+	lastMs   int64
+	sequence int64
+	err      error
+	now      func() time.Time
+}
+
+func NewSnowflakeIdGenerator(nodeId int64) (*SnowflakeIdGenerator, error) {
+	if nodeId < 0 || nodeId > MAX_NODE_ID {
+		return nil, fmt.Errorf("node id must be in [0, %v], got %v", MAX_NODE_ID, nodeId)
+	}
+	return &SnowflakeIdGenerator{
+		nodeId: nodeId,
+		now:    time.Now,
+	}, nil
+}
+
+// Invalidate stops generation, used when uniqueness of node id is not guaranteed anymore
+func (generator *SnowflakeIdGenerator) Invalidate(err error) {
+	generator.mutex.Lock()
+	defer generator.mutex.Unlock()
+	generator.err = err
+}
+
+// Restart continues generation with new node id after Invalidate
+func (generator *SnowflakeIdGenerator) Restart(nodeId int64) error {
+	if nodeId < 0 || nodeId > MAX_NODE_ID {
+		return fmt.Errorf("node id must be in [0, %v], got %v", MAX_NODE_ID, nodeId)
+	}
+	generator.mutex.Lock()
+	defer generator.mutex.Unlock()
+	generator.nodeId = nodeId
+	generator.err = nil
+	return nil
+}
+
+// NodeId returns error if node id may be used by another instance
+func (generator *SnowflakeIdGenerator) NodeId() (int64, error) {
+	generator.mutex.Lock()
+	defer generator.mutex.Unlock()
+	return generator.nodeId, generator.err
+}
+
+func (generator *SnowflakeIdGenerator) NextId() (int64, error) {
+	generator.mutex.Lock()
+	defer generator.mutex.Unlock()
+	if generator.err != nil {
+		return 0, generator.err
+	}
+
+	currentMs := generator.now().UnixMilli() - ID_EPOCH_MS
+	// clock may go backwards, last timestamp is still safe to use
+	if currentMs < generator.lastMs {
+		currentMs = generator.lastMs
+	}
+	if currentMs == generator.lastMs {
+		generator.sequence += 1
+		if generator.sequence > MAX_SEQUENCE {
+			// sequence is exhausted, borrow next millisecond
+			currentMs += 1
+			generator.sequence = 0
+		}
+	} else {
+		generator.sequence = 0
+	}
+	generator.lastMs = currentMs
+
+	return currentMs<<(ID_NODE_BITS+ID_SEQUENCE_BITS) | generator.nodeId<<ID_SEQUENCE_BITS | generator.sequence, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnowflakeIdGeneratorConcurrent(t *testing.T) {
+	generators := make([]*SnowflakeIdGenerator, 0)
+	for nodeId := int64(0); nodeId < 3; nodeId++ {
+		generator, err := NewSnowflakeIdGenerator(nodeId)
+		assert.Nil(t, err)
+		generators = append(generators, generator)
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[int64]bool)
+	for worker := 0; worker < 12; worker++ {
+		wg.Add(1)
+		go func(generator *SnowflakeIdGenerator) {
+			defer wg.Done()
+			for ind := 0; ind < 1000; ind++ {
+				newId, err := generator.NextId()
+				assert.Nil(t, err)
+				mutex.Lock()
+				assert.False(t, seen[newId])
+				seen[newId] = true
+				mutex.Unlock()
+			}
+		}(generators[worker%len(generators)])
+	}
+	wg.Wait()
+	assert.Equal(t, 12000, len(seen))
+}
+
+func TestSnowflakeIdGeneratorClock(t *testing.T) {
+	generator, _ := NewSnowflakeIdGenerator(5)
+	current := time.Now()
+	generator.now = func() time.Time { return current }
+
+	first, _ := generator.NextId()
+	assert.Greater(t, first, current.UnixMilli()) // old ids were UnixMilli
+	assert.Less(t, first, int64(1)<<53)           // safe for javascript
+	assert.Equal(t, int64(5), first>>ID_SEQUENCE_BITS&MAX_NODE_ID)
+
+	// exhausted sequence and clock going backwards must not produce duplicates
+	previous := first
+	for ind := 0; ind < 3*MAX_SEQUENCE; ind++ {
+		if ind == MAX_SEQUENCE {
+			current = current.Add(-time.Second)
+		}
+		newId, _ := generator.NextId()
+		assert.Greater(t, newId, previous)
+		previous = newId
+	}
+
+	generator.Invalidate(ErrNodeIdLost)
+	_, err := generator.NextId()
+	assert.ErrorIs(t, err, ErrNodeIdLost)
+
+	assert.Nil(t, generator.Restart(7))
+	newId, err := generator.NextId()
+	assert.Nil(t, err)
+	assert.Greater(t, newId, previous)
+	assert.Equal(t, int64(7), newId>>ID_SEQUENCE_BITS&MAX_NODE_ID)
+}
+
+func TestSnowflakeIdGeneratorInvalidNode(t *testing.T) {
+	_, err := NewSnowflakeIdGenerator(MAX_NODE_ID + 1)
+	assert.NotNil(t, err)
+	_, err = NewSnowflakeIdGenerator(-1)
+	assert.NotNil(t, err)
+}
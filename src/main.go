@@ -1,29 +1,182 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
-const APPLICATION_PORT = 8123
-
-func likeDislikeHandler(c *gin.Context, backendHandler func(int64) (int64, int64, error)) {
-	commentId, err := strconv.Atoi(c.Param("commentId"))
+func parseCommentId(c *gin.Context) (int64, bool) {
+	commentId, err := strconv.ParseInt(c.Param("commentId"), 10, 64)
 	if err != nil {
 		c.PureJSON(http.StatusUnprocessableEntity, gin.H{
 			"error": fmt.Sprintf("Invalid commentId: %v", c.Param("commentId")),
 		})
+		return 0, false
+	}
+	return commentId, true
+}
+
+const COMMENT_COOKIE_PREFIX = "isso-"
+
+func getCommentCookieName(commentId int64) string {
+	return fmt.Sprintf("%v%v", COMMENT_COOKIE_PREFIX, commentId)
+}
+
+// setCommentCookie marks client as author of the comment.
+// Value is duplicated to X-Set-Cookie, because isso frontend may be on another domain
+func setCommentCookie(c *gin.Context, commentId int64, sessionKey string, maxAge time.Duration) {
+	writeCommentCookie(c, http.Cookie{
+		Name:   getCommentCookieName(commentId),
+		Value:  SignCommentToken(commentId, sessionKey),
+		MaxAge: int(maxAge.Seconds()),
+	})
+}
+
+func removeCommentCookie(c *gin.Context, commentId int64) {
+	writeCommentCookie(c, http.Cookie{
+		Name:   getCommentCookieName(commentId),
+		Value:  "",
+		MaxAge: -1,
+	})
+}
+
+// writeCommentCookie adds cookie to response, other cookies of response are kept.
+// NB: frontend copies X-Set-Cookie into document.cookie, so only its copy is readable by scripts
+func writeCommentCookie(c *gin.Context, cookie http.Cookie) {
+	cookie.Path = "/"
+	cookie.SameSite = http.SameSiteLaxMode
+	c.Header("X-Set-Cookie", cookie.String())
+	cookie.HttpOnly = true
+	http.SetCookie(c.Writer, &cookie)
+}
+
+// respondError returns isso-like error body, invalid field is added for validation errors
+func respondError(c *gin.Context, status int, err error) {
+	body := gin.H{"error": err.Error()}
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		body["field"] = validationErr.Field
+	}
+	c.PureJSON(status, body)
+}
+
+func getModificationErrorStatus(err error) int {
+	if errors.Is(err, ErrCommentNotFound) {
+		return http.StatusNotFound
+	} else if errors.Is(err, ErrEditWindowExpired) || errors.Is(err, ErrSelfVote) {
+		return http.StatusForbidden
+	} else if errors.Is(err, ErrAlreadyVoted) || errors.Is(err, ErrCommentNotPending) {
+		return http.StatusConflict
 	}
-	likes, dislikes, isOk := backendHandler(
-		int64(commentId))
+	return http.StatusBadRequest
+}
+
+// parseLimit parses isso limit, "inf" or empty value for unlimited
+func parseLimit(value string) (int, error) {
+	if value == "" || value == "inf" {
+		return -1, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid limit: %v", value)
+	}
+	return limit, nil
+}
+
+func parseCommentsQuery(c *gin.Context) (CommentsQuery, error) {
+	query := DefaultCommentsQuery()
+	var err error
+
+	if parent := c.Query("parent"); parent != "" && parent != "null" {
+		parentId, err := strconv.ParseInt(parent, 10, 64)
+		if err != nil {
+			return query, fmt.Errorf("invalid parent: %v", parent)
+		}
+		query.Parent = &parentId
+	}
+	if query.Limit, err = parseLimit(c.Query("limit")); err != nil {
+		return query, err
+	}
+	if query.NestedLimit, err = parseLimit(c.Query("nested_limit")); err != nil {
+		return query, err
+	}
+	if after := c.Query("after"); after != "" {
+		query.After, err = strconv.ParseFloat(after, 64)
+		if err != nil {
+			return query, fmt.Errorf("invalid after: %v", after)
+		}
+	}
+	query.Plain = c.Query("plain") == "1"
+	if sortOrder := c.Query("sort"); sortOrder != "" {
+		if sortOrder != SORT_OLDEST && sortOrder != SORT_NEWEST && sortOrder != SORT_UPVOTES {
+			return query, fmt.Errorf("invalid sort: %v", sortOrder)
+		}
+		query.Sort = sortOrder
+	}
+	return query, nil
+}
+
+func isCommentAuthor(c *gin.Context, commentId int64, sessionKey string) bool {
+	token, err := c.Cookie(getCommentCookieName(commentId))
+	if err != nil {
+		return false
+	}
+	return VerifyCommentToken(commentId, token, sessionKey)
+}
+
+// getAuthoredCommentIds returns ids of all comments with valid author cookies
+func getAuthoredCommentIds(c *gin.Context, sessionKey string) []int64 {
+	res := make([]int64, 0)
+	for _, cookie := range c.Request.Cookies() {
+		if !strings.HasPrefix(cookie.Name, COMMENT_COOKIE_PREFIX) {
+			continue
+		}
+		commentId, err := strconv.ParseInt(strings.TrimPrefix(cookie.Name, COMMENT_COOKIE_PREFIX), 10, 64)
+		if err == nil && VerifyCommentToken(commentId, cookie.Value, sessionKey) {
+			res = append(res, commentId)
+		}
+	}
+	return res
+}
+
+func getClientInfo(c *gin.Context, sessionKey string, voterSecret string) ClientInfo {
+	return ClientInfo{
+		IsAuthorOf: func(commentId int64) bool {
+			return isCommentAuthor(c, commentId, sessionKey)
+		},
+		AuthoredIds: func() []int64 {
+			return getAuthoredCommentIds(c, sessionKey)
+		},
+		VoterId: HashClientAddress(c.ClientIP(), voterSecret),
+	}
+}
+
+func likeDislikeHandler(c *gin.Context, backendHandler func(int64) (int64, int64, error)) {
+	commentId, isValid := parseCommentId(c)
+	if !isValid {
+		return
+	}
+	likes, dislikes, isOk := backendHandler(commentId)
 	if isOk != nil {
-		c.PureJSON(http.StatusUnprocessableEntity, gin.H{
+		status := http.StatusUnprocessableEntity
+		if errors.Is(isOk, ErrAlreadyVoted) || errors.Is(isOk, ErrSelfVote) {
+			status = getModificationErrorStatus(isOk)
+		}
+		c.PureJSON(status, gin.H{
 			"likes":    likes,
 			"dislikes": dislikes,
 			"error":    isOk.Error(),
@@ -39,15 +192,28 @@ func likeDislikeHandler(c *gin.Context, backendHandler func(int64) (int64, int64
 }
 
 func GetGinApp(config ApplicationConfig) *gin.Engine {
+	return NewGinApp(config, GetCommentsLogic(config))
+}
+
+func NewGinApp(config ApplicationConfig, commentsBackend CommentsLogicInterface) *gin.Engine {
 	r := gin.Default()
+	// NB: gin trusts X-Forwarded-For of any client by default, so voters could choose their addresses
+	if err := r.SetTrustedProxies(config.Server.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err.Error())
+	}
 
+	corsOrigins := config.Server.CorsOrigins
+	if len(corsOrigins) == 0 {
+		corsOrigins = DefaultServerConfig().CorsOrigins
+	}
 	r.Use(cors.New(cors.Config{
-		AllowOrigins: []string{"http://127.0.0.1:8800"},
-		AllowMethods: []string{http.MethodGet, http.MethodPatch, http.MethodPost, http.MethodHead, http.MethodDelete, http.MethodOptions},
-		AllowHeaders: []string{"Content-Type", "X-XSRF-TOKEN", "Accept", "Origin", "X-Requested-With", "Authorization"},
+		AllowOrigins: corsOrigins,
+		AllowMethods: []string{http.MethodGet, http.MethodPatch, http.MethodPost, http.MethodPut, http.MethodHead, http.MethodDelete, http.MethodOptions},
+		AllowHeaders: []string{"Content-Type", "X-XSRF-TOKEN", "Accept", "Origin", "X-Requested-With", "Authorization", API_KEY_HEADER},
 		ExposeHeaders: []string{
 			"Content-Length",
 			"Date", // client error without this line, in timezone calculation
+			"X-Set-Cookie",
 		},
 		AllowCredentials: true,
 	}))
@@ -55,16 +221,61 @@ func GetGinApp(config ApplicationConfig) *gin.Engine {
 	metricsMonitor := GetPrometheusHandler()
 	metricsMonitor.Use(r)
 
-	commentsBackend := GetCommentsLogic(config)
+	sessionKey := config.SessionKey
+	if sessionKey == "" {
+		log.Printf("No session key, generating random one. Comments will be editable only until restart")
+		sessionKey = GenerateSessionKey()
+	}
+	// voters must be recognized after restarts and by other replicas, so random session key is not used
+	voterSecret := config.VoterSecret
+	if voterSecret == "" {
+		voterSecret = config.HashSecret
+	}
+	if voterSecret == "" {
+		voterSecret = DEFAULT_HASH_SECRET
+	}
+
+	renderer := NewMarkupRenderer(config.Markup)
 
 	r.Static("/js", "./static/js")
 	r.Static("/css", "./static/css")
 
+	r.GET("/config", func(c *gin.Context) {
+		c.PureJSON(200, gin.H{
+			"config": gin.H{
+				"reply-to-self":       config.Policy.ReplyToSelf,
+				"require-author":      config.Policy.RequireAuthor,
+				"require-email":       config.Policy.RequireEmail,
+				"reply-notifications": config.Policy.ReplyNotifications,
+				"gravatar":            config.Policy.Gravatar,
+				"avatar":              config.Policy.Avatar,
+				"feed":                true,
+				"max-age":             int(config.Policy.EditMaxAge.Seconds()),
+			},
+		})
+	})
+
 	r.OPTIONS("/count", func(c *gin.Context) {
 		c.String(200, "")
 	})
 	r.POST("/count", func(c *gin.Context) {
-		c.PureJSON(200, make([]int, 0))
+		uris := make([]string, 0)
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&uris); err != nil {
+				c.PureJSON(http.StatusUnprocessableEntity, gin.H{
+					"error": "Expected list of uris",
+				})
+				return
+			}
+		}
+		counts, err := commentsBackend.CountComments(uris, getClientInfo(c, sessionKey, voterSecret))
+		if err != nil {
+			c.PureJSON(http.StatusInternalServerError, gin.H{
+				"error": "Unable to count comments",
+			})
+			return
+		}
+		c.PureJSON(200, counts)
 	})
 
 	r.OPTIONS("/", func(c *gin.Context) {
@@ -76,14 +287,50 @@ func GetGinApp(config ApplicationConfig) *gin.Engine {
 			c.PureJSON(http.StatusUnprocessableEntity, gin.H{
 				"error": "No uri in query",
 			})
+			return
 		}
-		comments := commentsBackend.GetComments(uri, 10)
-		c.PureJSON(200, gin.H{
-			"id":             nil,
-			"total_replies":  len(comments),
-			"hidden_replies": 0,
-			"replies":        comments,
-		})
+		query, err := parseCommentsQuery(c)
+		if err != nil {
+			c.PureJSON(http.StatusUnprocessableEntity, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.PureJSON(200, commentsBackend.GetComments(uri, query, getClientInfo(c, sessionKey, voterSecret)))
+	})
+
+	r.GET("/feed", func(c *gin.Context) {
+		uri := c.Query("uri")
+		if len(uri) == 0 {
+			c.PureJSON(http.StatusUnprocessableEntity, gin.H{
+				"error": "No uri in query",
+			})
+			return
+		}
+		comments := commentsBackend.GetLatestComments(uri, FEED_LIMIT)
+		feed, err := BuildAtomFeed(getFeedTag(config.Feed, c.Request.Host, uri), uri, c.Request.URL.String(), comments)
+		if err != nil {
+			log.Printf("Unable to build feed for %v: %v\n", uri, err.Error())
+			c.PureJSON(http.StatusInternalServerError, gin.H{
+				"error": "Unable to build feed",
+			})
+			return
+		}
+
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%v", int(FEED_MAX_AGE.Seconds())))
+		c.Header("ETag", feed.ETag)
+		c.Header("Last-Modified", feed.Updated.Format(http.TimeFormat))
+		if c.GetHeader("If-None-Match") == feed.ETag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		if since, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && c.GetHeader("If-None-Match") == "" {
+			if !feed.Updated.Truncate(time.Second).After(since) {
+				c.Status(http.StatusNotModified)
+				return
+			}
+		}
+		c.Data(200, "application/atom+xml; charset=utf-8", feed.Body)
 	})
 
 	r.POST("/preview", func(c *gin.Context) {
@@ -93,7 +340,7 @@ func GetGinApp(config ApplicationConfig) *gin.Engine {
 			log.Printf("Preview error: %v\n", err.Error())
 			return
 		}
-		outputComment := PreviewModel{Text: RenderMarkdown(inputComment.Text)}
+		outputComment := PreviewModel{Text: renderer.Render(inputComment.Text)}
 		c.PureJSON(200, outputComment)
 	})
 	r.POST("/new", func(c *gin.Context) {
@@ -111,31 +358,134 @@ func GetGinApp(config ApplicationConfig) *gin.Engine {
 			})
 			return
 		}
-		newComment, err := commentsBackend.AddComment(uri, &inputComment)
+		newComment, err := commentsBackend.AddComment(uri, &inputComment, getClientInfo(c, sessionKey, voterSecret))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		setCommentCookie(c, newComment.Id, sessionKey, config.Policy.EditMaxAge)
+		c.PureJSON(201, newComment)
+	})
+	r.GET("/id/:commentId", func(c *gin.Context) {
+		commentId, isValid := parseCommentId(c)
+		if !isValid {
+			return
+		}
+		comment, err := commentsBackend.GetComment(commentId, c.Query("plain") == "1")
+		if err == nil && comment.Mode == MODE_PENDING && !isCommentAuthor(c, commentId, sessionKey) {
+			err = fmt.Errorf("%w: %v", ErrCommentNotFound, commentId)
+		}
 		if err != nil {
-			c.PureJSON(http.StatusBadRequest, gin.H{
+			c.PureJSON(http.StatusNotFound, gin.H{
 				"error": err.Error(),
 			})
 			return
 		}
-		c.PureJSON(201, newComment)
+		c.PureJSON(200, comment)
+	})
+	r.PUT("/id/:commentId", func(c *gin.Context) {
+		commentId, isValid := parseCommentId(c)
+		if !isValid {
+			return
+		}
+		if !isCommentAuthor(c, commentId, sessionKey) {
+			c.PureJSON(http.StatusForbidden, gin.H{
+				"error": "Not authorized to modify this comment",
+			})
+			return
+		}
+		editData := CommentModelEdit{}
+		if err := c.ShouldBindJSON(&editData); err != nil {
+			c.PureJSON(http.StatusUnprocessableEntity, gin.H{
+				"error": "Invalid input model",
+			})
+			return
+		}
+		editedComment, err := commentsBackend.EditComment(commentId, &editData)
+		if err != nil {
+			respondError(c, getModificationErrorStatus(err), err)
+			return
+		}
+		setCommentCookie(c, commentId, sessionKey, config.Policy.EditMaxAge)
+		c.PureJSON(200, editedComment)
+	})
+	r.DELETE("/id/:commentId", func(c *gin.Context) {
+		commentId, isValid := parseCommentId(c)
+		if !isValid {
+			return
+		}
+		if !isCommentAuthor(c, commentId, sessionKey) {
+			c.PureJSON(http.StatusForbidden, gin.H{
+				"error": "Not authorized to remove this comment",
+			})
+			return
+		}
+		deletedComment, err := commentsBackend.DeleteComment(commentId)
+		if err != nil {
+			c.PureJSON(getModificationErrorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		removeCommentCookie(c, commentId)
+		// isso frontend expects null for completely removed comment
+		c.PureJSON(200, deletedComment)
 	})
 	r.POST("/id/:commentId/like", func(c *gin.Context) {
 		likeDislikeHandler(c, func(commentId int64) (int64, int64, error) {
-			return commentsBackend.Like(commentId)
+			return commentsBackend.Like(commentId, getClientInfo(c, sessionKey, voterSecret))
 		})
 	})
 	r.POST("/id/:commentId/dislike", func(c *gin.Context) {
 		likeDislikeHandler(c, func(commentId int64) (int64, int64, error) {
-			return commentsBackend.Dislike(commentId)
+			return commentsBackend.Dislike(commentId, getClientInfo(c, sessionKey, voterSecret))
 		})
 	})
+	addModerationRoutes(r, NewModerationSigner(config), commentsBackend)
+	if config.Notify.Enabled {
+		addNotifyRoutes(r, NewUnsubscribeSigner(config), commentsBackend)
+	}
 	return r
 }
 
 func main() {
 	fmt.Printf("s3-comment, builded with Go %s\n", runtime.Version())
 
-	app := GetGinApp(ReadConfigFromEnvs())
-	app.Run("0.0.0.0:" + strconv.Itoa(APPLICATION_PORT))
+	config := ReadConfig()
+	if len(os.Args) > 1 {
+		err := RunCommand(config, os.Args[1:])
+		if err != nil {
+			log.Fatalf("Command %v failed: %v", os.Args[1], err.Error())
+		}
+		return
+	}
+
+	log.Printf("Effective config:\n%v", DumpConfig(config))
+	for _, warning := range ConfigWarnings(config) {
+		log.Printf("Warning: %v\n", warning)
+	}
+	sites := NewSitesRouter(config)
+	server := &http.Server{
+		Addr:    net.JoinHostPort(config.Server.Host, strconv.Itoa(config.Server.Port)),
+		Handler: sites,
+	}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err.Error())
+		}
+	}()
+
+	// NB: votes are buffered, so they must be flushed before exit
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	log.Printf("Shutting down\n")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+	err := sites.Close()
+	if err != nil {
+		log.Printf("Unable to save data on shutdown: %v\n", err.Error())
+	}
 }
@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/minio/minio-go/v7"
@@ -32,6 +33,51 @@ func getFloat(unk interface{}) (float64, error) {
 	return fv.Float(), nil
 }
 
+const FORM_CONTENT_TYPE = "application/x-www-form-urlencoded"
+
+// requestOption changes request of serveRequest before it is served
+type requestOption func(*http.Request)
+
+func withHeader(name string, value string) requestOption {
+	return func(req *http.Request) {
+		req.Header.Set(name, value)
+	}
+}
+
+func withBearer(token string) requestOption {
+	return withHeader("Authorization", "Bearer "+token)
+}
+
+func withCookies(cookies []*http.Cookie) requestOption {
+	return func(req *http.Request) {
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+	}
+}
+
+func withHost(host string) requestOption {
+	return func(req *http.Request) {
+		req.Host = host
+	}
+}
+
+func serveRequest(handler http.Handler, method string, path string, body string, options ...requestOption) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	for _, option := range options {
+		option(req)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func jsonBody(t *testing.T, value interface{}) string {
+	data, err := json.Marshal(value)
+	assert.Nil(t, err)
+	return string(data)
+}
+
 func getFakeInputComment() CommentModelInput {
 	return CommentModelInput{
 		Author:       s("Test user Alex"),
@@ -98,6 +144,105 @@ func testCount(t *testing.T, app *gin.Engine) {
 
 }
 
+func countComments(t *testing.T, app *gin.Engine, uris []string) []int {
+	urisData, err := json.Marshal(uris)
+	assert.Nil(t, err)
+	req, _ := http.NewRequest("POST", "/count", strings.NewReader(string(urisData)))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var counts []int
+	json.Unmarshal(w.Body.Bytes(), &counts)
+	return counts
+}
+
+func testCountScenarios(t *testing.T, app *gin.Engine, uriPrefix string) {
+	inputComment := getFakeInputComment()
+	first := uriPrefix + "/first"
+	second := uriPrefix + "/second"
+	empty := uriPrefix + "/empty"
+	postComment(t, app, &inputComment, first)
+	assert.Equal(t, []int{1, 0, 0}, countComments(t, app, []string{first, second, empty}))
+
+	// cached counts must be updated with new comments
+	postComment(t, app, &inputComment, first)
+	postComment(t, app, &inputComment, second)
+	assert.Equal(t, []int{2, 1, 0, 2}, countComments(t, app, []string{first, second, empty, first}))
+
+	req, _ := http.NewRequest("POST", "/count", strings.NewReader("{\"uri\": 1}"))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, 422, w.Code)
+}
+
+func testRepliesScenario(t *testing.T, app *gin.Engine, uri string) {
+	inputComment := getFakeInputComment()
+	root := postComment(t, app, &inputComment, uri)
+	inputComment.Parent = &root.Id
+	reply := postComment(t, app, &inputComment, uri)
+	assert.Equal(t, root.Id, *reply.Parent)
+
+	t.Run("TestReplyIsNested", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/?uri="+uri, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+
+		var thread CommentModelOutput
+		json.Unmarshal(w.Body.Bytes(), &thread)
+		assert.Equal(t, 1, thread.TotalRelies)
+		assert.Equal(t, 1, thread.Replies[0].TotalRelies)
+		assert.Equal(t, reply.Id, thread.Replies[0].Replies[0].Id)
+	})
+	t.Run("TestRepliesOfParent", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/?uri=%v&parent=%v&limit=1&nested_limit=inf", uri, root.Id), nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+
+		var thread CommentsThread
+		json.Unmarshal(w.Body.Bytes(), &thread)
+		assert.Equal(t, root.Id, *thread.Id)
+		assert.Equal(t, reply.Id, thread.Replies[0].Id)
+	})
+	t.Run("TestInvalidQuery", func(t *testing.T) {
+		for _, query := range []string{"limit=-1", "nested_limit=x", "after=x", "parent=x", "sort=random"} {
+			req, _ := http.NewRequest("GET", "/?uri="+uri+"&"+query, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, req)
+			assert.Equal(t, 422, w.Code)
+		}
+	})
+	t.Run("TestParentFromAnotherPage", func(t *testing.T) {
+		code, _ := prePostComment(t, app, &inputComment, uri+"/another")
+		assert.Equal(t, 400, code)
+	})
+}
+
+func testFeedScenario(t *testing.T, app *gin.Engine, uri string) {
+	inputComment := getFakeInputComment()
+	created := postComment(t, app, &inputComment, uri)
+
+	req, _ := http.NewRequest("GET", "/feed?uri="+uri, nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/atom+xml; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.NotEmpty(t, w.Header().Get("Cache-Control"))
+	assert.Contains(t, w.Body.String(), fmt.Sprintf("/%v</id>", created.Id))
+	assert.Contains(t, w.Body.String(), "<name>"+*inputComment.Author+"</name>")
+	assert.Contains(t, w.Body.String(), "&lt;em&gt;world&lt;/em&gt;")
+
+	t.Run("TestFeedNotModified", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/feed?uri="+uri, nil)
+		req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+		cachedW := httptest.NewRecorder()
+		app.ServeHTTP(cachedW, req)
+		assert.Equal(t, 304, cachedW.Code)
+	})
+}
+
 func TestEngineWithoutIntegrations(t *testing.T) {
 	app := GetGinApp(ApplicationConfig{})
 
@@ -108,9 +253,50 @@ func TestEngineWithoutIntegrations(t *testing.T) {
 	t.Run("TestWebCount", func(t *testing.T) {
 		testCount(t, app)
 	})
+
+	t.Run("TestWebPreviewSanitized", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(
+			"POST",
+			"/preview",
+			strings.NewReader(`{"text":"<img src=x onerror=alert(1)>[link](javascript:alert(1))"}`),
+		)
+		app.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		var preview PreviewModel
+		json.Unmarshal(w.Body.Bytes(), &preview)
+		assert.Equal(t, "<p><a rel=\"nofollow noopener ugc\">link</a></p>\n", preview.Text)
+	})
+
+	t.Run("TestWebPreviewHighlighted", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(
+			"POST",
+			"/preview",
+			strings.NewReader(`{"text":"`+"```yaml\\nkey: value\\n```"+`"}`),
+		)
+		app.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		var preview PreviewModel
+		json.Unmarshal(w.Body.Bytes(), &preview)
+		assert.Equal(t, NewMarkupRenderer(DefaultMarkupConfig()).Render("```yaml\nkey: value\n```"), preview.Text)
+		assert.Contains(t, preview.Text, "<span class=\"nt\">key</span>")
+	})
+
+	t.Run("TestWebConfig", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/config", nil)
+		app.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+
+		var clientConfig map[string]map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &clientConfig)
+		assert.Equal(t, false, clientConfig["config"]["require-email"])
+		assert.Equal(t, float64(0), clientConfig["config"]["max-age"])
+	})
 }
 
-func prePostComment(t *testing.T, app *gin.Engine, inputComment *CommentModelInput, uri string) (int, string) {
+func postCommentRecorder(t *testing.T, app *gin.Engine, inputComment *CommentModelInput, uri string) *httptest.ResponseRecorder {
 	inputCommentData, err := json.Marshal(inputComment)
 	assert.Nil(t, err)
 	req, _ := http.NewRequest(
@@ -120,10 +306,234 @@ func prePostComment(t *testing.T, app *gin.Engine, inputComment *CommentModelInp
 	)
 	w := httptest.NewRecorder()
 	app.ServeHTTP(w, req)
+	return w
+}
+
+func prePostComment(t *testing.T, app *gin.Engine, inputComment *CommentModelInput, uri string) (int, string) {
+	w := postCommentRecorder(t, app, inputComment, uri)
+	return w.Code, strings.TrimSpace(w.Body.String())
+}
+
+func editComment(t *testing.T, app *gin.Engine, commentId int64, cookies []*http.Cookie, text string) (int, CommentModelOutput) {
+	editData, err := json.Marshal(CommentModelEdit{Text: text})
+	assert.Nil(t, err)
+	req, _ := http.NewRequest(
+		"PUT",
+		fmt.Sprintf("/id/%v", commentId),
+		strings.NewReader(string(editData)),
+	)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+
+	var resultModel CommentModelOutput
+	json.Unmarshal(w.Body.Bytes(), &resultModel)
+	return w.Code, resultModel
+}
+
+func testEditScenarios(t *testing.T, app *gin.Engine, uri string) {
+	inputComment := getFakeInputComment()
+	w := postCommentRecorder(t, app, &inputComment, uri)
+	assert.Equal(t, 201, w.Code)
+	assert.NotEmpty(t, w.Header().Get("X-Set-Cookie"))
+	assert.NotContains(t, w.Header().Get("X-Set-Cookie"), "HttpOnly")
+	var created CommentModelOutput
+	json.Unmarshal(w.Body.Bytes(), &created)
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+
+	t.Run("TestEditWithoutCookie", func(t *testing.T) {
+		code, _ := editComment(t, app, created.Id, nil, "Edited")
+		assert.Equal(t, 403, code)
+	})
+	t.Run("TestEditForeignCookie", func(t *testing.T) {
+		foreignCookie := http.Cookie{Name: getCommentCookieName(created.Id), Value: "fake"}
+		code, _ := editComment(t, app, created.Id, []*http.Cookie{&foreignCookie}, "Edited")
+		assert.Equal(t, 403, code)
+	})
+	t.Run("TestEditInvalid", func(t *testing.T) {
+		code, _ := editComment(t, app, created.Id, cookies, " \u200b ")
+		assert.Equal(t, 400, code)
+	})
+	t.Run("TestEditByAuthor", func(t *testing.T) {
+		code, edited := editComment(t, app, created.Id, cookies, "Edited *text*")
+		assert.Equal(t, 200, code)
+		assert.Equal(t, "<p>Edited <em>text</em></p>\n", edited.Text)
+		assert.NotNil(t, edited.Modified)
+		assert.Equal(t, *inputComment.Author, *edited.Author)
+	})
+}
 
+func deleteComment(t *testing.T, app *gin.Engine, commentId int64, cookies []*http.Cookie) (int, string) {
+	req, _ := http.NewRequest(
+		"DELETE",
+		fmt.Sprintf("/id/%v", commentId),
+		nil,
+	)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
 	return w.Code, strings.TrimSpace(w.Body.String())
 }
 
+func testDeleteScenarios(t *testing.T, app *gin.Engine, uri string) {
+	inputComment := getFakeInputComment()
+	w := postCommentRecorder(t, app, &inputComment, uri)
+	assert.Equal(t, 201, w.Code)
+	var created CommentModelOutput
+	json.Unmarshal(w.Body.Bytes(), &created)
+	cookies := w.Result().Cookies()
+	assert.Equal(t, 1, getCommentsForPage(t, app, uri))
+
+	t.Run("TestDeleteWithoutCookie", func(t *testing.T) {
+		code, _ := deleteComment(t, app, created.Id, nil)
+		assert.Equal(t, 403, code)
+		assert.Equal(t, 1, getCommentsForPage(t, app, uri))
+	})
+	t.Run("TestDeleteByAuthor", func(t *testing.T) {
+		code, body := deleteComment(t, app, created.Id, cookies)
+		assert.Equal(t, 200, code)
+		assert.Equal(t, "null", body)
+		assert.Equal(t, 0, getCommentsForPage(t, app, uri))
+	})
+	t.Run("TestDeleteTwice", func(t *testing.T) {
+		code, _ := deleteComment(t, app, created.Id, cookies)
+		assert.Equal(t, 404, code)
+	})
+}
+
+func viewComment(t *testing.T, app *gin.Engine, commentId int64, plain bool) (int, CommentModelOutput) {
+	url := fmt.Sprintf("/id/%v", commentId)
+	if plain {
+		url += "?plain=1"
+	}
+	req, _ := http.NewRequest("GET", url, nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+
+	var resultModel CommentModelOutput
+	json.Unmarshal(w.Body.Bytes(), &resultModel)
+	return w.Code, resultModel
+}
+
+func testViewScenarios(t *testing.T, app *gin.Engine, uri string) {
+	inputComment := getFakeInputComment()
+	created := postComment(t, app, &inputComment, uri)
+
+	t.Run("TestViewRendered", func(t *testing.T) {
+		code, comment := viewComment(t, app, created.Id, false)
+		assert.Equal(t, 200, code)
+		assert.Equal(t, created.Text, comment.Text)
+	})
+	t.Run("TestViewPlain", func(t *testing.T) {
+		code, comment := viewComment(t, app, created.Id, true)
+		assert.Equal(t, 200, code)
+		assert.Equal(t, inputComment.Text, comment.Text)
+	})
+	t.Run("TestViewNotExisting", func(t *testing.T) {
+		code, _ := viewComment(t, app, 41, false)
+		assert.Equal(t, 404, code)
+	})
+}
+
+func testVotesScenario(t *testing.T, app *gin.Engine, uri string) {
+	inputComment := getFakeInputComment()
+	created := postComment(t, app, &inputComment, uri)
+
+	t.Run("TestSelfVote", func(t *testing.T) {
+		// comments are posted in tests without remote address
+		code, _ := voteComment(t, app, created.Id, "like", "")
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+	t.Run("TestRepeatedVote", func(t *testing.T) {
+		code, body := voteComment(t, app, created.Id, "like", "198.51.100.1:1234")
+		assert.Equal(t, 200, code)
+		assert.Equal(t, 1.0, body["likes"])
+		code, body = voteComment(t, app, created.Id, "dislike", "198.51.100.1:4321")
+		assert.Equal(t, http.StatusConflict, code)
+		assert.Equal(t, 1.0, body["likes"])
+		assert.Equal(t, 0.0, body["dislikes"])
+		code, body = voteComment(t, app, created.Id, "dislike", "198.51.100.2:1234")
+		assert.Equal(t, 200, code)
+		assert.Equal(t, 1.0, body["dislikes"])
+	})
+	t.Run("TestForwardedForIgnored", func(t *testing.T) {
+		// proxies are not trusted by default, so client can't change its address
+		for ind, expectedCode := range []int{200, http.StatusConflict} {
+			fromProxy := func(req *http.Request) { req.RemoteAddr = "198.51.100.3:1234" }
+			forwardedFor := withHeader("X-Forwarded-For", fmt.Sprintf("192.0.2.%v", ind))
+			w := serveRequest(app, "POST", fmt.Sprintf("/id/%v/like", created.Id), "", fromProxy, forwardedFor)
+			assert.Equal(t, expectedCode, w.Code)
+		}
+	})
+}
+
+func testValidationScenario(t *testing.T, app *gin.Engine, uri string) {
+	t.Run("TestInvalidFields", func(t *testing.T) {
+		for field, inputComment := range map[string]CommentModelInput{
+			"text":    {Text: "\u200b"},
+			"email":   {Text: "Hello", Email: s("John <john@example.com>")},
+			"website": {Text: "Hello", Website: s("javascript:alert(1)")},
+			"author":  {Text: "Hello", Author: s(strings.Repeat("a", 255))},
+		} {
+			w := postCommentRecorder(t, app, &inputComment, uri)
+			assert.Equal(t, 400, w.Code)
+			var body map[string]string
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, field, body["field"])
+			assert.Contains(t, body["error"], field)
+		}
+	})
+	t.Run("TestSanitizedText", func(t *testing.T) {
+		inputComment := CommentModelInput{Text: "<script>alert(1)</script>*safe*", Author: s("John")}
+		created := postComment(t, app, &inputComment, uri)
+		assert.Equal(t, "<p><em>safe</em></p>\n", created.Text)
+	})
+	t.Run("TestNormalizedFields", func(t *testing.T) {
+		inputComment := CommentModelInput{
+			Text:    "Hello\r\nworld\u0007",
+			Author:  s(" Jo\u200bhn\u202e "),
+			Email:   s("  "),
+			Website: s("Example.COM/Path"),
+		}
+		code, body := prePostComment(t, app, &inputComment, uri)
+		assert.Equal(t, 201, code)
+		var created CommentModelOutput
+		json.Unmarshal([]byte(body), &created)
+		assert.Equal(t, "John", *created.Author)
+		assert.Equal(t, "http://example.com/Path", *created.Website)
+		assert.Equal(t, "<p>Hello\nworld</p>\n", created.Text)
+	})
+}
+
+func TestEngineWithMemoryStorage(t *testing.T) {
+	app := GetGinApp(ApplicationConfig{Policy: DefaultPolicyConfig()})
+	testEditScenarios(t, app, "example.com/memory-edit")
+	testDeleteScenarios(t, app, "example.com/memory-delete")
+	testViewScenarios(t, app, "example.com/memory-view")
+	testCountScenarios(t, app, "example.com/memory-count")
+	testRepliesScenario(t, app, "example.com/memory-replies")
+	testFeedScenario(t, app, "example.com/memory-feed")
+	testVotesScenario(t, app, "example.com/memory-votes")
+	testValidationScenario(t, app, "example.com/memory-validation")
+
+	t.Run("TestEditDisabled", func(t *testing.T) {
+		app := GetGinApp(ApplicationConfig{})
+		inputComment := getFakeInputComment()
+		w := postCommentRecorder(t, app, &inputComment, "example.com/no-edit")
+		var created CommentModelOutput
+		json.Unmarshal(w.Body.Bytes(), &created)
+		code, _ := editComment(t, app, created.Id, w.Result().Cookies(), "Edited")
+		assert.Equal(t, 403, code)
+	})
+}
+
 func postComment(t *testing.T, app *gin.Engine, inputComment *CommentModelInput, uri string) CommentModelOutput {
 	code, body := prePostComment(t, app, inputComment, uri)
 	assert.Equal(t, 201, code)
@@ -159,6 +569,11 @@ func getCommentsForPage(t *testing.T,
 }
 
 func likeDislikeComment(t *testing.T, app *gin.Engine, commentId int64, action string) int {
+	code, _ := voteComment(t, app, commentId, action, "192.0.2.1:1234")
+	return code
+}
+
+func voteComment(t *testing.T, app *gin.Engine, commentId int64, action string, remoteAddr string) (int, map[string]interface{}) {
 	assert.True(t, action == "like" || action == "dislike")
 	request_url := fmt.Sprintf("/id/%v/%v", commentId, action)
 	req, _ := http.NewRequest(
@@ -166,9 +581,12 @@ func likeDislikeComment(t *testing.T, app *gin.Engine, commentId int64, action s
 		request_url,
 		nil,
 	)
+	req.RemoteAddr = remoteAddr
 	w := httptest.NewRecorder()
 	app.ServeHTTP(w, req)
-	return w.Code
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
 }
 
 func testNegativeLikeScenarios(t *testing.T, app *gin.Engine) {
@@ -191,14 +609,188 @@ func testNegativeParentScenario(t *testing.T, app *gin.Engine) {
 		assert.Equal(t, 0, fakeParentsCount)
 	})
 }
+
+func testS3Votes(t *testing.T, config MinioConfig) {
+	backend, err := NewS3CommentsStorage(config)
+	assert.Nil(t, err)
+	var commentId int64 = 42
+	votes, err := backend.GetCommentVotes(commentId)
+	assert.Nil(t, err)
+	assert.Nil(t, votes)
+
+	assert.Nil(t, backend.SaveNodeVotes(commentId, "1", VoteCounts{Likes: 2}))
+	assert.Nil(t, backend.SaveNodeVotes(commentId, "2", VoteCounts{Likes: 1, Dislikes: 1}))
+	assert.Nil(t, backend.SaveNodeVotes(commentId, "2", VoteCounts{Likes: 3, Dislikes: 1}))
+	votes, err = backend.GetNodeVotes(commentId, "2")
+	assert.Nil(t, err)
+	assert.Equal(t, VoteCounts{Likes: 3, Dislikes: 1}, *votes)
+	votes, err = backend.GetCommentVotes(commentId)
+	assert.Nil(t, err)
+	assert.Equal(t, VoteCounts{Likes: 5, Dislikes: 1}, *votes)
+}
+
+func testLegacyPageMigration(t *testing.T, app *gin.Engine, config MinioConfig) {
+	uri := "example.com/legacy"
+	inputComment := getFakeInputComment()
+	created := postComment(t, app, &inputComment, uri)
+
+	// move page to layout of old versions
+	client := createMinioClient(&config)
+	pageHash := getPageHash(uri, config.PageSecret)
+	err := client.RemoveObject(context.Background(), config.Bucket, getPageCommentObjectName(pageHash, created.Id), minio.RemoveObjectOptions{})
+	assert.Nil(t, err)
+	legacyData := fmt.Sprintf("[%v]", created.Id)
+	_, err = client.PutObject(
+		context.Background(), config.Bucket, getLegacyPageObjectName(pageHash),
+		strings.NewReader(legacyData), int64(len(legacyData)), minio.PutObjectOptions{},
+	)
+	assert.Nil(t, err)
+
+	backend, _ := NewS3CommentsStorage(config)
+	pageComments, err := backend.GetPageComments(uri)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{created.Id}, pageComments)
+
+	migratedCount, err := backend.MigratePages()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, migratedCount)
+	legacyComments, err := backend.readLegacyPage(pageHash)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(legacyComments))
+	pageComments, err = backend.GetPageComments(uri)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{created.Id}, pageComments)
+
+	// other instances stop reading of legacy objects too
+	other, _ := NewS3CommentsStorage(config)
+	other.minioLazyInit()
+	assert.False(t, other.hasLegacyPages())
+}
+
+func testPageRehash(t *testing.T, app *gin.Engine, config MinioConfig) {
+	uri := "example.com/rehash"
+	inputComment := getFakeInputComment()
+	first := postComment(t, app, &inputComment, uri)
+	second := postComment(t, app, &inputComment, uri)
+
+	// legacy page of old secret is moved too
+	client := createMinioClient(&config)
+	oldHash := getPageHash(uri, config.PageSecret)
+	err := client.RemoveObject(context.Background(), config.Bucket, getPageCommentObjectName(oldHash, second.Id), minio.RemoveObjectOptions{})
+	assert.Nil(t, err)
+	legacyData := fmt.Sprintf("[%v]", second.Id)
+	_, err = client.PutObject(
+		context.Background(), config.Bucket, getLegacyPageObjectName(oldHash),
+		strings.NewReader(legacyData), int64(len(legacyData)), minio.PutObjectOptions{},
+	)
+	assert.Nil(t, err)
+
+	rotatedConfig := config
+	rotatedConfig.PageSecret = "rotated-page-secret"
+	rotatedConfig.PreviousPageSecrets = []string{config.PageSecret}
+	rotated, _ := NewS3CommentsStorage(rotatedConfig)
+	pageComments, err := rotated.GetPageComments(uri)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{first.Id, second.Id}, pageComments)
+	// reads don't move pages
+	oldComments, err := rotated.readPage(oldHash)
+	assert.Nil(t, err)
+	assert.Len(t, oldComments, 2)
+
+	third := postComment(t, app, &inputComment, uri)
+	assert.Nil(t, rotated.RemoveCommentFromPage(uri, third.Id))
+	pageComments, err = rotated.GetPageComments(uri)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{first.Id, second.Id}, pageComments)
+
+	// comment of old versions has no uri, so its page is moved only when uri is passed
+	original, _ := NewS3CommentsStorage(config)
+	oldUri := "example.com/rehash-old"
+	oldComment := CommentModelOutput{Id: first.Id - 1, Created: first.Created, Mode: MODE_PUBLIC, Text: "<p>old</p>"}
+	_, err = original.AddComment(&oldComment)
+	assert.Nil(t, err)
+	assert.Nil(t, original.AddCommentToPage(oldUri, oldComment.Id))
+
+	rehashedCount, err := rotated.RehashPages(nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "1 pages of old versions are left")
+	assert.GreaterOrEqual(t, rehashedCount, 1)
+	oldComments, err = rotated.readPage(oldHash)
+	assert.Nil(t, err)
+	assert.Len(t, oldComments, 0)
+
+	pageComments, err = rotated.GetPageComments(oldUri)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{oldComment.Id}, pageComments)
+	_, err = rotated.RehashPages(nil)
+	assert.NotNil(t, err)
+	_, err = rotated.RehashPages([]string{oldUri})
+	assert.Nil(t, err)
+	moved, err := rotated.GetComment(oldComment.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, oldUri, moved.Uri)
+
+	rotatedConfig.PreviousPageSecrets = nil
+	rehashed, _ := NewS3CommentsStorage(rotatedConfig)
+	pageComments, err = rehashed.GetPageComments(uri)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{first.Id, second.Id}, pageComments)
+	pageComments, err = rehashed.GetPageComments(oldUri)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{oldComment.Id}, pageComments)
+	_, err = rehashed.RehashPages(nil)
+	assert.NotNil(t, err)
+}
+
+func testNodeIdKeeper(t *testing.T, config MinioConfig) {
+	backend, err := NewS3CommentsStorage(config)
+	assert.Nil(t, err)
+	owner := GetNodeOwnerName()
+	nodeId, err := backend.ClaimNodeId(owner)
+	assert.Nil(t, err)
+	generator, _ := NewSnowflakeIdGenerator(nodeId)
+	keeper := NewNodeIdKeeper(backend, generator, nodeId, owner)
+	defer keeper.Close()
+
+	// active lease is taken by another instance, so ids may be duplicated already
+	var failure error
+	keeper.fail = func(err error) { failure = err }
+	assert.Nil(t, backend.writeNodeLease(nodeId, "another-owner"))
+	keeper.renew()
+	assert.ErrorIs(t, failure, ErrNodeIdLost)
+	_, err = generator.NextId()
+	assert.ErrorIs(t, err, ErrNodeIdLost)
+
+	// expired lease may be taken, so generator is stopped until new node id is claimed
+	failure = nil
+	generator, _ = NewSnowflakeIdGenerator(nodeId)
+	keeper.generator = generator
+	keeper.lastRenew = time.Now().Add(-NODE_LEASE_TTL)
+	keeper.renew()
+	assert.Nil(t, failure)
+	_, err = generator.NextId()
+	assert.ErrorIs(t, err, ErrNodeIdLost)
+
+	keeper.renew()
+	newNodeId, err := generator.NodeId()
+	assert.Nil(t, err)
+	assert.NotEqual(t, nodeId, newNodeId)
+	_, err = generator.NextId()
+	assert.Nil(t, err)
+}
+
 func TestEngineWithIntegrations(t *testing.T) {
 	// really big single test for many things in one.
 	// Not a great solution, but simple enough for good covearge/code ratio
 	if _, exists := os.LookupEnv("TESTS_ENABLE_INTEGRATIONS"); !exists {
 		t.Skipf("TESTS_ENABLE_INTEGRATIONS disabled")
 	}
-	testConfig := ReadConfigFromEnvs()
+	testConfig := ReadConfig()
 	testConfig.Minio.Bucket = "test"
+	if testConfig.Redis != nil {
+		// bucket is recreated for every run, so cache of previous runs must be ignored
+		testConfig.Redis.KeyPrefix = fmt.Sprintf("test-%v:", time.Now().UnixNano())
+	}
 	app := GetGinApp(testConfig)
 	defer postDeleteS3Bucket(t, *testConfig.Minio)
 
@@ -207,8 +799,9 @@ func TestEngineWithIntegrations(t *testing.T) {
 
 	inputComment := getFakeInputComment()
 	singleComment := postComment(t, app, &inputComment, "example.com/single")
-	for _, action := range []string{"like", "dislike"} {
-		assert.Equal(t, 200, likeDislikeComment(t, app, singleComment.Id, action))
+	for ind, action := range []string{"like", "dislike"} {
+		code, _ := voteComment(t, app, singleComment.Id, action, fmt.Sprintf("203.0.113.%v:1234", ind))
+		assert.Equal(t, 200, code)
 	}
 	postComment(t, app, &inputComment, "example.com/extra")
 	postComment(t, app, &inputComment, "example.com/extra")
@@ -225,4 +818,17 @@ func TestEngineWithIntegrations(t *testing.T) {
 
 	manyCommentsCount := getCommentsForPage(t, app, "example.com/extra")
 	assert.Equal(t, 2, manyCommentsCount)
+
+	testEditScenarios(t, app, "example.com/edit")
+	testDeleteScenarios(t, app, "example.com/delete")
+	testViewScenarios(t, app, "example.com/view")
+	testCountScenarios(t, app, "example.com/count")
+	testRepliesScenario(t, app, "example.com/replies")
+	testFeedScenario(t, app, "example.com/feed")
+	testVotesScenario(t, app, "example.com/votes")
+	testS3Votes(t, *testConfig.Minio)
+	// migration marks bucket, so legacy pages are read only before it
+	testPageRehash(t, app, *testConfig.Minio)
+	testLegacyPageMigration(t, app, *testConfig.Minio)
+	testNodeIdKeeper(t, *testConfig.Minio)
 }
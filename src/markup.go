@@ -0,0 +1,173 @@
+package main
+
+import (
+	"html"
+	"io"
+	"strings"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	markdownHtml "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// markup modes
+const (
+	MARKUP_MARKDOWN = "markdown"
+	MARKUP_PLAIN    = "plain" // text is shown as is, without any formatting
+)
+
+// MARKDOWN_EXTENSIONS are names of markdown syntax extensions in config
+var MARKDOWN_EXTENSIONS = map[string]parser.Extensions{
+	"no_intra_emphasis":    parser.NoIntraEmphasis,
+	"tables":               parser.Tables,
+	"fenced_code":          parser.FencedCode,
+	"autolink":             parser.Autolink,
+	"strikethrough":        parser.Strikethrough,
+	"space_headings":       parser.SpaceHeadings,
+	"footnotes":            parser.Footnotes,
+	"backslash_line_break": parser.BackslashLineBreak,
+	"definition_lists":     parser.DefinitionLists,
+	"superscript":          parser.SuperSubscript,
+}
+
+// MARKDOWN_EXTENSION_ELEMENTS are rendered by extensions, they must be in markup.allowed_elements
+var MARKDOWN_EXTENSION_ELEMENTS = map[string][]string{
+	"tables":               {"table", "thead", "tbody", "tr", "th", "td"},
+	"fenced_code":          {"pre", "code"},
+	"autolink":             {"a"},
+	"strikethrough":        {"del"},
+	"footnotes":            {"sup", "a", "div", "hr", "ol", "li"},
+	"backslash_line_break": {"br"},
+	"definition_lists":     {"dl", "dt", "dd"},
+	"superscript":          {"sup"},
+}
+
+// MarkupRenderer converts text of comments to safe html by markup config
+type MarkupRenderer struct {
+	config      MarkupConfig
+	extensions  parser.Extensions
+	sanitizer   *HtmlSanitizer
+	highlighter *Highlighter
+}
+
+func NewMarkupRenderer(config MarkupConfig) *MarkupRenderer {
+	if config.Extensions == nil {
+		config.Extensions = DefaultMarkupConfig().Extensions
+	}
+	var extensions parser.Extensions = parser.NoExtensions
+	for _, name := range config.Extensions {
+		extensions |= MARKDOWN_EXTENSIONS[name]
+	}
+	if config.HardWrap {
+		extensions |= parser.HardLineBreak
+	}
+	defaults := DefaultMarkupConfig()
+	if config.HighlightLanguages == nil {
+		config.HighlightLanguages = defaults.HighlightLanguages
+	}
+	highlightLanguages := config.HighlightLanguages
+	if config.Mode == MARKUP_PLAIN {
+		highlightLanguages = nil // plain text has no code blocks
+	}
+	highlighter := NewHighlighter(highlightLanguages, config.HighlightMaxSize)
+
+	// copies, so slices of config are not modified
+	sanitizerConfig := config
+	if sanitizerConfig.AllowedElements == nil {
+		sanitizerConfig.AllowedElements = defaults.AllowedElements
+	}
+	if sanitizerConfig.AllowedAttributes == nil {
+		sanitizerConfig.AllowedAttributes = defaults.AllowedAttributes
+	}
+	sanitizerConfig.AllowedElements = append([]string{}, sanitizerConfig.AllowedElements...)
+	sanitizerConfig.AllowedAttributes = append([]string{}, sanitizerConfig.AllowedAttributes...)
+	if config.Images && config.Mode != MARKUP_PLAIN {
+		sanitizerConfig.AllowedElements = append(sanitizerConfig.AllowedElements, "img")
+		sanitizerConfig.AllowedAttributes = append(sanitizerConfig.AllowedAttributes, "src", "alt", "title")
+	}
+	if highlighter.Enabled() {
+		sanitizerConfig.AllowedElements = append(sanitizerConfig.AllowedElements, "span")
+	}
+	sanitizer := NewHtmlSanitizer(sanitizerConfig)
+	if highlighter.Enabled() {
+		sanitizer.allowClasses(highlightClassElements...)
+	}
+	return &MarkupRenderer{
+		config:      config,
+		extensions:  extensions,
+		sanitizer:   sanitizer,
+		highlighter: highlighter,
+	}
+}
+
+// renderNodeHook replaces disabled elements with simpler ones
+func (renderer *MarkupRenderer) renderNodeHook(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	switch node := node.(type) {
+	case *ast.Heading:
+		if renderer.config.Headings {
+			return ast.GoToNext, false
+		}
+		if entering {
+			io.WriteString(w, "<p>")
+		} else {
+			io.WriteString(w, "</p>\n")
+		}
+		return ast.GoToNext, true
+	case *ast.Image:
+		if renderer.config.Images {
+			return ast.GoToNext, false
+		}
+		// alt text of image is text of link
+		if entering {
+			io.WriteString(w, `<a href="`+html.EscapeString(string(node.Destination))+`">`)
+		} else {
+			io.WriteString(w, "</a>")
+		}
+		return ast.GoToNext, true
+	}
+	return ast.GoToNext, false
+}
+
+func (renderer *MarkupRenderer) renderMarkdown(source string) string {
+	// NB: parser and renderer keep state, so they can't be reused
+	markdownParser := parser.NewWithExtensions(renderer.extensions)
+	highlight := renderer.highlighter.newSession()
+	htmlRenderer := markdownHtml.NewRenderer(markdownHtml.RendererOptions{
+		Flags: markdownHtml.CommonFlags,
+		RenderNodeHook: func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+			// code blocks are leaves, so hook is called once for them
+			if block, isCodeBlock := node.(*ast.CodeBlock); isCodeBlock && highlight.writeCodeBlock(w, block.Info, block.Literal) {
+				return ast.GoToNext, true
+			}
+			return renderer.renderNodeHook(w, node, entering)
+		},
+	})
+	return string(markdown.ToHTML([]byte(source), markdownParser, htmlRenderer))
+}
+
+// renderPlainText splits text to paragraphs by empty lines, other newlines are line breaks
+func renderPlainText(source string) string {
+	var builder strings.Builder
+	for _, paragraph := range strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n\n") {
+		paragraph = strings.Trim(paragraph, "\n")
+		if paragraph == "" {
+			continue
+		}
+		lines := strings.Split(html.EscapeString(paragraph), "\n")
+		builder.WriteString("<p>" + strings.Join(lines, "<br>\n") + "</p>\n")
+	}
+	return builder.String()
+}
+
+func (renderer *MarkupRenderer) Render(source string) string {
+	if renderer.config.Mode == MARKUP_PLAIN {
+		return renderer.sanitizer.Sanitize(renderPlainText(source))
+	}
+	return renderer.sanitizer.Sanitize(renderer.renderMarkdown(source))
+}
+
+// Sanitize cleans html of old comments without markdown source
+func (renderer *MarkupRenderer) Sanitize(source string) string {
+	return renderer.sanitizer.Sanitize(source)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func renderWith(modify func(config *MarkupConfig), source string) string {
+	config := DefaultMarkupConfig()
+	modify(&config)
+	return NewMarkupRenderer(config).Render(source)
+}
+
+func TestMarkupDefaults(t *testing.T) {
+	noChanges := func(config *MarkupConfig) {}
+	assert.Equal(t, "<h1>Title</h1>\n", renderWith(noChanges, "# Title"))
+	assert.Equal(t, "<p><del>old</del> new</p>\n", renderWith(noChanges, "~~old~~ new"))
+	assert.Equal(t, "<p>line\nnext</p>\n", renderWith(noChanges, "line\nnext"))
+	assert.Equal(t,
+		"<p><a href=\"https://example.com/a.png\" rel=\"nofollow noopener ugc\">alt text</a></p>\n",
+		renderWith(noChanges, "![alt text](https://example.com/a.png)"),
+	)
+	assert.Equal(t,
+		"<p><a href=\"https://example.com\" rel=\"nofollow noopener ugc\">https://example.com</a></p>\n",
+		renderWith(noChanges, "https://example.com"),
+	)
+}
+
+func TestMarkupOptions(t *testing.T) {
+	assert.Equal(t, "<p>Title</p>\n", renderWith(func(config *MarkupConfig) {
+		config.Headings = false
+	}, "# Title"))
+	assert.Equal(t, "<p>line<br>\nnext</p>\n", renderWith(func(config *MarkupConfig) {
+		config.HardWrap = true
+	}, "line\nnext"))
+	assert.Equal(t, "<p><img src=\"https://example.com/a.png\" alt=\"alt\"></p>\n", renderWith(func(config *MarkupConfig) {
+		config.Images = true
+	}, "![alt](https://example.com/a.png)"))
+	assert.Equal(t, "<p>~~old~~ https://example.com</p>\n", renderWith(func(config *MarkupConfig) {
+		config.Extensions = []string{}
+	}, "~~old~~ https://example.com"))
+
+	// images are not allowed by other settings
+	config := DefaultMarkupConfig()
+	config.Images = true
+	NewMarkupRenderer(config)
+	assert.NotContains(t, config.AllowedElements, "img")
+}
+
+func TestMarkupPlain(t *testing.T) {
+	plain := func(config *MarkupConfig) {
+		config.Mode = MARKUP_PLAIN
+	}
+	assert.Equal(t,
+		"<p># Not *title*<br>\n&lt;b&gt;raw&lt;/b&gt;</p>\n<p>second</p>\n",
+		renderWith(plain, "# Not *title*\n<b>raw</b>\n\n\n\nsecond\n"),
+	)
+	assert.Equal(t, "", renderWith(plain, "\n\n"))
+}
+
+func TestMarkupConfig(t *testing.T) {
+	configPath := writeTestFile(t, "config.yaml", `
+markup:
+  hard_wrap: true
+sites:
+  - name: plain
+    hosts: [plain.example.com]
+    key_prefix: plain/
+    markup:
+      mode: plain
+  - name: blog
+`)
+	config, err := LoadConfig(getTestEnv(map[string]string{CONFIG_FILE_ENV: configPath}))
+	assert.Nil(t, err)
+	assert.Equal(t, MARKUP_PLAIN, config.Sites[0].Markup.Mode)
+	assert.True(t, config.Sites[0].Markup.HardWrap)
+	assert.Nil(t, config.Sites[1].Markup)
+
+	_, err = LoadConfig(getTestEnv(map[string]string{
+		"MARKUP_MODE":       "html",
+		"MARKUP_EXTENSIONS": "tables,mathjax",
+	}))
+	configErr, isConfigErr := err.(*ConfigError)
+	assert.True(t, isConfigErr)
+	assert.Len(t, configErr.Problems, 2)
+}
+
+func TestMarkupHighlight(t *testing.T) {
+	noChanges := func(config *MarkupConfig) {}
+	assert.Equal(t,
+		"<pre class=\"highlight\"><code class=\"language-go\"><span class=\"kd\">func</span> "+
+			"<span class=\"nf\">main</span><span class=\"p\">()</span> <span class=\"p\">{}</span>\n</code></pre>\n",
+		renderWith(noChanges, "```go\nfunc main() {}\n```"),
+	)
+	// not allowed languages and indented code are not highlighted
+	assert.Equal(t, "<pre><code class=\"language-brainfuck\">+++.\n</code></pre>\n", renderWith(noChanges, "```brainfuck\n+++.\n```"))
+	assert.Equal(t, "<pre><code>echo 1\n</code></pre>\n", renderWith(noChanges, "    echo 1\n"))
+	assert.Equal(t, "<pre><code>x := 1\n</code></pre>\n", renderWith(func(config *MarkupConfig) {
+		config.HighlightLanguages = []string{}
+	}, "```go\nx := 1\n```"))
+
+	// code after size limit is plain
+	limited := renderWith(func(config *MarkupConfig) {
+		config.HighlightMaxSize = 10
+	}, "```sh\necho 1\n```\n\n```Shell\necho 2\n```")
+	assert.Contains(t, limited, "<span class=\"nb\">echo</span> <span class=\"m\">1</span>")
+	assert.Contains(t, limited, "<pre><code class=\"language-Shell\">echo 2\n</code></pre>")
+
+	// code is escaped and classes are allowed only for highlighted code
+	assert.Contains(t, renderWith(noChanges, "```html\n<script>\n```"),
+		"<span class=\"p\">&lt;</span><span class=\"nt\">script</span><span class=\"p\">&gt;</span>")
+	assert.Equal(t, "<p><span class=\"k\">x</span> <span>y</span> <em>z</em></p>\n",
+		renderWith(noChanges, `<span class="k">x</span> <span class="a&quot;" onclick="alert(1)">y</span> <em class="k">z</em>`))
+
+	_, err := LoadConfig(getTestEnv(map[string]string{
+		"MARKUP_HIGHLIGHT_LANGUAGES": "go,klingon",
+		"MARKUP_HIGHLIGHT_MAX_SIZE":  "-1",
+	}))
+	configErr, isConfigErr := err.(*ConfigError)
+	assert.True(t, isConfigErr)
+	assert.Len(t, configErr.Problems, 2)
+}
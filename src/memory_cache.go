@@ -0,0 +1,235 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const CACHE_SHARDS = 16
+
+// metrics are shared by all caches, because storages may be created many times
+var (
+	metricCacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "memory_cache_entries",
+		Help: "Number of entries in memory cache",
+	}, []string{"cache", "site"})
+	metricCacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "memory_cache_hits",
+		Help: "Number of memory cache hits",
+	}, []string{"cache", "site"})
+	metricCacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "memory_cache_misses",
+		Help: "Number of memory cache misses",
+	}, []string{"cache", "site"})
+	metricCacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "memory_cache_evictions",
+		Help: "Number of entries removed from memory cache by limits",
+	}, []string{"cache", "site", "reason"})
+)
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time // zero for entries without ttl
+}
+
+type cacheShard struct {
+	mutex      sync.Mutex
+	items      map[string]*list.Element
+	order      *list.List // front is most recently used
+	generation uint64     // changed by every modification, see GetGeneration
+}
+
+// MemoryCache is LRU cache with entries limit and ttl, safe for concurrent use
+type MemoryCache struct {
+	name          string
+	site          string
+	shards        []*cacheShard
+	maxShardItems int // zero for unlimited
+	ttl           time.Duration
+}
+
+func NewMemoryCache(name string, maxEntries int, ttl time.Duration) *MemoryCache {
+	return NewSiteMemoryCache(DEFAULT_SITE, name, maxEntries, ttl)
+}
+
+func NewSiteMemoryCache(site string, name string, maxEntries int, ttl time.Duration) *MemoryCache {
+	shards := make([]*cacheShard, CACHE_SHARDS)
+	for ind := range shards {
+		shards[ind] = &cacheShard{
+			items: make(map[string]*list.Element),
+			order: list.New(),
+		}
+	}
+	maxShardItems := 0
+	if maxEntries > 0 {
+		maxShardItems = (maxEntries + CACHE_SHARDS - 1) / CACHE_SHARDS
+	}
+	metricCacheEntries.WithLabelValues(name, site).Add(0) // series is shared with other caches of same name
+	return &MemoryCache{
+		name:          name,
+		site:          site,
+		shards:        shards,
+		maxShardItems: maxShardItems,
+		ttl:           ttl,
+	}
+}
+
+func (cache *MemoryCache) getShard(key string) *cacheShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return cache.shards[hash.Sum32()%CACHE_SHARDS]
+}
+
+// removeElement must be called with locked shard
+func (cache *MemoryCache) removeElement(shard *cacheShard, element *list.Element) {
+	shard.order.Remove(element)
+	delete(shard.items, element.Value.(*cacheEntry).key)
+	metricCacheEntries.WithLabelValues(cache.name, cache.site).Dec()
+}
+
+// lookup must be called with locked shard
+func (cache *MemoryCache) lookup(shard *cacheShard, key string) (*list.Element, bool) {
+	element, exists := shard.items[key]
+	if !exists {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		cache.removeElement(shard, element)
+		metricCacheEvictions.WithLabelValues(cache.name, cache.site, "ttl").Inc()
+		return nil, false
+	}
+	return element, true
+}
+
+// set must be called with locked shard
+func (cache *MemoryCache) set(shard *cacheShard, key string, value interface{}) {
+	shard.generation += 1
+	expires := time.Time{}
+	if cache.ttl > 0 {
+		expires = time.Now().Add(cache.ttl)
+	}
+	if element, exists := shard.items[key]; exists {
+		entry := element.Value.(*cacheEntry)
+		entry.value = value
+		entry.expires = expires
+		shard.order.MoveToFront(element)
+		return
+	}
+	shard.items[key] = shard.order.PushFront(&cacheEntry{key: key, value: value, expires: expires})
+	metricCacheEntries.WithLabelValues(cache.name, cache.site).Inc()
+	for cache.maxShardItems > 0 && shard.order.Len() > cache.maxShardItems {
+		cache.removeElement(shard, shard.order.Back())
+		metricCacheEvictions.WithLabelValues(cache.name, cache.site, "lru").Inc()
+	}
+}
+
+func (cache *MemoryCache) Get(key string) (interface{}, bool) {
+	shard := cache.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	element, exists := cache.lookup(shard, key)
+	if !exists {
+		metricCacheMisses.WithLabelValues(cache.name, cache.site).Inc()
+		return nil, false
+	}
+	metricCacheHits.WithLabelValues(cache.name, cache.site).Inc()
+	shard.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).value, true
+}
+
+func (cache *MemoryCache) Set(key string, value interface{}) {
+	shard := cache.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	cache.set(shard, key, value)
+}
+
+// GetGeneration returns token for SetIfUnchanged, it must be taken before loading value
+func (cache *MemoryCache) GetGeneration(key string) uint64 {
+	shard := cache.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	return shard.generation
+}
+
+// SetIfUnchanged stores loaded value only if nobody modified cache after generation was taken,
+// so slow load can not overwrite newer data
+func (cache *MemoryCache) SetIfUnchanged(key string, value interface{}, generation uint64) bool {
+	shard := cache.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if shard.generation != generation {
+		return false
+	}
+	cache.set(shard, key, value)
+	return true
+}
+
+// Modify atomically replaces value, modifier returns false to keep cache unchanged
+func (cache *MemoryCache) Modify(key string, modifier func(value interface{}, exists bool) (interface{}, bool)) {
+	shard := cache.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	var value interface{} = nil
+	element, exists := cache.lookup(shard, key)
+	if exists {
+		value = element.Value.(*cacheEntry).value
+	}
+	newValue, isChanged := modifier(value, exists)
+	if isChanged {
+		cache.set(shard, key, newValue)
+	}
+}
+
+func (cache *MemoryCache) Delete(key string) {
+	shard := cache.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.generation += 1
+	if element, exists := shard.items[key]; exists {
+		cache.removeElement(shard, element)
+	}
+}
+
+func (cache *MemoryCache) Keys() []string {
+	res := make([]string, 0)
+	for _, shard := range cache.shards {
+		shard.mutex.Lock()
+		for key := range shard.items {
+			res = append(res, key)
+		}
+		shard.mutex.Unlock()
+	}
+	return res
+}
+
+func (cache *MemoryCache) Len() int {
+	res := 0
+	for _, shard := range cache.shards {
+		shard.mutex.Lock()
+		res += shard.order.Len()
+		shard.mutex.Unlock()
+	}
+	return res
+}
+
+// Clear removes all entries, loads started before it will not be saved
+func (cache *MemoryCache) Clear() {
+	for _, shard := range cache.shards {
+		shard.mutex.Lock()
+		shard.generation += 1
+		for shard.order.Len() > 0 {
+			cache.removeElement(shard, shard.order.Back())
+		}
+		shard.mutex.Unlock()
+	}
+}
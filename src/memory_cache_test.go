@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCacheLru(t *testing.T) {
+	cache := NewMemoryCache("test_lru", CACHE_SHARDS, 0) // one entry per shard
+	shard := cache.getShard("first")
+	second := ""
+	for ind := 0; second == ""; ind++ {
+		key := fmt.Sprintf("key%v", ind)
+		if cache.getShard(key) == shard {
+			second = key
+		}
+	}
+
+	cache.Set("first", 1)
+	cache.Set(second, 2)
+	_, exists := cache.Get("first")
+	assert.False(t, exists)
+	value, exists := cache.Get(second)
+	assert.True(t, exists)
+	assert.Equal(t, 2, value)
+	assert.Equal(t, 1, cache.Len())
+}
+
+func TestMemoryCacheTtl(t *testing.T) {
+	cache := NewMemoryCache("test_ttl", 0, time.Millisecond)
+	cache.Set("key", 1)
+	time.Sleep(2 * time.Millisecond)
+	_, exists := cache.Get("key")
+	assert.False(t, exists)
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestMemoryCacheSetIfUnchanged(t *testing.T) {
+	cache := NewMemoryCache("test_generation", 0, 0)
+	generation := cache.GetGeneration("key")
+	cache.Set("key", "new")
+	assert.False(t, cache.SetIfUnchanged("key", "stale", generation))
+	value, _ := cache.Get("key")
+	assert.Equal(t, "new", value)
+
+	generation = cache.GetGeneration("key")
+	assert.True(t, cache.SetIfUnchanged("key", "loaded", generation))
+}
+
+func TestMemoryCacheConcurrent(t *testing.T) {
+	cache := NewMemoryCache("test_concurrent", 100, time.Minute)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for ind := 0; ind < 1000; ind++ {
+				key := fmt.Sprintf("key%v", ind%200)
+				cache.Set(key, ind)
+				cache.Get(key)
+				cache.Modify("counter", func(value interface{}, exists bool) (interface{}, bool) {
+					if !exists {
+						return 1, true
+					}
+					return value.(int) + 1, true
+				})
+			}
+		}(worker)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, cache.Len(), 100+CACHE_SHARDS)
+}
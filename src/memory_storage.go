@@ -1,35 +1,118 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
 
+// MemoryCommentsStorageLinked caches slowBackend or works as standalone storage without it.
+// Safe for concurrent use, comments are copied on every read and write
 type MemoryCommentsStorageLinked struct {
-	commentItems    map[int64]*CommentModelOutput
-	commentsStorage map[string][]int64
+	commentItems    *MemoryCache // comment id -> *CommentModelOutput
+	commentsStorage *MemoryCache // uri -> []int64
+	commentsCounts  *MemoryCache // uri -> int
 	slowBackend     CommentsStorageInterface
+	invalidator     CacheInvalidatorInterface // notifies other replicas, may be nil
+	origin          string                    // id of replica in invalidation events
+	site            string
 }
 
-func NewMemoryStorageLinked(slowBackend CommentsStorageInterface) (*MemoryCommentsStorageLinked, error) {
+func NewMemoryStorageLinked(slowBackend CommentsStorageInterface, config CacheConfig) (*MemoryCommentsStorageLinked, error) {
+	return NewSiteMemoryStorage(DEFAULT_SITE, slowBackend, config)
+}
+
+func NewSiteMemoryStorage(site string, slowBackend CommentsStorageInterface, config CacheConfig) (*MemoryCommentsStorageLinked, error) {
+	if slowBackend == nil && config != (CacheConfig{}) {
+		// memory is the only storage, so nothing may be evicted
+		log.Printf("Memory cache limits are ignored without slowBackend")
+		config = CacheConfig{}
+	}
 	return &MemoryCommentsStorageLinked{
-		commentItems:    make(map[int64]*CommentModelOutput),
-		commentsStorage: make(map[string][]int64),
+		commentItems:    NewSiteMemoryCache(site, "comments", config.MaxComments, config.Ttl),
+		commentsStorage: NewSiteMemoryCache(site, "pages", config.MaxPages, config.Ttl),
+		commentsCounts:  NewSiteMemoryCache(site, "counts", config.MaxPages, config.Ttl),
 		slowBackend:     slowBackend,
+		site:            site,
 	}, nil
 }
 
+// LinkInvalidator makes caches of replicas convergent, must be called before usage
+func (storage *MemoryCommentsStorageLinked) LinkInvalidator(invalidator CacheInvalidatorInterface) {
+	storage.origin = GenerateSessionKey()[:HASH_LEN]
+	storage.invalidator = invalidator
+	invalidator.Subscribe(storage.handleInvalidation, storage.reset)
+}
+
+func (storage *MemoryCommentsStorageLinked) publish(event InvalidationEvent) {
+	if storage.invalidator == nil {
+		return
+	}
+	event.Origin = storage.origin
+	event.Sent = float64(time.Now().UnixMilli()) / 1000
+	metricInvalidations.WithLabelValues("comments", storage.site, "local").Add(float64(len(event.Comments)))
+	metricInvalidations.WithLabelValues("pages", storage.site, "local").Add(float64(len(event.Pages)))
+	metricInvalidations.WithLabelValues("counts", storage.site, "local").Add(float64(len(event.Counts)))
+	err := storage.invalidator.Publish(&event)
+	if err != nil {
+		// NB: other replicas will see changes only after reset or ttl
+		log.Printf("Unable to publish invalidation event: %v\n", err.Error())
+	}
+}
+
+func (storage *MemoryCommentsStorageLinked) handleInvalidation(event *InvalidationEvent) {
+	if event.Origin == storage.origin {
+		return
+	}
+	observeInvalidationDelay(event)
+	for _, commentId := range event.Comments {
+		storage.commentItems.Delete(getCommentCacheKey(commentId))
+	}
+	for _, uri := range event.Pages {
+		storage.commentsStorage.Delete(uri)
+	}
+	for _, uri := range event.Counts {
+		storage.commentsCounts.Delete(uri)
+	}
+	metricInvalidations.WithLabelValues("comments", storage.site, "remote").Add(float64(len(event.Comments)))
+	metricInvalidations.WithLabelValues("pages", storage.site, "remote").Add(float64(len(event.Pages)))
+	metricInvalidations.WithLabelValues("counts", storage.site, "remote").Add(float64(len(event.Counts)))
+}
+
+func (storage *MemoryCommentsStorageLinked) reset() {
+	metricInvalidationResets.WithLabelValues(storage.site).Inc()
+	storage.commentItems.Clear()
+	storage.commentsStorage.Clear()
+	storage.commentsCounts.Clear()
+}
+
+func getCommentCacheKey(commentId int64) string {
+	return strconv.FormatInt(commentId, 10)
+}
+
+func copyComment(commentData *CommentModelOutput) *CommentModelOutput {
+	res := *commentData
+	res.Voters = append(VoterFilter(nil), commentData.Voters...)
+	return &res
+}
+
 func (storage *MemoryCommentsStorageLinked) GetPageComments(uri string) ([]int64, error) {
-	value, exists := storage.commentsStorage[uri]
+	value, exists := storage.commentsStorage.Get(uri)
 	if exists {
-		return value, nil
+		return value.([]int64), nil
 	}
 	if storage.slowBackend == nil {
 		return nil, fmt.Errorf("uri %v not found, but slowBackend is not available", uri)
 	}
-	value, error := storage.slowBackend.GetPageComments(uri)
+	generation := storage.commentsStorage.GetGeneration(uri)
+	pageComments, error := storage.slowBackend.GetPageComments(uri)
 	if error != nil {
-		return value, error
+		return pageComments, error
 	}
-	storage.commentsStorage[uri] = value
-	return value, nil
+	storage.commentsStorage.SetIfUnchanged(uri, pageComments, generation)
+	return pageComments, nil
 }
 
 func (storage *MemoryCommentsStorageLinked) AddCommentToPage(uri string, commentId int64) error {
@@ -40,16 +123,36 @@ func (storage *MemoryCommentsStorageLinked) AddCommentToPage(uri string, comment
 		}
 	}
 
-	_, exists := storage.commentsStorage[uri]
-	if !exists {
-		storage.commentsStorage[uri] = make([]int64, 0)
+	storage.commentsCounts.Delete(uri)
+	isCached := true
+	storage.commentsStorage.Modify(uri, func(value interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			if storage.slowBackend != nil {
+				// other comments of page are known only by slowBackend
+				isCached = false
+				return nil, false
+			}
+			return []int64{commentId}, true
+		}
+		// new slice, because old one may be still used by readers
+		pageComments := value.([]int64)
+		updated := make([]int64, len(pageComments), len(pageComments)+1)
+		copy(updated, pageComments)
+		return append(updated, commentId), true
+	})
+	if !isCached {
+		// NB: Delete drops page loaded before the change by concurrent GetPageComments
+		storage.commentsStorage.Delete(uri)
 	}
-	storage.commentsStorage[uri] = append(storage.commentsStorage[uri], commentId)
+	storage.publish(InvalidationEvent{Pages: []string{uri}, Counts: []string{uri}})
 	return nil
 }
 
 func (storage *MemoryCommentsStorageLinked) putComment(commentData *CommentModelOutput) error {
-	storage.commentItems[commentData.Id] = commentData
+	// mode of comment may be changed
+	storage.commentsCounts.Delete(commentData.Uri)
+	storage.commentItems.Set(getCommentCacheKey(commentData.Id), copyComment(commentData))
+	storage.publish(InvalidationEvent{Comments: []int64{commentData.Id}, Counts: []string{commentData.Uri}})
 	return nil
 }
 
@@ -71,6 +174,8 @@ func (storage *MemoryCommentsStorageLinked) UpdateComment(commentData *CommentMo
 	if storage.slowBackend != nil {
 		err := storage.slowBackend.UpdateComment(commentData)
 		if err != nil {
+			// state of slowBackend is unknown, so it will be reloaded on next request
+			storage.commentItems.Delete(getCommentCacheKey(commentData.Id))
 			return err
 		}
 	}
@@ -79,17 +184,133 @@ func (storage *MemoryCommentsStorageLinked) UpdateComment(commentData *CommentMo
 }
 
 func (storage *MemoryCommentsStorageLinked) GetComment(commentId int64) (*CommentModelOutput, error) {
-	value, exists := storage.commentItems[commentId]
+	key := getCommentCacheKey(commentId)
+	value, exists := storage.commentItems.Get(key)
 	if exists {
-		return value, nil
+		return copyComment(value.(*CommentModelOutput)), nil
 	}
 	if storage.slowBackend == nil {
 		return nil, fmt.Errorf("comment %v not found, but slowBackend is not available", commentId)
 	}
-	value, error := storage.slowBackend.GetComment(commentId)
+	generation := storage.commentItems.GetGeneration(key)
+	commentData, error := storage.slowBackend.GetComment(commentId)
 	if error != nil {
-		return value, error
+		return commentData, error
+	}
+	storage.commentItems.SetIfUnchanged(key, copyComment(commentData), generation)
+	return commentData, nil
+}
+
+func (storage *MemoryCommentsStorageLinked) RemoveCommentFromPage(uri string, commentId int64) error {
+	if storage.slowBackend != nil {
+		err := storage.slowBackend.RemoveCommentFromPage(uri, commentId)
+		if err != nil {
+			// state of slowBackend is unknown, so it will be reloaded on next request
+			storage.commentsStorage.Delete(uri)
+			storage.commentsCounts.Delete(uri)
+			return err
+		}
+	}
+	storage.commentsCounts.Delete(uri)
+	isCached := true
+	storage.commentsStorage.Modify(uri, func(value interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			isCached = false
+			return nil, false
+		}
+		// new slice, because old one may be still used by readers
+		pageComments := value.([]int64)
+		filtered := make([]int64, 0, len(pageComments))
+		for _, pageCommentId := range pageComments {
+			if pageCommentId != commentId {
+				filtered = append(filtered, pageCommentId)
+			}
+		}
+		return filtered, true
+	})
+	if !isCached {
+		storage.commentsStorage.Delete(uri)
+	}
+	storage.publish(InvalidationEvent{Pages: []string{uri}, Counts: []string{uri}})
+	return nil
+}
+
+func (storage *MemoryCommentsStorageLinked) DeleteComment(commentId int64) error {
+	storage.commentItems.Delete(getCommentCacheKey(commentId))
+	if storage.slowBackend != nil {
+		err := storage.slowBackend.DeleteComment(commentId)
+		storage.publish(InvalidationEvent{Comments: []int64{commentId}})
+		return err
+	}
+	return nil
+}
+
+func (storage *MemoryCommentsStorageLinked) ListComments() ([]int64, error) {
+	if storage.slowBackend != nil {
+		return storage.slowBackend.ListComments()
+	}
+	res := make([]int64, 0)
+	for _, key := range storage.commentItems.Keys() {
+		commentId, _ := strconv.ParseInt(key, 10, 64)
+		res = append(res, commentId)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
+
+func (storage *MemoryCommentsStorageLinked) ListCommentsIndex() ([]CommentIndexEntry, error) {
+	if storage.slowBackend != nil {
+		return storage.slowBackend.ListCommentsIndex()
+	}
+	res := make([]CommentIndexEntry, 0)
+	for _, key := range storage.commentItems.Keys() {
+		value, exists := storage.commentItems.Get(key)
+		if !exists {
+			continue
+		}
+		comment := value.(*CommentModelOutput)
+		res = append(res, CommentIndexEntry{Id: comment.Id, Page: comment.Uri, Mode: comment.Mode})
+	}
+	sortIndexEntries(res)
+	return res, nil
+}
+
+func (storage *MemoryCommentsStorageLinked) countPageComments(uri string) (int, error) {
+	count, err := countPageComments(storage, uri)
+	if err != nil && storage.slowBackend == nil {
+		// unknown page in storage without slowBackend
+		return 0, nil
+	}
+	return count, err
+}
+
+func (storage *MemoryCommentsStorageLinked) GetCommentsCounts(uris []string) ([]int, error) {
+	res := make([]int, len(uris))
+	missedInds := make([]int, 0)
+	missedUris := make([]string, 0)
+	generations := make([]uint64, 0)
+	for ind, uri := range uris {
+		count, exists := storage.commentsCounts.Get(uri)
+		if exists {
+			res[ind] = count.(int)
+		} else {
+			missedInds = append(missedInds, ind)
+			missedUris = append(missedUris, uri)
+			generations = append(generations, storage.commentsCounts.GetGeneration(uri))
+		}
+	}
+	if len(missedUris) == 0 {
+		return res, nil
+	}
+
+	// NB: counted through cache of comments, so slowBackend is requested only for missed ones
+	missedCounts, err := countPages(missedUris, storage.countPageComments)
+	if err != nil {
+		return nil, err
+	}
+	for ind, uri := range missedUris {
+		storage.commentsCounts.SetIfUnchanged(uri, missedCounts[ind], generations[ind])
+		res[missedInds[ind]] = missedCounts[ind]
 	}
-	storage.commentItems[commentId] = value
-	return value, nil
+	return res, nil
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStorageWithSlowBackend(t *testing.T) {
+	slowBackend, _ := NewMemoryStorageLinked(nil, CacheConfig{})
+	storage, _ := NewMemoryStorageLinked(slowBackend, CacheConfig{MaxComments: 1, MaxPages: 1, Ttl: time.Minute})
+	uri := "example.com/cached"
+
+	// page is known by slowBackend only, it must not be cached partially
+	assert.Nil(t, slowBackend.AddCommentToPage(uri, 1))
+	assert.Nil(t, storage.AddCommentToPage(uri, 2))
+	pageComments, err := storage.GetPageComments(uri)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 2}, pageComments)
+
+	// evicted comments are loaded again from slowBackend
+	for commentId := int64(1); commentId <= 40; commentId++ {
+		_, err := storage.AddComment(&CommentModelOutput{Id: commentId, Mode: MODE_PUBLIC, Uri: uri})
+		assert.Nil(t, err)
+	}
+	assert.LessOrEqual(t, storage.commentItems.Len(), CACHE_SHARDS)
+	comment, err := storage.GetComment(1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), comment.Id)
+
+	// returned comments are copies
+	comment.Likes = 100
+	comment, _ = storage.GetComment(1)
+	assert.Equal(t, 0, comment.Likes)
+}
+
+// pausedPagesBackend stops GetPageComments after load until resume is closed
+type pausedPagesBackend struct {
+	CommentsStorageInterface
+	loaded chan struct{}
+	resume chan struct{}
+}
+
+func (backend *pausedPagesBackend) GetPageComments(uri string) ([]int64, error) {
+	pageComments, err := backend.CommentsStorageInterface.GetPageComments(uri)
+	close(backend.loaded)
+	<-backend.resume
+	return pageComments, err
+}
+
+func TestMemoryStorageSkipsStalePage(t *testing.T) {
+	memoryBackend, _ := NewMemoryStorageLinked(nil, CacheConfig{})
+	uri := "example.com/thread"
+	assert.Nil(t, memoryBackend.AddCommentToPage(uri, 1))
+
+	for _, change := range []func(storage *MemoryCommentsStorageLinked) error{
+		func(storage *MemoryCommentsStorageLinked) error { return storage.AddCommentToPage(uri, 2) },
+		func(storage *MemoryCommentsStorageLinked) error { return storage.RemoveCommentFromPage(uri, 2) },
+	} {
+		slowBackend := &pausedPagesBackend{memoryBackend, make(chan struct{}), make(chan struct{})}
+		storage, _ := NewMemoryStorageLinked(slowBackend, CacheConfig{})
+		expected, _ := memoryBackend.GetPageComments(uri)
+		loaded := make(chan []int64)
+		go func() {
+			pageComments, _ := storage.GetPageComments(uri)
+			loaded <- pageComments
+		}()
+
+		// page is changed while old list is loaded, so loaded list must not be cached
+		<-slowBackend.loaded
+		assert.Nil(t, change(storage))
+		close(slowBackend.resume)
+		assert.Equal(t, expected, <-loaded)
+		slowBackend.loaded, slowBackend.resume = make(chan struct{}), make(chan struct{})
+		close(slowBackend.resume)
+		actual, _ := memoryBackend.GetPageComments(uri)
+		pageComments, err := storage.GetPageComments(uri)
+		assert.Nil(t, err)
+		assert.Equal(t, actual, pageComments)
+		assert.NotEqual(t, expected, pageComments)
+	}
+}
+
+func TestMemoryStorageCountsThroughCache(t *testing.T) {
+	slowBackend, _ := NewMemoryStorageLinked(nil, CacheConfig{})
+	storage, _ := NewMemoryStorageLinked(slowBackend, CacheConfig{})
+	uri := "example.com/counted"
+	for commentId := int64(1); commentId <= 3; commentId++ {
+		storage.AddComment(&CommentModelOutput{Id: commentId, Mode: MODE_PUBLIC, Uri: uri})
+		assert.Nil(t, storage.AddCommentToPage(uri, commentId))
+	}
+
+	// cached comments are not requested from slowBackend, so change behind cache is not visible
+	slowBackend.UpdateComment(&CommentModelOutput{Id: 3, Mode: MODE_DELETED, Uri: uri})
+	counts, err := storage.GetCommentsCounts([]string{uri})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{3}, counts)
+}
+
+func TestMemoryStorageConcurrent(t *testing.T) {
+	storage, _ := NewMemoryStorageLinked(nil, CacheConfig{})
+	uri := "example.com/concurrent"
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for ind := 0; ind < 100; ind++ {
+				commentId := int64(worker*100 + ind)
+				storage.AddComment(&CommentModelOutput{Id: commentId, Mode: MODE_PUBLIC, Uri: uri})
+				storage.AddCommentToPage(uri, commentId)
+				storage.GetPageComments(uri)
+				storage.GetCommentsCounts([]string{uri})
+			}
+		}(worker)
+	}
+	wg.Wait()
+	pageComments, _ := storage.GetPageComments(uri)
+	assert.Equal(t, 800, len(pageComments))
+	counts, _ := storage.GetCommentsCounts([]string{uri})
+	assert.Equal(t, []int{800}, counts)
+}
+
+// testInvalidationBus delivers events synchronously to all subscribers
+type testInvalidationBus struct {
+	handlers []func(event *InvalidationEvent)
+}
+
+func (bus *testInvalidationBus) Publish(event *InvalidationEvent) error {
+	for _, handler := range bus.handlers {
+		handler(event)
+	}
+	return nil
+}
+
+func (bus *testInvalidationBus) Subscribe(handler func(event *InvalidationEvent), reset func()) {
+	bus.handlers = append(bus.handlers, handler)
+	reset()
+}
+
+func (bus *testInvalidationBus) Close() error {
+	return nil
+}
+
+func TestMemoryStorageInvalidation(t *testing.T) {
+	slowBackend, _ := NewMemoryStorageLinked(nil, CacheConfig{})
+	bus := &testInvalidationBus{}
+	first, _ := NewMemoryStorageLinked(slowBackend, CacheConfig{})
+	second, _ := NewMemoryStorageLinked(slowBackend, CacheConfig{})
+	first.LinkInvalidator(bus)
+	second.LinkInvalidator(bus)
+	uri := "example.com/replicas"
+
+	first.AddComment(&CommentModelOutput{Id: 1, Mode: MODE_PUBLIC, Uri: uri, Text: "first"})
+	assert.Nil(t, first.AddCommentToPage(uri, 1))
+	counts, _ := second.GetCommentsCounts([]string{uri})
+	assert.Equal(t, []int{1}, counts)
+	comment, _ := second.GetComment(1)
+	assert.Equal(t, "first", comment.Text)
+
+	// replica sees changes of other one without own requests to slowBackend
+	first.AddComment(&CommentModelOutput{Id: 2, Mode: MODE_PUBLIC, Uri: uri})
+	assert.Nil(t, first.AddCommentToPage(uri, 2))
+	comment.Text = "second"
+	assert.Nil(t, first.UpdateComment(comment))
+	pageComments, _ := second.GetPageComments(uri)
+	assert.Equal(t, []int64{1, 2}, pageComments)
+	counts, _ = second.GetCommentsCounts([]string{uri})
+	assert.Equal(t, []int{2}, counts)
+	comment, _ = second.GetComment(1)
+	assert.Equal(t, "second", comment.Text)
+
+	// own events are ignored
+	first.GetPageComments(uri)
+	assert.Nil(t, first.AddCommentToPage(uri, 3))
+	assert.Equal(t, 1, first.commentsStorage.Len())
+	assert.Equal(t, 0, second.commentsStorage.Len())
+}
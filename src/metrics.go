@@ -2,11 +2,15 @@ package main
 
 import "github.com/penglongli/gin-metrics/ginmetrics"
 
+const METRICS_PATH = "/metrics"
+
+var REQUEST_DURATION_BUCKETS = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10}
+
 func GetPrometheusHandler() *ginmetrics.Monitor {
 	m := ginmetrics.GetMonitor()
 
-	m.SetMetricPath("/metrics")
+	m.SetMetricPath(METRICS_PATH)
 	m.SetSlowTime(2)
-	m.SetDuration([]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10})
+	m.SetDuration(REQUEST_DURATION_BUCKETS)
 	return m
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// moderation actions, used in API paths and signed links
+const (
+	MODERATION_APPROVE = "approve"
+	MODERATION_REJECT  = "reject"
+)
+
+var ErrCommentNotPending = errors.New("comment is not pending moderation")
+
+// button and result of actions on pages of signed links
+var moderationActionLabels = map[string]struct{ Button, Done string }{
+	MODERATION_APPROVE: {"Approve", "approved"},
+	MODERATION_REJECT:  {"Reject", "rejected"},
+}
+
+// ModerationStorageInterface keeps ids of pending comments, so owner can find them without full scan
+type ModerationStorageInterface interface {
+	AddPendingComment(commentId int64, uri string) error
+	RemovePendingComment(commentId int64) error
+	ListPendingComments() ([]int64, error)
+}
+
+// MemoryModerationStorage is used without S3
+type MemoryModerationStorage struct {
+	mutex   sync.Mutex
+	pending map[int64]string
+}
+
+func NewMemoryModerationStorage() *MemoryModerationStorage {
+	return &MemoryModerationStorage{
+		pending: make(map[int64]string),
+	}
+}
+
+func (storage *MemoryModerationStorage) AddPendingComment(commentId int64, uri string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.pending[commentId] = uri
+	return nil
+}
+
+func (storage *MemoryModerationStorage) RemovePendingComment(commentId int64) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	delete(storage.pending, commentId)
+	return nil
+}
+
+func (storage *MemoryModerationStorage) ListPendingComments() ([]int64, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	res := make([]int64, 0, len(storage.pending))
+	for commentId := range storage.pending {
+		res = append(res, commentId)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
+
+// ModerationSigner creates and checks one-click moderation links of site owner
+type ModerationSigner struct {
+	key       string // empty key disables moderation by owner
+	publicUrl string
+}
+
+func NewModerationSigner(config ApplicationConfig) *ModerationSigner {
+	return &ModerationSigner{
+		key:       config.ModerationKey,
+		publicUrl: strings.TrimSuffix(config.Server.PublicUrl, "/"),
+	}
+}
+
+func (signer *ModerationSigner) Sign(commentId int64, action string) string {
+	mac := hmac.New(sha256.New, []byte(signer.key))
+	fmt.Fprintf(mac, "%v:%v", action, commentId)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (signer *ModerationSigner) Verify(commentId int64, action string, token string) bool {
+	if signer.key == "" {
+		return false
+	}
+	return hmac.Equal([]byte(signer.Sign(commentId, action)), []byte(token))
+}
+
+// Link returns url of moderation page, relative to root of site without public url
+func (signer *ModerationSigner) Link(commentId int64, action string) string {
+	return fmt.Sprintf("%v/moderation/%v/%v/%v", signer.publicUrl, commentId, action, signer.Sign(commentId, action))
+}
+
+// IsModerator checks owner key in Authorization header
+func (signer *ModerationSigner) IsModerator(c *gin.Context) bool {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return signer.key != "" && hmac.Equal([]byte(token), []byte(signer.key))
+}
+
+// PendingCommentModel is item of GET /moderation, internal fields of comment are needed by owner
+type PendingCommentModel struct {
+	Comment    *CommentModelOutput `json:"comment"`
+	Uri        string              `json:"uri"`
+	ApproveUrl string              `json:"approve_url"`
+	RejectUrl  string              `json:"reject_url"`
+}
+
+func moderateComment(commentsBackend CommentsLogicInterface, commentId int64, action string) (*CommentModelOutput, error) {
+	if action == MODERATION_APPROVE {
+		return commentsBackend.ApproveComment(commentId)
+	}
+	return commentsBackend.RejectComment(commentId)
+}
+
+// NB: links may be opened by mail scanners, so GET only shows the form and POST changes comment
+var moderationPageTemplate = template.Must(template.New("moderation").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>{{if .Title}}{{.Title}}{{else}}Moderation{{end}}</title>
+</head>
+<body>
+<p>{{.Message}}</p>
+{{if .Comment}}<p>{{.Uri}}, {{.Author}}:</p>
+<blockquote>{{.Comment}}</blockquote>{{end}}
+{{if .Action}}<form method="post"><button type="submit">{{.Action}}</button></form>{{end}}
+</body>
+</html>
+`))
+
+type moderationPage struct {
+	Title   string // Moderation if empty
+	Message string
+	Uri     string
+	Author  string
+	Comment template.HTML // sanitized html of comment
+	Action  string        // button of form, empty if nothing to do
+}
+
+func renderModerationPage(c *gin.Context, status int, page moderationPage) {
+	var buffer bytes.Buffer
+	if err := moderationPageTemplate.Execute(&buffer, page); err != nil {
+		log.Printf("Unable to render moderation page: %v\n", err.Error())
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(status, "text/html; charset=utf-8", buffer.Bytes())
+}
+
+// parseModerationAction writes error for unknown action
+func parseModerationAction(c *gin.Context) (string, bool) {
+	action := c.Param("action")
+	if _, exists := moderationActionLabels[action]; !exists {
+		c.PureJSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("Unknown action: %v", action),
+		})
+		return "", false
+	}
+	return action, true
+}
+
+// addModerationRoutes adds API of site owner and pages of signed links
+func addModerationRoutes(r *gin.Engine, signer *ModerationSigner, commentsBackend CommentsLogicInterface) {
+	r.GET("/moderation", func(c *gin.Context) {
+		if !signer.IsModerator(c) {
+			c.PureJSON(http.StatusForbidden, gin.H{
+				"error": "Not authorized to moderate comments",
+			})
+			return
+		}
+		comments, err := commentsBackend.GetPendingComments()
+		if err != nil {
+			c.PureJSON(http.StatusInternalServerError, gin.H{
+				"error": "Unable to load pending comments",
+			})
+			return
+		}
+		res := make([]PendingCommentModel, 0, len(comments))
+		for _, comment := range comments {
+			res = append(res, PendingCommentModel{
+				Comment:    comment,
+				Uri:        comment.Uri,
+				ApproveUrl: signer.Link(comment.Id, MODERATION_APPROVE),
+				RejectUrl:  signer.Link(comment.Id, MODERATION_REJECT),
+			})
+		}
+		c.PureJSON(200, res)
+	})
+	r.POST("/moderation/:commentId/:action", func(c *gin.Context) {
+		commentId, isValid := parseCommentId(c)
+		if !isValid {
+			return
+		}
+		action, isValid := parseModerationAction(c)
+		if !isValid {
+			return
+		}
+		if !signer.IsModerator(c) {
+			c.PureJSON(http.StatusForbidden, gin.H{
+				"error": "Not authorized to moderate comments",
+			})
+			return
+		}
+		comment, err := moderateComment(commentsBackend, commentId, action)
+		if err != nil {
+			c.PureJSON(getModificationErrorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// null for rejected comment, which is removed completely
+		c.PureJSON(200, comment)
+	})
+
+	signedLinkHandler := func(c *gin.Context) {
+		commentId, isValid := parseCommentId(c)
+		if !isValid {
+			return
+		}
+		action, isValid := parseModerationAction(c)
+		if !isValid {
+			return
+		}
+		if !signer.Verify(commentId, action, c.Param("token")) {
+			renderModerationPage(c, http.StatusForbidden, moderationPage{Message: "Invalid moderation link"})
+			return
+		}
+		comment, err := commentsBackend.GetComment(commentId, false)
+		if err != nil {
+			renderModerationPage(c, http.StatusNotFound, moderationPage{Message: "Comment not found"})
+			return
+		}
+		if comment.Mode != MODE_PENDING {
+			renderModerationPage(c, http.StatusConflict, moderationPage{Message: "Comment is already moderated"})
+			return
+		}
+		page := moderationPage{
+			Uri:     comment.Uri,
+			Author:  "Anonymous",
+			Comment: template.HTML(comment.Text),
+		}
+		if comment.Author != nil {
+			page.Author = *comment.Author
+		}
+		if c.Request.Method == http.MethodGet {
+			page.Message = fmt.Sprintf("Comment %v is pending moderation", commentId)
+			page.Action = moderationActionLabels[action].Button
+			renderModerationPage(c, 200, page)
+			return
+		}
+		if _, err := moderateComment(commentsBackend, commentId, action); err != nil {
+			renderModerationPage(c, getModificationErrorStatus(err), moderationPage{Message: err.Error()})
+			return
+		}
+		page.Message = fmt.Sprintf("Comment %v is %v", commentId, moderationActionLabels[action].Done)
+		renderModerationPage(c, 200, page)
+	}
+	r.GET("/moderation/:commentId/:action/:token", signedLinkHandler)
+	r.POST("/moderation/:commentId/:action/:token", signedLinkHandler)
+}
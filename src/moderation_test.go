@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const TEST_MODERATION_KEY = "moderation-key-for-tests-only-0000"
+
+func getModerationConfig() ApplicationConfig {
+	config := ApplicationConfig{
+		Server:        ServerConfig{PublicUrl: "https://comments.example.com/"},
+		Policy:        DefaultPolicyConfig(),
+		SessionKey:    GenerateSessionKey(),
+		ModerationKey: TEST_MODERATION_KEY,
+	}
+	config.Policy.Moderation = true
+	return config
+}
+
+func TestModerationLogic(t *testing.T) {
+	logic := GetCommentsLogic(getModerationConfig())
+	uri := "example.com/moderation"
+	inputComment := getFakeInputComment()
+	pending, err := logic.AddComment(uri, &inputComment, ClientInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, MODE_PENDING, pending.Mode)
+
+	author := ClientInfo{
+		IsAuthorOf:  func(commentId int64) bool { return commentId == pending.Id },
+		AuthoredIds: func() []int64 { return []int64{pending.Id} },
+	}
+	assert.Equal(t, 0, logic.GetComments(uri, DefaultCommentsQuery(), ClientInfo{}).TotalReplies)
+	assert.Equal(t, 1, logic.GetComments(uri, DefaultCommentsQuery(), author).TotalReplies)
+	counts, err := logic.CountComments([]string{uri, "example.com/other"}, ClientInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 0}, counts)
+	counts, err = logic.CountComments([]string{uri, "example.com/other"}, author)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 0}, counts)
+
+	reply := getFakeInputComment()
+	reply.Parent = &pending.Id
+	_, err = logic.AddComment(uri, &reply, ClientInfo{})
+	assert.NotNil(t, err)
+
+	pendingComments, err := logic.GetPendingComments()
+	assert.Nil(t, err)
+	assert.Len(t, pendingComments, 1)
+
+	approved, err := logic.ApproveComment(pending.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, MODE_PUBLIC, approved.Mode)
+	_, err = logic.ApproveComment(pending.Id)
+	assert.ErrorIs(t, err, ErrCommentNotPending)
+	counts, err = logic.CountComments([]string{uri}, ClientInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, counts)
+	pendingComments, err = logic.GetPendingComments()
+	assert.Nil(t, err)
+	assert.Len(t, pendingComments, 0)
+
+	rejected, err := logic.AddComment(uri, &inputComment, ClientInfo{})
+	assert.Nil(t, err)
+	removed, err := logic.RejectComment(rejected.Id)
+	assert.Nil(t, err)
+	assert.Nil(t, removed)
+	_, err = logic.RejectComment(rejected.Id)
+	assert.ErrorIs(t, err, ErrCommentNotFound)
+	assert.Equal(t, 1, logic.GetComments(uri, DefaultCommentsQuery(), author).TotalReplies)
+}
+
+func TestModerationSigner(t *testing.T) {
+	signer := NewModerationSigner(getModerationConfig())
+	token := signer.Sign(1, MODERATION_APPROVE)
+	assert.True(t, signer.Verify(1, MODERATION_APPROVE, token))
+	assert.False(t, signer.Verify(2, MODERATION_APPROVE, token))
+	assert.False(t, signer.Verify(1, MODERATION_REJECT, token))
+	assert.Equal(t, "https://comments.example.com/moderation/1/approve/"+token, signer.Link(1, MODERATION_APPROVE))
+
+	// without key nothing is signed
+	disabled := NewModerationSigner(ApplicationConfig{})
+	assert.False(t, disabled.Verify(1, MODERATION_APPROVE, disabled.Sign(1, MODERATION_APPROVE)))
+}
+
+func getPendingComments(t *testing.T, app *gin.Engine) []PendingCommentModel {
+	w := serveRequest(app, "GET", "/moderation", "", withBearer(TEST_MODERATION_KEY))
+	assert.Equal(t, 200, w.Code)
+	var res []PendingCommentModel
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+	return res
+}
+
+func testModerationScenario(t *testing.T, app *gin.Engine, uri string) {
+	inputComment := getFakeInputComment()
+	w := postCommentRecorder(t, app, &inputComment, uri)
+	assert.Equal(t, 201, w.Code)
+	var created CommentModelOutput
+	json.Unmarshal(w.Body.Bytes(), &created)
+	assert.Equal(t, MODE_PENDING, created.Mode)
+	cookies := w.Result().Cookies()
+
+	t.Run("TestPendingHidden", func(t *testing.T) {
+		assert.Equal(t, 0, getCommentsForPage(t, app, uri))
+		assert.Equal(t, []int{0}, countComments(t, app, []string{uri}))
+		code, _ := viewComment(t, app, created.Id, false)
+		assert.Equal(t, 404, code)
+		// votes don't reveal existence of pending comment
+		code, body := voteComment(t, app, created.Id, "like", "198.51.100.1:1234")
+		missingCode, missingBody := voteComment(t, app, created.Id+1000, "like", "198.51.100.1:1234")
+		assert.Equal(t, missingCode, code)
+		assert.Equal(t, strings.Replace(missingBody["error"].(string), fmt.Sprint(created.Id+1000), fmt.Sprint(created.Id), 1), body["error"])
+
+		// author sees own comment
+		for _, path := range []string{"/?uri=" + uri, fmt.Sprintf("/id/%v", created.Id)} {
+			w := serveRequest(app, "GET", path, "", withCookies(cookies))
+			assert.Equal(t, 200, w.Code)
+			assert.Contains(t, w.Body.String(), fmt.Sprintf(`"id":%v`, created.Id))
+		}
+		w := serveRequest(app, "POST", "/count", `["`+uri+`"]`, withCookies(cookies))
+		assert.Equal(t, "[1]", strings.TrimSpace(w.Body.String()))
+	})
+
+	t.Run("TestModerationApi", func(t *testing.T) {
+		assert.Equal(t, 403, serveRequest(app, "GET", "/moderation", "").Code)
+		path := fmt.Sprintf("/moderation/%v/approve", created.Id)
+		assert.Equal(t, 403, serveRequest(app, "POST", path, "").Code)
+		assert.Equal(t, 404, serveRequest(app, "POST", fmt.Sprintf("/moderation/%v/publish", created.Id), "", withBearer(TEST_MODERATION_KEY)).Code)
+
+		pending := getPendingComments(t, app)
+		assert.Len(t, pending, 1)
+		assert.Equal(t, created.Id, pending[0].Comment.Id)
+		assert.Equal(t, uri, pending[0].Uri)
+
+		other := postComment(t, app, &inputComment, uri)
+		w := serveRequest(app, "POST", fmt.Sprintf("/moderation/%v/reject", other.Id), "", withBearer(TEST_MODERATION_KEY))
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "null", strings.TrimSpace(w.Body.String()))
+		assert.Len(t, getPendingComments(t, app), 1)
+	})
+
+	t.Run("TestModerationLinks", func(t *testing.T) {
+		pending := getPendingComments(t, app)
+		assert.Len(t, pending, 1)
+		approveUrl := strings.TrimPrefix(pending[0].ApproveUrl, "https://comments.example.com")
+		invalidUrl := strings.TrimPrefix(pending[0].RejectUrl, "https://comments.example.com")
+		invalidUrl = strings.Replace(invalidUrl, "/reject/", "/approve/", 1)
+
+		assert.Equal(t, 403, serveRequest(app, "GET", invalidUrl, "").Code)
+		// GET shows form only, so link scanners don't approve comments
+		w := serveRequest(app, "GET", approveUrl, "")
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), "<form method=\"post\">")
+		assert.Equal(t, 0, getCommentsForPage(t, app, uri))
+
+		w = serveRequest(app, "POST", approveUrl, "")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, 1, getCommentsForPage(t, app, uri))
+		assert.Equal(t, []int{1}, countComments(t, app, []string{uri}))
+		assert.Len(t, getPendingComments(t, app), 0)
+
+		assert.Equal(t, 409, serveRequest(app, "POST", approveUrl, "").Code)
+		assert.Equal(t, 409, serveRequest(app, "POST", fmt.Sprintf("/moderation/%v/approve", created.Id), "", withBearer(TEST_MODERATION_KEY)).Code)
+	})
+}
+
+func TestModerationWithMemoryStorage(t *testing.T) {
+	testModerationScenario(t, GetGinApp(getModerationConfig()), "example.com/memory-moderation")
+}
+
+func TestModerationConfig(t *testing.T) {
+	configPath := writeTestFile(t, "config.yaml", `
+sites:
+  - name: blog
+    hosts: [blog.example.com]
+    key_prefix: blog/
+    policy:
+      moderation: true
+  - name: docs
+    public_url: docs.example.com
+    policy:
+      moderation: true
+    moderation_key: short
+`)
+	_, err := LoadConfig(getTestEnv(map[string]string{CONFIG_FILE_ENV: configPath}))
+	configErr, isConfigErr := err.(*ConfigError)
+	assert.True(t, isConfigErr)
+	assert.Len(t, configErr.Problems, 3)
+	for _, problem := range []string{"sites[0]: moderation_key is required", "sites[1].public_url", "sites[1].moderation_key"} {
+		assert.Contains(t, err.Error(), problem)
+	}
+
+	// key of site is taken from global settings
+	config, err := LoadConfig(getTestEnv(map[string]string{
+		"MODERATION_KEY":    TEST_MODERATION_KEY,
+		"POLICY_MODERATION": "true",
+	}))
+	assert.Nil(t, err)
+	assert.True(t, config.Policy.Moderation)
+	assert.NotContains(t, DumpConfig(config), TEST_MODERATION_KEY)
+}
+
+func TestModerationWithIntegrations(t *testing.T) {
+	if _, exists := os.LookupEnv("TESTS_ENABLE_INTEGRATIONS"); !exists {
+		t.Skipf("TESTS_ENABLE_INTEGRATIONS disabled")
+	}
+	config := ReadConfig()
+	config.Minio.Bucket = "test-moderation"
+	config.Redis = nil
+	config.Policy.Moderation = true
+	config.ModerationKey = TEST_MODERATION_KEY
+	app := GetGinApp(config)
+	defer postDeleteS3Bucket(t, *config.Minio)
+
+	inputComment := getFakeInputComment()
+	created := postComment(t, app, &inputComment, "example.com/s3-moderation")
+
+	// pending comments survive restart
+	restarted := GetCommentsLogic(config)
+	pending, err := restarted.GetPendingComments()
+	assert.Nil(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, created.Id, pending[0].Id)
+	_, err = restarted.ApproveComment(created.Id)
+	assert.Nil(t, err)
+	assert.Len(t, getPendingComments(t, app), 0)
+
+	testModerationScenario(t, app, "example.com/s3-moderation-scenario")
+}
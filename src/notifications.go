@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// security of connection to SMTP server
+const (
+	SMTP_NONE     = "none"
+	SMTP_STARTTLS = "starttls"
+	SMTP_TLS      = "tls"
+)
+
+var smtpSecurityModes = map[string]bool{SMTP_NONE: true, SMTP_STARTTLS: true, SMTP_TLS: true}
+
+// kinds of notifications, also names of their template files
+const (
+	NOTIFY_NEW_COMMENT = "new_comment"
+	NOTIFY_REPLY       = "reply"
+)
+
+// action of signed unsubscribe links
+const NOTIFY_UNSUBSCRIBE = "unsubscribe"
+
+var (
+	metricNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications",
+		Help: "Number of email notifications by result: sent, retried, failed or dropped",
+	}, []string{"site", "status"})
+)
+
+// templates define subject and body, both are executed with NotifyData
+var defaultNotifyTemplates = map[string]string{
+	NOTIFY_NEW_COMMENT: `{{define "subject"}}New comment on {{.Uri}}{{end}}
+{{- define "body"}}{{.Comment.Author}} wrote on {{.Uri}}{{if .Parent}} in reply to {{.Parent.Author}}{{end}}:
+
+{{.Comment.Text}}
+
+{{if .Comment.Website}}Website: {{.Comment.Website}}
+{{end}}Link: {{.Uri}}#isso-{{.Comment.Id}}
+{{- if .Pending}}
+
+Comment is pending moderation.
+{{- if .ApproveUrl}}
+Approve: {{.ApproveUrl}}
+Reject: {{.RejectUrl}}
+{{- end}}
+{{- end}}
+{{end}}`,
+	NOTIFY_REPLY: `{{define "subject"}}Reply to your comment on {{.Uri}}{{end}}
+{{- define "body"}}{{.Comment.Author}} replied to your comment on {{.Uri}}:
+
+{{.Comment.Text}}
+
+Link: {{.Uri}}#isso-{{.Comment.Id}}
+
+Your comment:
+
+{{.Parent.Text}}
+
+Unsubscribe from replies: {{.UnsubscribeUrl}}
+{{end}}`,
+}
+
+// NotifyComment is comment in templates
+type NotifyComment struct {
+	Id      int64
+	Author  string // Anonymous if empty
+	Website string
+	Text    string // markdown source, or html of old comments
+}
+
+func newNotifyComment(comment *CommentModelOutput) *NotifyComment {
+	res := &NotifyComment{Id: comment.Id, Author: "Anonymous", Text: comment.TextSource}
+	if comment.Author != nil {
+		res.Author = *comment.Author
+	}
+	if comment.Website != nil {
+		res.Website = *comment.Website
+	}
+	if res.Text == "" {
+		res.Text = comment.Text
+	}
+	return res
+}
+
+// NotifyData is passed to templates
+type NotifyData struct {
+	Uri            string
+	Comment        *NotifyComment
+	Parent         *NotifyComment // nil for top level comments
+	Pending        bool
+	ApproveUrl     string // only for pending comments with moderation_key
+	RejectUrl      string
+	UnsubscribeUrl string // only for replies
+}
+
+// LoadNotifyTemplates reads <kind>.txt files from dir, missing files are replaced with defaults
+func LoadNotifyTemplates(dir string) (map[string]*template.Template, error) {
+	res := make(map[string]*template.Template)
+	for kind, source := range defaultNotifyTemplates {
+		if dir != "" {
+			data, err := os.ReadFile(filepath.Join(dir, kind+".txt"))
+			if err == nil {
+				source = string(data)
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		parsed, err := template.New(kind).Parse(source)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.Lookup("subject") == nil || parsed.Lookup("body") == nil {
+			return nil, fmt.Errorf("template %v must define subject and body", kind)
+		}
+		res[kind] = parsed
+	}
+	return res, nil
+}
+
+type EmailMessage struct {
+	To      []string
+	Subject string
+	Body    string
+	Headers map[string]string // additional ones, like List-Unsubscribe
+}
+
+// NB: values of headers come from templates and config, newlines would inject other headers
+var headerNewlines = strings.NewReplacer("\r", " ", "\n", " ")
+
+// Bytes returns message with headers, body is quoted-printable text
+func (message *EmailMessage) Bytes(from string, now time.Time) []byte {
+	headers := map[string]string{
+		"From":                      from,
+		"To":                        strings.Join(message.To, ", "),
+		"Subject":                   mime.QEncoding.Encode("utf-8", headerNewlines.Replace(message.Subject)),
+		"Date":                      now.Format(time.RFC1123Z),
+		"MIME-Version":              "1.0",
+		"Content-Type":              "text/plain; charset=utf-8",
+		"Content-Transfer-Encoding": "quoted-printable",
+	}
+	for name, value := range message.Headers {
+		headers[name] = value
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buffer, "%v: %v\r\n", name, headerNewlines.Replace(headers[name]))
+	}
+	buffer.WriteString("\r\n")
+	writer := quotedprintable.NewWriter(&buffer)
+	writer.Write([]byte(strings.ReplaceAll(message.Body, "\n", "\r\n")))
+	writer.Close()
+	return buffer.Bytes()
+}
+
+type MailerInterface interface {
+	Send(message *EmailMessage) error
+}
+
+// SmtpMailer opens new connection for every message, notifications are rare
+type SmtpMailer struct {
+	config SmtpConfig
+}
+
+func NewSmtpMailer(config SmtpConfig) *SmtpMailer {
+	return &SmtpMailer{config: config}
+}
+
+func (mailer *SmtpMailer) Send(message *EmailMessage) error {
+	from, err := mail.ParseAddress(mailer.config.From)
+	if err != nil {
+		return err
+	}
+	address := net.JoinHostPort(mailer.config.Host, strconv.Itoa(mailer.config.Port))
+	conn, err := net.DialTimeout("tcp", address, mailer.config.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(mailer.config.Timeout))
+	tlsConfig := &tls.Config{ServerName: mailer.config.Host}
+	if mailer.config.Security == SMTP_TLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	client, err := smtp.NewClient(conn, mailer.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if mailer.config.Security == SMTP_STARTTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if mailer.config.Username != "" {
+		// NB: PlainAuth refuses to send password without TLS, except to localhost
+		if err := client.Auth(smtp.PlainAuth("", mailer.config.Username, mailer.config.Password, mailer.config.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range message.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message.Bytes(mailer.config.From, time.Now())); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+type notifyJob struct {
+	message  *EmailMessage
+	attempts int
+}
+
+// Notifier renders notifications and sends them in background, failed ones are retried
+type Notifier struct {
+	site          string
+	mailer        MailerInterface
+	templates     map[string]*template.Template
+	ownerEmails   []string
+	cipher        *EmailCipher      // nil without email_key, replies are not sent then
+	moderation    *ModerationSigner // links of pending comments
+	unsubscribe   *ModerationSigner // signed with email_key
+	maxAttempts   int
+	retryInterval time.Duration
+
+	queue     chan *notifyJob
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewNotifier returns nil if notifications are disabled
+func NewNotifier(site string, config ApplicationConfig, mailer MailerInterface) (*Notifier, error) {
+	if !config.Notify.Enabled {
+		return nil, nil
+	}
+	templates, err := LoadNotifyTemplates(config.Notify.TemplatesDir)
+	if err != nil {
+		return nil, err
+	}
+	var emailCipher *EmailCipher = nil
+	if config.Notify.EmailKey != "" {
+		if emailCipher, err = NewEmailCipher(config.Notify.EmailKey); err != nil {
+			return nil, err
+		}
+	}
+	notifier := &Notifier{
+		site:          site,
+		mailer:        mailer,
+		templates:     templates,
+		ownerEmails:   config.Notify.OwnerEmails,
+		cipher:        emailCipher,
+		moderation:    NewModerationSigner(config),
+		unsubscribe:   NewUnsubscribeSigner(config),
+		maxAttempts:   config.Notify.MaxAttempts,
+		retryInterval: config.Notify.RetryInterval,
+		queue:         make(chan *notifyJob, config.Notify.QueueSize),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go notifier.run()
+	return notifier, nil
+}
+
+// NewUnsubscribeSigner signs links of reply notifications, they are valid until email_key is changed.
+// Links are disabled without valid key
+func NewUnsubscribeSigner(config ApplicationConfig) *ModerationSigner {
+	key := ""
+	if config.Notify.EmailKey != "" {
+		if subkey, err := deriveEmailKey(config.Notify.EmailKey, UNSUBSCRIBE_KEY_INFO); err == nil {
+			key = hex.EncodeToString(subkey)
+		}
+	}
+	return &ModerationSigner{
+		key:       key,
+		publicUrl: strings.TrimSuffix(config.Server.PublicUrl, "/"),
+	}
+}
+
+func getUnsubscribeLink(signer *ModerationSigner, commentId int64) string {
+	return fmt.Sprintf("%v/notifications/%v/%v/%v", signer.publicUrl, commentId, NOTIFY_UNSUBSCRIBE, signer.Sign(commentId, NOTIFY_UNSUBSCRIBE))
+}
+
+func (notifier *Notifier) run() {
+	defer close(notifier.stopped)
+	for {
+		select {
+		case job := <-notifier.queue:
+			notifier.send(job, true)
+		case <-notifier.done:
+			// queued messages get last attempt on shutdown
+			for {
+				select {
+				case job := <-notifier.queue:
+					notifier.send(job, false)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (notifier *Notifier) send(job *notifyJob, retry bool) {
+	job.attempts += 1
+	err := notifier.mailer.Send(job.message)
+	if err == nil {
+		metricNotifications.WithLabelValues(notifier.site, "sent").Inc()
+		return
+	}
+	if !retry || job.attempts >= notifier.maxAttempts {
+		log.Printf("Unable to send notification %q after %v attempts: %v\n", job.message.Subject, job.attempts, err.Error())
+		metricNotifications.WithLabelValues(notifier.site, "failed").Inc()
+		return
+	}
+	delay := notifier.retryInterval * time.Duration(1<<(job.attempts-1))
+	log.Printf("Unable to send notification %q, retry in %v: %v\n", job.message.Subject, delay, err.Error())
+	metricNotifications.WithLabelValues(notifier.site, "retried").Inc()
+	time.AfterFunc(delay, func() { notifier.enqueue(job) })
+}
+
+func (notifier *Notifier) enqueue(job *notifyJob) {
+	select {
+	case <-notifier.done:
+		log.Printf("Notification %q is dropped on shutdown\n", job.message.Subject)
+		metricNotifications.WithLabelValues(notifier.site, "dropped").Inc()
+		return
+	default:
+	}
+	select {
+	case notifier.queue <- job:
+	default:
+		log.Printf("Notifications queue is full, %q is dropped\n", job.message.Subject)
+		metricNotifications.WithLabelValues(notifier.site, "dropped").Inc()
+	}
+}
+
+// render executes subject and body of template, subject is single line
+func (notifier *Notifier) render(kind string, data NotifyData) (string, string, error) {
+	var subject, body bytes.Buffer
+	if err := notifier.templates[kind].ExecuteTemplate(&subject, "subject", data); err != nil {
+		return "", "", err
+	}
+	if err := notifier.templates[kind].ExecuteTemplate(&body, "body", data); err != nil {
+		return "", "", err
+	}
+	return strings.Join(strings.Fields(subject.String()), " "), body.String(), nil
+}
+
+func (notifier *Notifier) notify(kind string, to []string, data NotifyData, headers map[string]string) {
+	subject, body, err := notifier.render(kind, data)
+	if err != nil {
+		log.Printf("Unable to render %v notification for comment %v: %v\n", kind, data.Comment.Id, err.Error())
+		return
+	}
+	notifier.enqueue(&notifyJob{message: &EmailMessage{To: to, Subject: subject, Body: body, Headers: headers}})
+}
+
+// Subscribe stores encrypted email in comment, so author may be notified about replies
+func (notifier *Notifier) Subscribe(comment *CommentModelOutput, email string) error {
+	if notifier.cipher == nil {
+		return errors.New("notifications.email_key is not set")
+	}
+	encrypted, err := notifier.cipher.Encrypt(email)
+	if err != nil {
+		return err
+	}
+	comment.EncryptedEmail = encrypted
+	return nil
+}
+
+// NotifyNewComment sends comment to owners, pending one with moderation links
+func (notifier *Notifier) NotifyNewComment(comment *CommentModelOutput, parent *CommentModelOutput) {
+	if len(notifier.ownerEmails) == 0 {
+		return
+	}
+	data := NotifyData{
+		Uri:     comment.Uri,
+		Comment: newNotifyComment(comment),
+		Pending: comment.Mode == MODE_PENDING,
+	}
+	if parent != nil {
+		data.Parent = newNotifyComment(parent)
+	}
+	if data.Pending && notifier.moderation.key != "" {
+		data.ApproveUrl = notifier.moderation.Link(comment.Id, MODERATION_APPROVE)
+		data.RejectUrl = notifier.moderation.Link(comment.Id, MODERATION_REJECT)
+	}
+	notifier.notify(NOTIFY_NEW_COMMENT, notifier.ownerEmails, data, nil)
+}
+
+// NotifyReply sends published reply to subscribed author of parent
+func (notifier *Notifier) NotifyReply(comment *CommentModelOutput, parent *CommentModelOutput) {
+	if notifier.cipher == nil || parent.Notification != 1 || parent.EncryptedEmail == "" {
+		return
+	}
+	email, err := notifier.cipher.Decrypt(parent.EncryptedEmail)
+	if err != nil {
+		log.Printf("Unable to decrypt email of comment %v: %v\n", parent.Id, err.Error())
+		return
+	}
+	unsubscribeUrl := getUnsubscribeLink(notifier.unsubscribe, parent.Id)
+	data := NotifyData{
+		Uri:            comment.Uri,
+		Comment:        newNotifyComment(comment),
+		Parent:         newNotifyComment(parent),
+		UnsubscribeUrl: unsubscribeUrl,
+	}
+	notifier.notify(NOTIFY_REPLY, []string{email}, data, map[string]string{
+		"List-Unsubscribe": "<" + unsubscribeUrl + ">",
+	})
+}
+
+// Close stops retries, queued messages are sent once
+func (notifier *Notifier) Close() {
+	notifier.closeOnce.Do(func() {
+		close(notifier.done)
+	})
+	<-notifier.stopped
+}
+
+// addNotifyRoutes adds pages of unsubscribe links from reply notifications
+func addNotifyRoutes(r *gin.Engine, signer *ModerationSigner, commentsBackend CommentsLogicInterface) {
+	unsubscribeHandler := func(c *gin.Context) {
+		commentId, isValid := parseCommentId(c)
+		if !isValid {
+			return
+		}
+		if !signer.Verify(commentId, NOTIFY_UNSUBSCRIBE, c.Param("token")) {
+			renderModerationPage(c, http.StatusForbidden, moderationPage{Title: "Notifications", Message: "Invalid unsubscribe link"})
+			return
+		}
+		if c.Request.Method == http.MethodGet {
+			renderModerationPage(c, 200, moderationPage{
+				Title:   "Notifications",
+				Message: "Stop notifications about replies to your comment?",
+				Action:  "Unsubscribe",
+			})
+			return
+		}
+		if err := commentsBackend.Unsubscribe(commentId); err != nil {
+			renderModerationPage(c, getModificationErrorStatus(err), moderationPage{Title: "Notifications", Message: err.Error()})
+			return
+		}
+		renderModerationPage(c, 200, moderationPage{Title: "Notifications", Message: "You are unsubscribed from replies"})
+	}
+	r.GET("/notifications/:commentId/"+NOTIFY_UNSUBSCRIBE+"/:token", unsubscribeHandler)
+	r.POST("/notifications/:commentId/"+NOTIFY_UNSUBSCRIBE+"/:token", unsubscribeHandler)
+}
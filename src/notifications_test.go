@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const TEST_EMAIL_KEY = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+type sinkMessage struct {
+	From    string
+	To      []string
+	Headers mail.Header
+	Body    string
+}
+
+// smtpSink is local SMTP server, which accepts everything
+type smtpSink struct {
+	listener net.Listener
+	messages chan sinkMessage
+	failures int32 // next transactions rejected with temporary error
+}
+
+func startSmtpSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	sink := &smtpSink{listener: listener, messages: make(chan sinkMessage, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return sink
+}
+
+func (sink *smtpSink) port() int {
+	return sink.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (sink *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%v\r\n", line) }
+	reply("220 sink ESMTP")
+	message := sinkMessage{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimRight(line, "\r\n"))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 sink")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			if atomic.AddInt32(&sink.failures, -1) >= 0 {
+				reply("451 try again later")
+				continue
+			}
+			message.From = strings.Trim(line[len("MAIL FROM:"):], "<> \r\n")
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			message.To = append(message.To, strings.Trim(line[len("RCPT TO:"):], "<> \r\n"))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+			parsed, err := mail.ReadMessage(strings.NewReader(data.String()))
+			if err != nil {
+				reply("554 invalid message")
+				continue
+			}
+			body, _ := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+			message.Headers = parsed.Header
+			message.Body = strings.ReplaceAll(string(body), "\r\n", "\n")
+			sink.messages <- message
+			message = sinkMessage{}
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (sink *smtpSink) waitMessage(t *testing.T) sinkMessage {
+	select {
+	case message := <-sink.messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message in SMTP sink")
+		return sinkMessage{}
+	}
+}
+
+func (sink *smtpSink) assertEmpty(t *testing.T) {
+	select {
+	case message := <-sink.messages:
+		t.Errorf("unexpected message %q to %v", message.Headers.Get("Subject"), message.To)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func getNotifyConfig(sink *smtpSink) ApplicationConfig {
+	config := getModerationConfig()
+	config.Policy.ReplyNotifications = true
+	config.Notify = DefaultNotifyConfig()
+	config.Notify.Enabled = true
+	config.Notify.Smtp.Host = "127.0.0.1"
+	config.Notify.Smtp.Port = sink.port()
+	config.Notify.Smtp.Security = SMTP_NONE
+	config.Notify.Smtp.From = "Comments <comments@example.com>"
+	config.Notify.Smtp.Timeout = 5 * time.Second
+	config.Notify.OwnerEmails = []string{"owner@example.com"}
+	config.Notify.EmailKey = TEST_EMAIL_KEY
+	config.Notify.RetryInterval = 10 * time.Millisecond
+	return config
+}
+
+func TestEmailCipher(t *testing.T) {
+	emailCipher, err := NewEmailCipher(TEST_EMAIL_KEY)
+	assert.Nil(t, err)
+	encrypted, err := emailCipher.Encrypt("alex@example.com")
+	assert.Nil(t, err)
+	assert.NotContains(t, encrypted, "alex")
+	other, _ := emailCipher.Encrypt("alex@example.com")
+	assert.NotEqual(t, encrypted, other)
+	email, err := emailCipher.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, "alex@example.com", email)
+
+	otherCipher, _ := NewEmailCipher(strings.Repeat("ff", EMAIL_KEY_LEN))
+	_, err = otherCipher.Decrypt(encrypted)
+	assert.NotNil(t, err)
+	_, err = emailCipher.Decrypt("invalid")
+	assert.NotNil(t, err)
+	_, err = NewEmailCipher("0011")
+	assert.NotNil(t, err)
+}
+
+func TestEmailSubkeys(t *testing.T) {
+	cipherKey, err := deriveEmailKey(TEST_EMAIL_KEY, EMAIL_CIPHER_KEY_INFO)
+	assert.Nil(t, err)
+	unsubscribeKey, err := deriveEmailKey(TEST_EMAIL_KEY, UNSUBSCRIBE_KEY_INFO)
+	assert.Nil(t, err)
+	assert.Len(t, cipherKey, EMAIL_KEY_LEN)
+	assert.NotEqual(t, cipherKey, unsubscribeKey)
+	assert.NotEqual(t, TEST_EMAIL_KEY, hex.EncodeToString(cipherKey))
+
+	config := ApplicationConfig{Notify: DefaultNotifyConfig()}
+	config.Notify.EmailKey = TEST_EMAIL_KEY
+	signer := NewUnsubscribeSigner(config)
+	assert.Equal(t, hex.EncodeToString(unsubscribeKey), signer.key)
+	rawSigner := &ModerationSigner{key: TEST_EMAIL_KEY}
+	assert.False(t, signer.Verify(1, NOTIFY_UNSUBSCRIBE, rawSigner.Sign(1, NOTIFY_UNSUBSCRIBE)))
+	assert.True(t, signer.Verify(1, NOTIFY_UNSUBSCRIBE, signer.Sign(1, NOTIFY_UNSUBSCRIBE)))
+
+	config.Notify.EmailKey = ""
+	assert.Equal(t, "", NewUnsubscribeSigner(config).key)
+}
+
+func TestNotifyTemplates(t *testing.T) {
+	templates, err := LoadNotifyTemplates("")
+	assert.Nil(t, err)
+	notifier := &Notifier{templates: templates}
+	comment := &CommentModelOutput{Id: 2, Text: "<p>reply</p>", TextSource: "reply", Author: s("Bob")}
+	subject, body, err := notifier.render(NOTIFY_NEW_COMMENT, NotifyData{
+		Uri:        "/post/",
+		Comment:    newNotifyComment(comment),
+		Parent:     newNotifyComment(&CommentModelOutput{Id: 1, Text: "<p>old</p>"}),
+		Pending:    true,
+		ApproveUrl: "https://comments.example.com/moderation/2/approve/token",
+		RejectUrl:  "https://comments.example.com/moderation/2/reject/token",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "New comment on /post/", subject)
+	assert.Equal(t, "Bob wrote on /post/ in reply to Anonymous:\n\nreply\n\nLink: /post/#isso-2\n\n"+
+		"Comment is pending moderation.\nApprove: https://comments.example.com/moderation/2/approve/token\n"+
+		"Reject: https://comments.example.com/moderation/2/reject/token\n", body)
+
+	dir := filepath.Dir(writeTestFile(t, "new_comment.txt", `{{define "subject"}}
+  [blog] {{.Comment.Author}}
+{{end}}{{define "body"}}{{.Comment.Text}}{{end}}`))
+	templates, err = LoadNotifyTemplates(dir)
+	assert.Nil(t, err)
+	notifier = &Notifier{templates: templates}
+	subject, body, err = notifier.render(NOTIFY_NEW_COMMENT, NotifyData{Comment: newNotifyComment(comment)})
+	assert.Nil(t, err)
+	assert.Equal(t, "[blog] Bob", subject)
+	assert.Equal(t, "reply", body)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "reply.txt"), []byte(`{{define "subject"}}reply{{end}}`), 0600))
+	_, err = LoadNotifyTemplates(dir)
+	assert.NotNil(t, err)
+}
+
+func TestEmailMessage(t *testing.T) {
+	message := EmailMessage{
+		To:      []string{"alex@example.com"},
+		Subject: "Привет\r\nBcc: spam@example.com",
+		Body:    "line\nnext",
+		Headers: map[string]string{"List-Unsubscribe": "<https://example.com/unsubscribe>"},
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(string(message.Bytes("comments@example.com", time.Now()))))
+	assert.Nil(t, err)
+	assert.Equal(t, "", parsed.Header.Get("Bcc"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Привет  Bcc: spam@example.com", subject)
+	assert.Equal(t, "<https://example.com/unsubscribe>", parsed.Header.Get("List-Unsubscribe"))
+	body, _ := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+	assert.Equal(t, "line\r\nnext", string(body))
+}
+
+func TestNotifyWithSmtpSink(t *testing.T) {
+	sink := startSmtpSink(t)
+	config := getNotifyConfig(sink)
+	logic := GetCommentsLogic(config)
+	app := NewGinApp(config, logic)
+	uri := "example.com/notifications"
+
+	inputComment := getFakeInputComment()
+	inputComment.Notification = 1
+	created := postComment(t, app, &inputComment, uri)
+	assert.Equal(t, 1, created.Notification)
+	stored, _ := logic.storage.GetComment(created.Id)
+	assert.NotEqual(t, "", stored.EncryptedEmail)
+	assert.NotContains(t, stored.EncryptedEmail, "alex")
+
+	message := sink.waitMessage(t)
+	assert.Equal(t, "comments@example.com", message.From)
+	assert.Equal(t, []string{"owner@example.com"}, message.To)
+	assert.Equal(t, "New comment on "+uri, message.Headers.Get("Subject"))
+	assert.Contains(t, message.Body, "Hello, _world_")
+	approveUrl := NewModerationSigner(config).Link(created.Id, MODERATION_APPROVE)
+	assert.Contains(t, message.Body, "Approve: "+approveUrl)
+	assert.Equal(t, 200, serveRequest(app, "POST", strings.TrimPrefix(approveUrl, "https://comments.example.com"), "").Code)
+
+	// reply is sent after approval of it
+	reply := getFakeInputComment()
+	reply.Author = s("Bob")
+	reply.Email = s("bob@example.com")
+	reply.Parent = &created.Id
+	reply.Text = "Reply to Alex"
+	replyComment := postComment(t, app, &reply, uri)
+	assert.Contains(t, sink.waitMessage(t).Body, "Bob wrote on "+uri+" in reply to Test user Alex")
+	sink.assertEmpty(t)
+	_, err := logic.ApproveComment(replyComment.Id)
+	assert.Nil(t, err)
+	message = sink.waitMessage(t)
+	assert.Equal(t, []string{"alex@example.com"}, message.To)
+	assert.Equal(t, "Reply to your comment on "+uri, message.Headers.Get("Subject"))
+	assert.Contains(t, message.Body, "Reply to Alex")
+	unsubscribeUrl := regexp.MustCompile(`Unsubscribe from replies: (\S+)`).FindStringSubmatch(message.Body)[1]
+	assert.Equal(t, "<"+unsubscribeUrl+">", message.Headers.Get("List-Unsubscribe"))
+
+	// own replies are not sent
+	ownReply := getFakeInputComment()
+	ownReply.Parent = &created.Id
+	ownReplyComment := postComment(t, app, &ownReply, uri)
+	sink.waitMessage(t)
+	_, err = logic.ApproveComment(ownReplyComment.Id)
+	assert.Nil(t, err)
+	sink.assertEmpty(t)
+
+	unsubscribePath := strings.TrimPrefix(unsubscribeUrl, "https://comments.example.com")
+	assert.Equal(t, http.StatusForbidden, serveRequest(app, "POST", unsubscribePath+"0", "").Code)
+	w := serveRequest(app, "GET", unsubscribePath, "")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "<form method=\"post\">")
+	assert.Equal(t, 200, serveRequest(app, "POST", unsubscribePath, "").Code)
+	stored, _ = logic.storage.GetComment(created.Id)
+	assert.Equal(t, 0, stored.Notification)
+	assert.Equal(t, "", stored.EncryptedEmail)
+
+	secondReply := postComment(t, app, &reply, uri)
+	sink.waitMessage(t)
+	_, err = logic.ApproveComment(secondReply.Id)
+	assert.Nil(t, err)
+	sink.assertEmpty(t)
+
+	// queued messages are sent on shutdown
+	postComment(t, app, &inputComment, uri)
+	assert.Nil(t, logic.Close())
+	assert.Equal(t, []string{"owner@example.com"}, sink.waitMessage(t).To)
+}
+
+func TestNotifyRetries(t *testing.T) {
+	sink := startSmtpSink(t)
+	config := getNotifyConfig(sink)
+	config.Policy.Moderation = false
+	config.Notify.MaxAttempts = 3
+	logic := GetCommentsLogic(config)
+	defer logic.Close()
+
+	atomic.StoreInt32(&sink.failures, 2)
+	inputComment := getFakeInputComment()
+	comment, err := logic.AddComment("example.com/retries", &inputComment, ClientInfo{})
+	assert.Nil(t, err)
+	assert.Contains(t, sink.waitMessage(t).Body, "#isso-"+strconv.FormatInt(comment.Id, 10))
+
+	// failed messages are dropped after last attempt
+	atomic.StoreInt32(&sink.failures, 3)
+	_, err = logic.AddComment("example.com/retries", &inputComment, ClientInfo{})
+	assert.Nil(t, err)
+	time.Sleep(200 * time.Millisecond)
+	sink.assertEmpty(t)
+}
+
+func TestNotifyConfig(t *testing.T) {
+	_, err := LoadConfig(getTestEnv(map[string]string{
+		"NOTIFY_ENABLED":             "true",
+		"SMTP_SECURITY":              "ssl",
+		"NOTIFY_OWNER_EMAILS":        "owner@example.com,owner",
+		"POLICY_REPLY_NOTIFICATIONS": "true",
+	}))
+	configErr, isConfigErr := err.(*ConfigError)
+	assert.True(t, isConfigErr)
+	assert.Len(t, configErr.Problems, 5)
+	for _, problem := range []string{"smtp.host", "smtp.security", "smtp.from", "owner_emails", "email_key"} {
+		assert.Contains(t, err.Error(), problem)
+	}
+
+	config, err := LoadConfig(getTestEnv(map[string]string{
+		"NOTIFY_ENABLED":             "true",
+		"SMTP_HOST":                  "smtp.example.com",
+		"SMTP_FROM":                  "comments@example.com",
+		"SMTP_PASSWORD":              "smtp-password",
+		"NOTIFY_EMAIL_KEY":           TEST_EMAIL_KEY,
+		"POLICY_REPLY_NOTIFICATIONS": "true",
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, SMTP_STARTTLS, config.Notify.Smtp.Security)
+	assert.NotContains(t, DumpConfig(config), TEST_EMAIL_KEY)
+	assert.NotContains(t, DumpConfig(config), "smtp-password")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisInvalidator delivers invalidation events between replicas with Redis pub/sub.
+// Pub/sub has no delivery guarantees, so caches are reset after every reconnect
+type RedisInvalidator struct {
+	client  *redis.Client
+	channel string
+	cancel  context.CancelFunc
+	ctx     context.Context
+}
+
+const REDIS_RECONNECT_DELAY = time.Second
+
+func NewRedisInvalidator(config RedisConfig) *RedisInvalidator {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RedisInvalidator{
+		client: redis.NewClient(&redis.Options{
+			Addr:     config.Endpoint,
+			Password: config.Password,
+			DB:       config.Db,
+		}),
+		channel: config.KeyPrefix + "invalidations",
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (invalidator *RedisInvalidator) Publish(event *InvalidationEvent) error {
+	eventBytes, _ := json.Marshal(event)
+	err := invalidator.client.Publish(context.Background(), invalidator.channel, eventBytes).Err()
+	if err != nil {
+		metricInvalidationErrors.WithLabelValues("publish").Inc()
+	}
+	return err
+}
+
+func (invalidator *RedisInvalidator) Subscribe(handler func(event *InvalidationEvent), reset func()) {
+	pubsub := invalidator.client.Subscribe(invalidator.ctx, invalidator.channel)
+	go func() {
+		defer pubsub.Close()
+		for {
+			message, err := pubsub.Receive(invalidator.ctx)
+			if err != nil {
+				if invalidator.ctx.Err() != nil {
+					return
+				}
+				metricInvalidationErrors.WithLabelValues("receive").Inc()
+				log.Printf("Invalidation events are not received: %v\n", err.Error())
+				time.Sleep(REDIS_RECONNECT_DELAY)
+				continue
+			}
+			switch message := message.(type) {
+			case *redis.Subscription:
+				// first subscription or reconnect, events may be lost before it
+				if message.Kind == "subscribe" {
+					reset()
+				}
+			case *redis.Message:
+				event := InvalidationEvent{}
+				err := json.Unmarshal([]byte(message.Payload), &event)
+				if err != nil {
+					metricInvalidationErrors.WithLabelValues("receive").Inc()
+					log.Printf("Invalid invalidation event: %v\n", err.Error())
+					reset()
+					continue
+				}
+				handler(&event)
+			}
+		}
+	}()
+}
+
+func (invalidator *RedisInvalidator) Close() error {
+	invalidator.cancel()
+	return invalidator.client.Close()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RedisCommentsStorage is cache shared by all replicas in front of slowBackend.
+// Every cached value has generation key, incremented by writers,
+// so value loaded from slowBackend is not saved if it was changed during loading.
+// Errors of Redis are logged and requests are passed to slowBackend
+type RedisCommentsStorage struct {
+	client      *redis.Client
+	config      RedisConfig
+	slowBackend CommentsStorageInterface
+	site        string
+}
+
+var (
+	metricRedisHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_cache_hits",
+		Help: "Number of redis cache hits",
+	}, []string{"cache", "site"})
+	metricRedisMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_cache_misses",
+		Help: "Number of redis cache misses",
+	}, []string{"cache", "site"})
+	metricRedisErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_cache_errors",
+		Help: "Number of failed redis requests",
+	}, []string{"cache", "site"})
+)
+
+// KEYS: value, generation; ARGV: value, expected generation, ttl in ms
+var redisSetIfUnchanged = redis.NewScript(`
+local generation = redis.call("GET", KEYS[2]) or ""
+if generation ~= ARGV[2] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+return 1
+`)
+
+const REDIS_GENERATION_TTL = 24 * time.Hour // must be longer than any loading from slowBackend
+
+func NewRedisCommentsStorage(config RedisConfig, slowBackend CommentsStorageInterface) (*RedisCommentsStorage, error) {
+	return NewSiteRedisCommentsStorage(DEFAULT_SITE, config, slowBackend)
+}
+
+func NewSiteRedisCommentsStorage(site string, config RedisConfig, slowBackend CommentsStorageInterface) (*RedisCommentsStorage, error) {
+	if slowBackend == nil {
+		return nil, fmt.Errorf("redis storage requires slowBackend")
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     config.Endpoint,
+		Password: config.Password,
+		DB:       config.Db,
+	})
+	return &RedisCommentsStorage{
+		client:      client,
+		config:      config,
+		slowBackend: slowBackend,
+		site:        site,
+	}, nil
+}
+
+func (storage *RedisCommentsStorage) getCommentKey(commentId int64) string {
+	return fmt.Sprintf("%vcomment:%v", storage.config.KeyPrefix, commentId)
+}
+
+func (storage *RedisCommentsStorage) getPageKey(uri string) string {
+	return fmt.Sprintf("%vpage:%v", storage.config.KeyPrefix, uri)
+}
+
+func (storage *RedisCommentsStorage) getCountKey(uri string) string {
+	return fmt.Sprintf("%vcount:%v", storage.config.KeyPrefix, uri)
+}
+
+func getGenerationKey(key string) string {
+	return key + ":generation"
+}
+
+func (storage *RedisCommentsStorage) logError(cache string, err error) {
+	metricRedisErrors.WithLabelValues(cache, storage.site).Inc()
+	log.Printf("Redis %v cache error: %v\n", cache, err.Error())
+}
+
+// get returns generation for setIfUnchanged on miss, exists is false on errors too
+func (storage *RedisCommentsStorage) get(cache string, key string) (value string, generation string, exists bool) {
+	ctx := context.Background()
+	pipe := storage.client.Pipeline()
+	valueCmd := pipe.Get(ctx, key)
+	generationCmd := pipe.Get(ctx, getGenerationKey(key))
+	pipe.Exec(ctx)
+	if err := generationCmd.Err(); err != nil && err != redis.Nil {
+		storage.logError(cache, err)
+		return "", "", false
+	}
+	generation = generationCmd.Val()
+	if err := valueCmd.Err(); err != nil {
+		if err != redis.Nil {
+			storage.logError(cache, err)
+		}
+		metricRedisMisses.WithLabelValues(cache, storage.site).Inc()
+		return "", generation, false
+	}
+	metricRedisHits.WithLabelValues(cache, storage.site).Inc()
+	return valueCmd.Val(), generation, true
+}
+
+func (storage *RedisCommentsStorage) setIfUnchanged(cache string, key string, value string, generation string, ttl time.Duration) {
+	err := redisSetIfUnchanged.Run(
+		context.Background(),
+		storage.client,
+		[]string{key, getGenerationKey(key)},
+		value, generation, ttl.Milliseconds(),
+	).Err()
+	if err != nil {
+		storage.logError(cache, err)
+	}
+}
+
+// invalidate must be called after every change in slowBackend
+func (storage *RedisCommentsStorage) invalidate(cache string, keys ...string) {
+	ctx := context.Background()
+	_, err := storage.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Incr(ctx, getGenerationKey(key))
+			pipe.Expire(ctx, getGenerationKey(key), REDIS_GENERATION_TTL)
+			pipe.Del(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		// NB: cache may be stale until ttl
+		storage.logError(cache, err)
+	}
+}
+
+func (storage *RedisCommentsStorage) GetPageComments(uri string) ([]int64, error) {
+	key := storage.getPageKey(uri)
+	value, generation, exists := storage.get("pages", key)
+	if exists {
+		var pageComments []int64
+		err := json.Unmarshal([]byte(value), &pageComments)
+		if err == nil {
+			return pageComments, nil
+		}
+		storage.logError("pages", err)
+	}
+	pageComments, err := storage.slowBackend.GetPageComments(uri)
+	if err != nil {
+		return pageComments, err
+	}
+	pageBytes, _ := json.Marshal(pageComments)
+	storage.setIfUnchanged("pages", key, string(pageBytes), generation, storage.config.PageTtl)
+	return pageComments, nil
+}
+
+func (storage *RedisCommentsStorage) AddCommentToPage(uri string, commentId int64) error {
+	err := storage.slowBackend.AddCommentToPage(uri, commentId)
+	storage.invalidate("pages", storage.getPageKey(uri), storage.getCountKey(uri))
+	return err
+}
+
+func (storage *RedisCommentsStorage) RemoveCommentFromPage(uri string, commentId int64) error {
+	err := storage.slowBackend.RemoveCommentFromPage(uri, commentId)
+	storage.invalidate("pages", storage.getPageKey(uri), storage.getCountKey(uri))
+	return err
+}
+
+func (storage *RedisCommentsStorage) AddComment(commentData *CommentModelOutput) (int64, error) {
+	commentId, err := storage.slowBackend.AddComment(commentData)
+	// comment may be requested before it was added
+	storage.invalidate("comments", storage.getCommentKey(commentData.Id), storage.getCountKey(commentData.Uri))
+	return commentId, err
+}
+
+func (storage *RedisCommentsStorage) UpdateComment(commentData *CommentModelOutput) error {
+	err := storage.slowBackend.UpdateComment(commentData)
+	// mode of comment may be changed
+	storage.invalidate("comments", storage.getCommentKey(commentData.Id), storage.getCountKey(commentData.Uri))
+	return err
+}
+
+func (storage *RedisCommentsStorage) GetComment(commentId int64) (*CommentModelOutput, error) {
+	key := storage.getCommentKey(commentId)
+	value, generation, exists := storage.get("comments", key)
+	if exists {
+		commentData, err := UnmarshalCommentRecord([]byte(value))
+		if err == nil {
+			return commentData, nil
+		}
+		storage.logError("comments", err)
+	}
+	commentData, err := storage.slowBackend.GetComment(commentId)
+	if err != nil || commentData == nil {
+		return commentData, err
+	}
+	commentBytes, err := MarshalCommentRecord(commentData)
+	if err == nil {
+		storage.setIfUnchanged("comments", key, string(commentBytes), generation, storage.config.CommentTtl)
+	}
+	return commentData, nil
+}
+
+func (storage *RedisCommentsStorage) DeleteComment(commentId int64) error {
+	err := storage.slowBackend.DeleteComment(commentId)
+	storage.invalidate("comments", storage.getCommentKey(commentId))
+	return err
+}
+
+func (storage *RedisCommentsStorage) ListComments() ([]int64, error) {
+	return storage.slowBackend.ListComments()
+}
+
+func (storage *RedisCommentsStorage) ListCommentsIndex() ([]CommentIndexEntry, error) {
+	return storage.slowBackend.ListCommentsIndex()
+}
+
+func (storage *RedisCommentsStorage) GetCommentsCounts(uris []string) ([]int, error) {
+	res := make([]int, len(uris))
+	missedInds := make([]int, 0)
+	missedUris := make([]string, 0)
+	generations := make([]string, 0)
+	for ind, uri := range uris {
+		value, generation, exists := storage.get("counts", storage.getCountKey(uri))
+		if exists {
+			count, err := strconv.Atoi(value)
+			if err == nil {
+				res[ind] = count
+				continue
+			}
+			storage.logError("counts", err)
+		}
+		missedInds = append(missedInds, ind)
+		missedUris = append(missedUris, uri)
+		generations = append(generations, generation)
+	}
+	if len(missedUris) == 0 {
+		return res, nil
+	}
+
+	// counted through shared cache of comments, so replicas don't load same comments from slowBackend
+	missedCounts, err := countPages(missedUris, func(uri string) (int, error) {
+		return countPageComments(storage, uri)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for ind, uri := range missedUris {
+		storage.setIfUnchanged(
+			"counts", storage.getCountKey(uri), strconv.Itoa(missedCounts[ind]), generations[ind], storage.config.CountTtl,
+		)
+		res[missedInds[ind]] = missedCounts[ind]
+	}
+	return res, nil
+}
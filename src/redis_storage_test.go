@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getRedisTestStorages(t *testing.T, replicas int) ([]*RedisCommentsStorage, *MemoryCommentsStorageLinked) {
+	if _, exists := os.LookupEnv("TESTS_ENABLE_INTEGRATIONS"); !exists {
+		t.Skipf("TESTS_ENABLE_INTEGRATIONS disabled")
+	}
+	config := ReadConfig().Redis
+	if config == nil {
+		t.Skipf("REDIS_ENDPOINT is not set")
+	}
+	config.KeyPrefix = fmt.Sprintf("test-%v:", time.Now().UnixNano())
+	slowBackend, _ := NewMemoryStorageLinked(nil, CacheConfig{})
+	res := make([]*RedisCommentsStorage, replicas)
+	for ind := range res {
+		storage, err := NewRedisCommentsStorage(*config, slowBackend)
+		assert.Nil(t, err)
+		res[ind] = storage
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		keys, _ := res[0].client.Keys(ctx, config.KeyPrefix+"*").Result()
+		if len(keys) > 0 {
+			res[0].client.Del(ctx, keys...)
+		}
+	})
+	return res, slowBackend
+}
+
+func TestRedisSharedComments(t *testing.T) {
+	storages, slowBackend := getRedisTestStorages(t, 2)
+	first, second := storages[0], storages[1]
+	comment := CommentModelOutput{Id: 1, Mode: MODE_PUBLIC, Text: "first", Uri: "example.com/redis"}
+	_, err := first.AddComment(&comment)
+	assert.Nil(t, err)
+
+	loaded, err := first.GetComment(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", loaded.Text)
+	assert.Equal(t, "example.com/redis", loaded.Uri)
+
+	// change behind cache is not visible, other replica uses warm cache
+	comment.Text = "hidden"
+	slowBackend.UpdateComment(&comment)
+	loaded, _ = second.GetComment(1)
+	assert.Equal(t, "first", loaded.Text)
+
+	comment.Text = "second"
+	assert.Nil(t, second.UpdateComment(&comment))
+	loaded, _ = first.GetComment(1)
+	assert.Equal(t, "second", loaded.Text)
+
+	assert.Nil(t, first.DeleteComment(1))
+	_, err = second.GetComment(1)
+	assert.NotNil(t, err)
+
+	keys, _ := first.client.Keys(context.Background(), first.config.KeyPrefix+"comment:*").Result()
+	assert.NotEmpty(t, keys)
+}
+
+func TestRedisPagesAndCounts(t *testing.T) {
+	storages, _ := getRedisTestStorages(t, 2)
+	first, second := storages[0], storages[1]
+	uri := "example.com/redis-page"
+	for commentId := int64(1); commentId <= 2; commentId++ {
+		first.AddComment(&CommentModelOutput{Id: commentId, Mode: MODE_PUBLIC, Uri: uri})
+		assert.Nil(t, first.AddCommentToPage(uri, commentId))
+	}
+
+	counts, err := first.GetCommentsCounts([]string{uri})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2}, counts)
+	pageComments, err := second.GetPageComments(uri)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []int64{1, 2}, pageComments)
+
+	assert.Nil(t, second.RemoveCommentFromPage(uri, 1))
+	counts, _ = first.GetCommentsCounts([]string{uri})
+	assert.Equal(t, []int{1}, counts)
+	pageComments, _ = first.GetPageComments(uri)
+	assert.Equal(t, []int64{2}, pageComments)
+}
+
+func TestRedisStaleLoadIsNotSaved(t *testing.T) {
+	storages, _ := getRedisTestStorages(t, 1)
+	storage := storages[0]
+	key := storage.getCommentKey(1)
+
+	_, generation, exists := storage.get("comments", key)
+	assert.False(t, exists)
+	storage.invalidate("comments", key) // writer finished during loading
+	storage.setIfUnchanged("comments", key, "stale", generation, time.Minute)
+	_, _, exists = storage.get("comments", key)
+	assert.False(t, exists)
+
+	_, generation, _ = storage.get("comments", key)
+	storage.setIfUnchanged("comments", key, "fresh", generation, time.Minute)
+	value, _, exists := storage.get("comments", key)
+	assert.True(t, exists)
+	assert.Equal(t, "fresh", value)
+}
+
+func TestRedisInvalidation(t *testing.T) {
+	storages, _ := getRedisTestStorages(t, 2)
+	first, _ := NewMemoryStorageLinked(storages[0], CacheConfig{})
+	second, _ := NewMemoryStorageLinked(storages[1], CacheConfig{})
+	for _, storage := range []*MemoryCommentsStorageLinked{first, second} {
+		invalidator := NewRedisInvalidator(storages[0].config)
+		defer invalidator.Close()
+		storage.LinkInvalidator(invalidator)
+	}
+	time.Sleep(100 * time.Millisecond) // subscriptions are asynchronous
+	uri := "example.com/redis-invalidation"
+
+	first.AddComment(&CommentModelOutput{Id: 1, Mode: MODE_PUBLIC, Uri: uri, Text: "first"})
+	assert.Nil(t, first.AddCommentToPage(uri, 1))
+	comment, _ := second.GetComment(1)
+	assert.Equal(t, "first", comment.Text)
+
+	comment.Text = "second"
+	assert.Nil(t, first.UpdateComment(comment))
+	assert.Eventually(t, func() bool {
+		comment, _ := second.GetComment(1)
+		return comment.Text == "second"
+	}, time.Second, 10*time.Millisecond)
+}
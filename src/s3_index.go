@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Index of comments for admin area: every comment has empty object index/<id>.<page hash>,
+// tombstone has index/<id>.<page hash>.deleted instead, pending ones are known from pending/.
+// So comments are filtered and grouped by pages with listings instead of loading every comment.
+// Comments of old versions are indexed by index-comments command
+const (
+	INDEX_PREFIX         = "index/"
+	INDEX_DELETED_SUFFIX = ".deleted"
+)
+
+func getIndexPrefix(commentId int64) string {
+	return fmt.Sprintf("%v%v.", INDEX_PREFIX, commentId)
+}
+
+// getIndexObjectName returns name of index entry for current state of comment
+func (backend *S3CommentsBackend) getIndexObjectName(comment *CommentModelOutput) string {
+	pageHash := ""
+	if comment.Uri != "" {
+		pageHash = backend.pageHashes(comment.Uri)[0]
+	}
+	name := getIndexPrefix(comment.Id) + pageHash
+	if comment.Mode == MODE_DELETED {
+		name += INDEX_DELETED_SUFFIX
+	}
+	return name
+}
+
+func (backend *S3CommentsBackend) putIndexObject(name string) error {
+	_, err := backend.minio.PutObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(name),
+		bytes.NewReader([]byte{}),
+		0,
+		minio.PutObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("PUT", "index").Inc()
+	return err
+}
+
+func (backend *S3CommentsBackend) removeIndexObject(name string) error {
+	err := backend.minio.RemoveObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(name),
+		minio.RemoveObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("DELETE", "index").Inc()
+	return err
+}
+
+// listIndexObjects returns names of index entries with prefix, without key prefix of site
+func (backend *S3CommentsBackend) listIndexObjects(prefix string) ([]string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	objectCh := backend.minio.ListObjects(ctx, backend.config.Bucket, minio.ListObjectsOptions{
+		Prefix:    backend.objectName(prefix),
+		Recursive: true,
+	})
+	backend.metricOperations.WithLabelValues("LIST", "index").Inc()
+	res := make([]string, 0)
+	for object := range objectCh {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		res = append(res, strings.TrimPrefix(object.Key, backend.objectName("")))
+	}
+	return res, nil
+}
+
+// writeIndexEntry replaces entries of comment with one for its current state
+func (backend *S3CommentsBackend) writeIndexEntry(comment *CommentModelOutput) error {
+	names, err := backend.listIndexObjects(getIndexPrefix(comment.Id))
+	if err != nil {
+		return err
+	}
+	name := backend.getIndexObjectName(comment)
+	if len(names) == 1 && names[0] == name {
+		return nil
+	}
+	if err := backend.putIndexObject(name); err != nil {
+		return err
+	}
+	return backend.removeIndexObjects(names, name)
+}
+
+// removeIndexObjects removes entries except kept one
+func (backend *S3CommentsBackend) removeIndexObjects(names []string, kept string) error {
+	for _, name := range names {
+		if name == kept {
+			continue
+		}
+		if err := backend.removeIndexObject(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (backend *S3CommentsBackend) removeIndexEntries(commentId int64) error {
+	names, err := backend.listIndexObjects(getIndexPrefix(commentId))
+	if err != nil {
+		return err
+	}
+	return backend.removeIndexObjects(names, "")
+}
+
+func (backend *S3CommentsBackend) ListCommentsIndex() ([]CommentIndexEntry, error) {
+	backend.minioLazyInit()
+	pendingIds, err := backend.ListPendingComments()
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[int64]bool, len(pendingIds))
+	for _, commentId := range pendingIds {
+		pending[commentId] = true
+	}
+	names, err := backend.listIndexObjects(INDEX_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]CommentIndexEntry, 0, len(names))
+	positions := make(map[int64]int, len(names))
+	for _, name := range names {
+		parts := strings.SplitN(strings.TrimPrefix(name, INDEX_PREFIX), ".", 2)
+		commentId, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) != 2 {
+			log.Printf("Unexpected object %v in index, skipping\n", name)
+			continue
+		}
+		entry := CommentIndexEntry{Id: commentId, Page: strings.TrimSuffix(parts[1], INDEX_DELETED_SUFFIX), Mode: MODE_PUBLIC}
+		if strings.HasSuffix(parts[1], INDEX_DELETED_SUFFIX) {
+			entry.Mode = MODE_DELETED
+		} else if pending[commentId] {
+			entry.Mode = MODE_PENDING
+		}
+		// comment has two entries only while its entry is replaced
+		if position, exists := positions[commentId]; exists {
+			if entry.Mode == MODE_DELETED {
+				res[position] = entry
+			}
+			continue
+		}
+		positions[commentId] = len(res)
+		res = append(res, entry)
+	}
+	sortIndexEntries(res)
+	return res, nil
+}
+
+// IndexComments writes index entries of all stored comments, returns number of comments
+func (backend *S3CommentsBackend) IndexComments() (int, error) {
+	commentIds, err := backend.ListComments()
+	if err != nil {
+		return 0, err
+	}
+	for ind, commentId := range commentIds {
+		comment, err := backend.GetComment(commentId)
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			continue
+		}
+		if err != nil {
+			return ind, err
+		}
+		if err := backend.writeIndexEntry(comment); err != nil {
+			return ind, err
+		}
+	}
+	return len(commentIds), nil
+}
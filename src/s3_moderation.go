@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// every pending comment has pending/<comment id>.json, so nodes don't overwrite each other
+const PENDING_PREFIX = "pending/"
+
+func getPendingObjectName(commentId int64) string {
+	return fmt.Sprintf("%v%v.json", PENDING_PREFIX, commentId)
+}
+
+type pendingRecord struct {
+	Uri string `json:"uri"` // only for people looking into bucket
+}
+
+func (backend *S3CommentsBackend) AddPendingComment(commentId int64, uri string) error {
+	backend.minioLazyInit()
+	recordBytes, _ := json.Marshal(pendingRecord{Uri: uri})
+	_, err := backend.minio.PutObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(getPendingObjectName(commentId)),
+		bytes.NewReader(recordBytes),
+		int64(len(recordBytes)),
+		minio.PutObjectOptions{ContentType: "application/json"},
+	)
+	backend.metricOperations.WithLabelValues("PUT", "pending").Inc()
+	return err
+}
+
+func (backend *S3CommentsBackend) RemovePendingComment(commentId int64) error {
+	backend.minioLazyInit()
+	err := backend.minio.RemoveObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(getPendingObjectName(commentId)),
+		minio.RemoveObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("DELETE", "pending").Inc()
+	return err
+}
+
+func (backend *S3CommentsBackend) ListPendingComments() ([]int64, error) {
+	backend.minioLazyInit()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	objectCh := backend.minio.ListObjects(ctx, backend.config.Bucket, minio.ListObjectsOptions{
+		Prefix:    backend.objectName(PENDING_PREFIX),
+		Recursive: true,
+	})
+	backend.metricOperations.WithLabelValues("LIST", "pending").Inc()
+	res := make([]int64, 0)
+	for object := range objectCh {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(object.Key, backend.objectName(PENDING_PREFIX)), ".json")
+		commentId, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			log.Printf("Unexpected object %v in pending comments, skipping\n", object.Key)
+			continue
+		}
+		res = append(res, commentId)
+	}
+	return res, nil
+}
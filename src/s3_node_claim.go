@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Node ids are leased through objects in S3. Used client has no conditional writes,
+// so lease is written and then read back after a pause, only last writer owns it.
+// NB: it's not guaranteed: replicas started together may both read own lease back,
+// or lease may be overwritten after the check. Such conflict is found by next renew,
+// then the process is stopped, because ids generated with the same node id may be duplicated.
+// Set node_id explicitly for replicas if it's not acceptable
+const (
+	NODES_PREFIX      = "nodes/"
+	NODE_LEASE_TTL    = time.Minute
+	NODE_CLAIM_SETTLE = time.Second
+)
+
+type nodeLease struct {
+	Owner   string `json:"owner"`
+	Expires int64  `json:"expires"` // unix time
+}
+
+func getNodeObjectName(nodeId int64) string {
+	return fmt.Sprintf("%v%v.json", NODES_PREFIX, nodeId)
+}
+
+func GetNodeOwnerName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%v-%v", hostname, GenerateSessionKey()[:8])
+}
+
+// readNodeLease returns nil lease for never claimed node id
+func (backend *S3CommentsBackend) readNodeLease(nodeId int64) (*nodeLease, error) {
+	object, err := backend.minio.GetObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(getNodeObjectName(nodeId)),
+		minio.GetObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("GET", "node_lease").Inc()
+	if err == nil {
+		var objectBytes []byte
+		objectBytes, err = io.ReadAll(object)
+		if err == nil {
+			lease := nodeLease{}
+			err = json.Unmarshal(objectBytes, &lease)
+			return &lease, err
+		}
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, nil
+	}
+	return nil, err
+}
+
+func (backend *S3CommentsBackend) writeNodeLease(nodeId int64, owner string) error {
+	leaseBytes, _ := json.Marshal(nodeLease{
+		Owner:   owner,
+		Expires: time.Now().Add(NODE_LEASE_TTL).Unix(),
+	})
+	_, err := backend.minio.PutObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(getNodeObjectName(nodeId)),
+		bytes.NewReader(leaseBytes),
+		int64(len(leaseBytes)),
+		minio.PutObjectOptions{ContentType: "application/json"},
+	)
+	backend.metricOperations.WithLabelValues("PUT", "node_lease").Inc()
+	return err
+}
+
+// ClaimNodeId finds node id without active lease and takes it for owner
+func (backend *S3CommentsBackend) ClaimNodeId(owner string) (int64, error) {
+	backend.minioLazyInit()
+	for nodeId := int64(0); nodeId <= MAX_NODE_ID; nodeId++ {
+		lease, err := backend.readNodeLease(nodeId)
+		if err != nil {
+			return 0, err
+		}
+		if lease != nil && lease.Owner != owner && lease.Expires > time.Now().Unix() {
+			continue
+		}
+		err = backend.writeNodeLease(nodeId, owner)
+		if err != nil {
+			return 0, err
+		}
+		time.Sleep(NODE_CLAIM_SETTLE)
+		lease, err = backend.readNodeLease(nodeId)
+		if err != nil {
+			return 0, err
+		}
+		if lease != nil && lease.Owner == owner {
+			log.Printf("Claimed node id %v as %v\n", nodeId, owner)
+			return nodeId, nil
+		}
+	}
+	return 0, fmt.Errorf("all %v node ids are claimed", MAX_NODE_ID+1)
+}
+
+func (backend *S3CommentsBackend) RenewNodeId(nodeId int64, owner string) error {
+	backend.minioLazyInit()
+	lease, err := backend.readNodeLease(nodeId)
+	if err != nil {
+		return err
+	}
+	if lease != nil && lease.Owner != owner {
+		return fmt.Errorf("%w: %v owned by %v", ErrNodeIdLost, nodeId, lease.Owner)
+	}
+	return backend.writeNodeLease(nodeId, owner)
+}
+
+// NodeIdKeeper renews lease of node id. Generator is stopped when lease may be lost
+// and restarted after new node id is claimed
+type NodeIdKeeper struct {
+	backend   *S3CommentsBackend
+	generator *SnowflakeIdGenerator
+	nodeId    int64
+	owner     string
+	lastRenew time.Time
+	fail      func(err error) // stops the process, replaced in tests
+	ticker    *time.Ticker
+	stop      chan struct{}
+	stopped   sync.WaitGroup
+}
+
+func NewNodeIdKeeper(backend *S3CommentsBackend, generator *SnowflakeIdGenerator, nodeId int64, owner string) *NodeIdKeeper {
+	keeper := &NodeIdKeeper{
+		backend:   backend,
+		generator: generator,
+		nodeId:    nodeId,
+		owner:     owner,
+		lastRenew: time.Now(),
+		fail: func(err error) {
+			log.Fatalf("Node id is not unique: %v", err.Error())
+		},
+		ticker: time.NewTicker(NODE_LEASE_TTL / 4),
+		stop:   make(chan struct{}),
+	}
+	keeper.stopped.Add(1)
+	go keeper.renewLoop()
+	return keeper
+}
+
+func (keeper *NodeIdKeeper) renewLoop() {
+	defer keeper.stopped.Done()
+	for {
+		select {
+		case <-keeper.ticker.C:
+			keeper.renew()
+		case <-keeper.stop:
+			return
+		}
+	}
+}
+
+// renew extends lease or claims new node id if it is lost
+func (keeper *NodeIdKeeper) renew() {
+	if _, err := keeper.generator.NodeId(); err != nil {
+		keeper.reclaim()
+		return
+	}
+	err := keeper.backend.RenewNodeId(keeper.nodeId, keeper.owner)
+	if err == nil {
+		keeper.lastRenew = time.Now()
+		return
+	}
+	log.Printf("Unable to renew node id %v: %v\n", keeper.nodeId, err.Error())
+	if time.Since(keeper.lastRenew) > NODE_LEASE_TTL-NODE_CLAIM_SETTLE {
+		// lease may be taken by another instance after expiration, new node id is claimed then
+		err = fmt.Errorf("%w: lease of %v is expired", ErrNodeIdLost, keeper.nodeId)
+		keeper.generator.Invalidate(err)
+		return
+	}
+	if errors.Is(err, ErrNodeIdLost) {
+		// another instance claimed the same node id while lease was active
+		keeper.generator.Invalidate(err)
+		keeper.fail(err)
+	}
+}
+
+func (keeper *NodeIdKeeper) reclaim() {
+	// lease is written before settle pause of claim
+	claimStarted := time.Now()
+	nodeId, err := keeper.backend.ClaimNodeId(keeper.owner)
+	if err != nil {
+		log.Printf("Unable to claim new node id: %v\n", err.Error())
+		return
+	}
+	err = keeper.generator.Restart(nodeId)
+	if err != nil {
+		log.Printf("Unable to restart id generator: %v\n", err.Error())
+		return
+	}
+	keeper.nodeId = nodeId
+	keeper.lastRenew = claimStarted
+}
+
+// Close stops renewals, lease expires by itself
+func (keeper *NodeIdKeeper) Close() {
+	keeper.ticker.Stop()
+	close(keeper.stop)
+	keeper.stopped.Wait()
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Page index is append-only: every comment of page is empty object pages/<hash>/<id>,
+// so concurrent writers from any replica never overwrite each other.
+// Old buckets have single pages/<hash>.json with list of ids, it is still read
+// and converted to new layout on first removal or by migrate-pages command,
+// which also writes marker to stop reading of legacy objects.
+// Hash of page depends on page secret, pages of previous secrets are read and updated
+// together with current one until they are moved by rehash-pages command
+const (
+	PAGES_PREFIX                 = "pages/"
+	LEGACY_PAGES_MIGRATED_MARKER = "meta/legacy-pages-migrated"
+	LEGACY_PAGES_CHECK_INTERVAL  = time.Minute
+)
+
+func getPageHash(uri string, secret string) string {
+	return CalculateUserHash(uri, secret)
+}
+
+// pageHashes returns hash of current secret first, then hashes of previous secrets
+func (backend *S3CommentsBackend) pageHashes(uri string) []string {
+	secret := backend.config.PageSecret
+	if secret == "" {
+		secret = DEFAULT_PAGE_SECRET
+	}
+	res := []string{getPageHash(uri, secret)}
+	for _, previous := range backend.config.PreviousPageSecrets {
+		if previous != secret {
+			res = append(res, getPageHash(uri, previous))
+		}
+	}
+	return res
+}
+
+func getLegacyPageObjectName(pageHash string) string {
+	return fmt.Sprintf("%v%v.json", PAGES_PREFIX, pageHash)
+}
+
+func getPagePrefix(pageHash string) string {
+	return fmt.Sprintf("%v%v/", PAGES_PREFIX, pageHash)
+}
+
+func getPageCommentObjectName(pageHash string, commentId int64) string {
+	return fmt.Sprintf("%v%v", getPagePrefix(pageHash), commentId)
+}
+
+// readLegacyPage returns empty list if page has no legacy object
+func (backend *S3CommentsBackend) readLegacyPage(pageHash string) ([]int64, error) {
+	object, err := backend.minio.GetObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(getLegacyPageObjectName(pageHash)),
+		minio.GetObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("GET", "page_comments").Inc()
+	if err == nil {
+		// NB: missing object is reported only on read
+		var objectBytes []byte
+		objectBytes, err = io.ReadAll(object)
+		if err == nil {
+			res := make([]int64, 0)
+			err = json.Unmarshal(objectBytes, &res)
+			if err != nil {
+				log.Printf("Unable to load json with comments for page %v, error: %v\n", pageHash, err.Error())
+			}
+			return res, err
+		}
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return make([]int64, 0), nil
+	}
+	return nil, err
+}
+
+// hasLegacyPages is false after migrate-pages command, until then legacy objects are read.
+// Marker of migration is checked again at most once per LEGACY_PAGES_CHECK_INTERVAL
+func (backend *S3CommentsBackend) hasLegacyPages() bool {
+	backend.legacyPagesMutex.Lock()
+	defer backend.legacyPagesMutex.Unlock()
+	if backend.legacyPagesMigrated {
+		return false
+	}
+	if time.Since(backend.legacyPagesChecked) < LEGACY_PAGES_CHECK_INTERVAL {
+		return true
+	}
+	backend.legacyPagesChecked = time.Now()
+	_, err := backend.minio.StatObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(LEGACY_PAGES_MIGRATED_MARKER),
+		minio.StatObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("HEAD", "page_comments").Inc()
+	if err == nil {
+		log.Printf("Legacy pages are migrated, they are not read anymore\n")
+		backend.legacyPagesMigrated = true
+		return false
+	}
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		log.Printf("Unable to check migration of legacy pages: %v\n", err.Error())
+	}
+	return true
+}
+
+func (backend *S3CommentsBackend) markLegacyPagesMigrated() error {
+	_, err := backend.minio.PutObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(LEGACY_PAGES_MIGRATED_MARKER),
+		bytes.NewReader([]byte{}),
+		0,
+		minio.PutObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("PUT", "page_comments").Inc()
+	if err != nil {
+		return err
+	}
+	backend.legacyPagesMutex.Lock()
+	defer backend.legacyPagesMutex.Unlock()
+	backend.legacyPagesMigrated = true
+	return nil
+}
+
+func (backend *S3CommentsBackend) listPageComments(pageHash string) ([]int64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	prefix := getPagePrefix(pageHash)
+	objectCh := backend.minio.ListObjects(ctx, backend.config.Bucket, minio.ListObjectsOptions{
+		Prefix:    backend.objectName(prefix),
+		Recursive: true,
+	})
+	backend.metricOperations.WithLabelValues("LIST", "page_comments").Inc()
+	res := make([]int64, 0)
+	for object := range objectCh {
+		if object.Err != nil {
+			fmt.Println(object.Err)
+			return nil, object.Err
+		}
+		commentId, err := strconv.ParseInt(strings.TrimPrefix(object.Key, backend.objectName(prefix)), 10, 64)
+		if err != nil {
+			log.Printf("Unexpected object %v in page, skipping\n", object.Key)
+			continue
+		}
+		res = append(res, commentId)
+	}
+	return res, nil
+}
+
+func (backend *S3CommentsBackend) putPageComment(pageHash string, commentId int64) error {
+	_, err := backend.minio.PutObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(getPageCommentObjectName(pageHash, commentId)),
+		bytes.NewReader([]byte{}),
+		0,
+		minio.PutObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("PUT", "page_comments").Inc()
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// readPage returns ids from both layouts of page
+func (backend *S3CommentsBackend) readPage(pageHash string) ([]int64, error) {
+	pageComments, err := backend.listPageComments(pageHash)
+	if err != nil || !backend.hasLegacyPages() {
+		return pageComments, err
+	}
+	legacyComments, err := backend.readLegacyPage(pageHash)
+	if err != nil {
+		return nil, err
+	}
+	return append(legacyComments, pageComments...), nil
+}
+
+func (backend *S3CommentsBackend) GetPageComments(uri string) ([]int64, error) {
+	backend.minioLazyInit()
+	// page may be migrated or rehashed partially, so ids may be in many places
+	uniqueIds := make(map[int64]bool)
+	res := make([]int64, 0)
+	for _, pageHash := range backend.pageHashes(uri) {
+		pageComments, err := backend.readPage(pageHash)
+		if err != nil {
+			return nil, err
+		}
+		for _, commentId := range pageComments {
+			if !uniqueIds[commentId] {
+				uniqueIds[commentId] = true
+				res = append(res, commentId)
+			}
+		}
+	}
+	// listing is sorted as strings, ids are roughly ordered by time
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
+
+func (backend *S3CommentsBackend) AddCommentToPage(uri string, commentId int64) error {
+	backend.minioLazyInit()
+	err := backend.putPageComment(backend.pageHashes(uri)[0], commentId)
+	if err != nil {
+		return err
+	}
+	log.Printf("new comment_id: %v on page: %v\n", commentId, uri)
+	return nil
+}
+
+// migrateLegacyPage moves ids from pages/<hash>.json to separate objects,
+// returns number of moved ids
+func (backend *S3CommentsBackend) migrateLegacyPage(pageHash string) (int, error) {
+	legacyComments, err := backend.readLegacyPage(pageHash)
+	if err != nil || len(legacyComments) == 0 {
+		return 0, err
+	}
+	for _, commentId := range legacyComments {
+		err = backend.putPageComment(pageHash, commentId)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// legacy object is removed only after all ids are copied, so it is safe to retry
+	err = backend.minio.RemoveObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(getLegacyPageObjectName(pageHash)),
+		minio.RemoveObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("DELETE", "page_comments").Inc()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("migrated %v comments of page %v\n", len(legacyComments), pageHash)
+	return len(legacyComments), nil
+}
+
+func (backend *S3CommentsBackend) removePageComment(pageHash string, commentId int64) error {
+	err := backend.minio.RemoveObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(getPageCommentObjectName(pageHash, commentId)),
+		minio.RemoveObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("DELETE", "page_comments").Inc()
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (backend *S3CommentsBackend) RemoveCommentFromPage(uri string, commentId int64) error {
+	backend.minioLazyInit()
+	// comment may be stored under any of secrets
+	for _, pageHash := range backend.pageHashes(uri) {
+		// legacy list can't be modified without lost updates, so it is converted first
+		_, err := backend.migrateLegacyPage(pageHash)
+		if err != nil {
+			log.Printf("Unable to migrate page %v: %v\n", uri, err.Error())
+			return err
+		}
+		err = backend.removePageComment(pageHash, commentId)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("removed comment_id: %v from page: %v\n", commentId, uri)
+	return nil
+}
+
+// MigratePages converts all legacy pages/<hash>.json objects, returns number of pages.
+// After success legacy objects are not read by any instance
+func (backend *S3CommentsBackend) MigratePages() (int, error) {
+	backend.minioLazyInit()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	legacyHashes := make([]string, 0)
+	objectCh := backend.minio.ListObjects(ctx, backend.config.Bucket, minio.ListObjectsOptions{
+		Prefix:    backend.objectName(PAGES_PREFIX),
+		Recursive: false,
+	})
+	backend.metricOperations.WithLabelValues("LIST", "page_comments").Inc()
+	for object := range objectCh {
+		if object.Err != nil {
+			return 0, object.Err
+		}
+		if strings.HasSuffix(object.Key, ".json") {
+			legacyHashes = append(legacyHashes, strings.TrimSuffix(strings.TrimPrefix(object.Key, backend.objectName(PAGES_PREFIX)), ".json"))
+		}
+	}
+
+	for ind, pageHash := range legacyHashes {
+		_, err := backend.migrateLegacyPage(pageHash)
+		if err != nil {
+			return ind, err
+		}
+	}
+	return len(legacyHashes), backend.markLegacyPagesMigrated()
+}
+
+// setCommentUri saves page of comment from old versions, so its page is known to rehash-pages
+func (backend *S3CommentsBackend) setCommentUri(commentId int64, uri string) error {
+	comment, err := backend.GetComment(commentId)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		// removed comment, its id is moved with page anyway
+		return nil
+	}
+	if err != nil || comment.Uri != "" {
+		return err
+	}
+	comment.Uri = uri
+	if err := backend.saveCommentData(comment); err != nil {
+		return err
+	}
+	return backend.writeIndexEntry(comment)
+}
+
+// rehashPage moves ids of page from hashes of previous secrets to current one,
+// returns number of moved ids
+func (backend *S3CommentsBackend) rehashPage(uri string) (int, error) {
+	pageHashes := backend.pageHashes(uri)
+	movedCount := 0
+	for _, previousHash := range pageHashes[1:] {
+		pageComments, err := backend.readPage(previousHash)
+		if err != nil {
+			return movedCount, err
+		}
+		if len(pageComments) == 0 {
+			continue
+		}
+		for _, commentId := range pageComments {
+			if err := backend.putPageComment(pageHashes[0], commentId); err != nil {
+				return movedCount, err
+			}
+			if err := backend.setCommentUri(commentId, uri); err != nil {
+				return movedCount, err
+			}
+		}
+		// old objects are removed only after all ids are copied, so it is safe to retry
+		if _, err := backend.migrateLegacyPage(previousHash); err != nil {
+			return movedCount, err
+		}
+		for _, commentId := range pageComments {
+			if err := backend.removePageComment(previousHash, commentId); err != nil {
+				return movedCount, err
+			}
+		}
+		movedCount += len(pageComments)
+	}
+	return movedCount, nil
+}
+
+// RehashPages moves pages of previous_page_secrets to current page_secret, returns number of pages.
+// Only hashes are stored in S3, so pages are found by uri of comments. Comments of old versions
+// have no uri, so uris of their pages must be passed, uri is saved into moved comments.
+// Error is returned while unknown pages are left.
+// NB: comment removed from page during rehash may be returned back to it
+func (backend *S3CommentsBackend) RehashPages(oldUris []string) (int, error) {
+	backend.minioLazyInit()
+	if len(backend.pageHashes("")) == 1 {
+		return 0, errors.New("no previous page secrets to rehash from")
+	}
+	commentIds, err := backend.ListComments()
+	if err != nil {
+		return 0, err
+	}
+	uris := make(map[string]bool)
+	for _, uri := range oldUris {
+		uris[uri] = true
+	}
+	for _, commentId := range commentIds {
+		comment, err := backend.GetComment(commentId)
+		if err != nil || comment == nil {
+			log.Printf("Unable to load comment %v for rehash\n", commentId)
+			continue
+		}
+		if comment.Uri != "" {
+			uris[comment.Uri] = true
+		}
+	}
+
+	rehashedCount := 0
+	currentHashes := make(map[string]bool, len(uris))
+	for uri := range uris {
+		currentHashes[backend.pageHashes(uri)[0]] = true
+		movedCount, err := backend.rehashPage(uri)
+		if err != nil {
+			return rehashedCount, err
+		}
+		if movedCount > 0 {
+			log.Printf("rehashed %v comments of page %v\n", movedCount, uri)
+			rehashedCount += 1
+		}
+	}
+
+	leftHashes, err := backend.listPageHashes(currentHashes)
+	if err != nil {
+		return rehashedCount, err
+	}
+	for _, pageHash := range leftHashes {
+		log.Printf("page %v%v of unknown uri is left\n", PAGES_PREFIX, pageHash)
+	}
+	if len(leftHashes) > 0 {
+		return rehashedCount, fmt.Errorf(
+			"%v pages of old versions are left, pass their uris to rehash-pages. Keep previous page secrets until then",
+			len(leftHashes),
+		)
+	}
+	return rehashedCount, nil
+}
+
+// listPageHashes returns hashes of stored pages in both layouts except known ones, which are updated
+func (backend *S3CommentsBackend) listPageHashes(known map[string]bool) ([]string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	prefix := backend.objectName(PAGES_PREFIX)
+	objectCh := backend.minio.ListObjects(ctx, backend.config.Bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: false,
+	})
+	backend.metricOperations.WithLabelValues("LIST", "page_comments").Inc()
+	res := make([]string, 0)
+	for object := range objectCh {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		// page prefixes are listed as directories with trailing slash
+		pageHash := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(object.Key, prefix), "/"), ".json")
+		if !known[pageHash] {
+			known[pageHash] = true
+			res = append(res, pageHash)
+		}
+	}
+	return res, nil
+}
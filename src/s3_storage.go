@@ -3,10 +3,12 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"io"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"fmt"
 
@@ -20,6 +22,10 @@ type S3CommentsBackend struct {
 	minio            *minio.Client
 	config           MinioConfig
 	metricOperations *prometheus.CounterVec
+
+	legacyPagesMutex    sync.Mutex
+	legacyPagesMigrated bool
+	legacyPagesChecked  time.Time // last check of migration marker
 }
 
 func createMinioClient(config *MinioConfig) *minio.Client {
@@ -52,23 +58,33 @@ func createMinioClient(config *MinioConfig) *minio.Client {
 	return minioClient
 }
 
+// shared by all backends, so commands and tests may create more than one
+var metricS3Operations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "s3_requests",
+	Help: "Number of S3 requests to comments storage",
+}, []string{"site", "operation", "target"})
+
 func NewS3CommentsStorage(config MinioConfig) (*S3CommentsBackend, error) {
+	return NewSiteS3CommentsStorage(DEFAULT_SITE, config)
+}
+
+func NewSiteS3CommentsStorage(site string, config MinioConfig) (*S3CommentsBackend, error) {
 	return &S3CommentsBackend{
-		minio:  nil,
-		config: config,
-		metricOperations: promauto.NewCounterVec(prometheus.CounterOpts{
-			Name: "s3_requests",
-			Help: "Number of S3 requests to comments storage",
-		}, []string{"operation", "target"}),
+		minio:            nil,
+		config:           config,
+		metricOperations: metricS3Operations.MustCurryWith(prometheus.Labels{"site": site}),
 	}, nil
 }
 
-func getCommetObjectName(commentId int64) string {
-	return fmt.Sprintf("comments/%v.json", commentId)
+// objectName adds key prefix of site, every object of backend must be named with it
+func (backend *S3CommentsBackend) objectName(name string) string {
+	return backend.config.KeyPrefix + name
 }
 
-func getUriObjectName(uri string) string {
-	return fmt.Sprintf("pages/%v.json", CalculateUserHash(uri, "fakeTODO"))
+const COMMENTS_PREFIX = "comments/"
+
+func getCommetObjectName(commentId int64) string {
+	return fmt.Sprintf("%v%v.json", COMMENTS_PREFIX, commentId)
 }
 
 func (backend *S3CommentsBackend) minioLazyInit() {
@@ -80,105 +96,50 @@ func (backend *S3CommentsBackend) minioLazyInit() {
 func (backend *S3CommentsBackend) saveCommentData(commentData *CommentModelOutput) error {
 	backend.minioLazyInit()
 
-	commentBytes, _ := json.Marshal(commentData)
-
-	objectReader := bytes.NewReader(commentBytes)
-
-	uploadInfo, err := backend.minio.PutObject(
-		context.Background(),
-		backend.config.Bucket,
-		getCommetObjectName(commentData.Id),
-		objectReader,
-		int64(len(commentBytes)),
-		minio.PutObjectOptions{ContentType: "application/json"},
-	)
+	commentBytes, err := MarshalCommentRecord(commentData)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
-	backend.metricOperations.WithLabelValues("PUT", "comment_data").Inc()
-	fmt.Println("Successfully uploaded bytes: ", uploadInfo)
-
-	return nil
-}
-
-func (backend *S3CommentsBackend) GetPageComments(uri string) ([]int64, error) {
-	backend.minioLazyInit()
-	object, err := backend.minio.GetObject(
-		context.Background(),
-		backend.config.Bucket,
-		getUriObjectName(uri),
-		minio.GetObjectOptions{},
-	)
-	backend.metricOperations.WithLabelValues("GET", "page_comments").Inc()
-	if err != nil {
-		switch err.(type) {
-		case minio.ErrorResponse:
-			return make([]int64, 0), nil
-		default:
-			fmt.Println(err)
-			return nil, err
-		}
-	}
-	objectBytes, err := io.ReadAll(object)
-	if err != nil {
-		// срабатывает именно этот
-		switch err.(type) {
-		case minio.ErrorResponse:
-			return make([]int64, 0), nil
-		default:
-			fmt.Println(err)
-			return nil, err
-		}
-	}
-
-	res := make([]int64, 0)
-	err = json.Unmarshal(objectBytes, &res)
-	if err != nil {
-		log.Printf("Unable to load json with comments for page %v, error: %v\n", uri, err.Error())
-		return nil, err
-	}
-	return res, nil
-}
-
-func (backend *S3CommentsBackend) AddCommentToPage(uri string, commentId int64) error {
-	backend.minioLazyInit()
-	currentComments, err := backend.GetPageComments(uri)
-	if err != nil {
-		log.Printf("Error %v with loading comments for page %v\n", err.Error(), uri)
-		return errors.New("unable to load comments for page")
-	}
-	currentComments = append(currentComments, commentId)
-	commentBytes, _ := json.Marshal(currentComments)
 
 	objectReader := bytes.NewReader(commentBytes)
 
 	uploadInfo, err := backend.minio.PutObject(
 		context.Background(),
 		backend.config.Bucket,
-		getUriObjectName(uri),
+		backend.objectName(getCommetObjectName(commentData.Id)),
 		objectReader,
 		int64(len(commentBytes)),
 		minio.PutObjectOptions{ContentType: "application/json"},
 	)
-	backend.metricOperations.WithLabelValues("PUT", "page_comments").Inc()
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
+	backend.metricOperations.WithLabelValues("PUT", "comment_data").Inc()
 	fmt.Println("Successfully uploaded bytes: ", uploadInfo)
-	log.Printf("new comment_id: %v on page: %v\n", commentId, uri)
 
 	return nil
 }
 
 func (backend *S3CommentsBackend) AddComment(commentData *CommentModelOutput) (int64, error) {
 	error := backend.saveCommentData(commentData)
+	if error == nil {
+		// NB: comment is saved anyway, missed entry is written by index-comments command
+		if err := backend.putIndexObject(backend.getIndexObjectName(commentData)); err != nil {
+			log.Printf("Unable to index comment %v: %v\n", commentData.Id, err.Error())
+		}
+	}
 	return commentData.Id, error
 }
 
 func (backend *S3CommentsBackend) UpdateComment(commentData *CommentModelOutput) error {
-	_, err := backend.AddComment(commentData)
+	err := backend.saveCommentData(commentData)
+	// index is changed only by deletion, other updates don't cost anything
+	if err == nil && commentData.Mode == MODE_DELETED {
+		if err := backend.writeIndexEntry(commentData); err != nil {
+			log.Printf("Unable to index comment %v: %v\n", commentData.Id, err.Error())
+		}
+	}
 	return err
 }
 
@@ -187,7 +148,7 @@ func (backend *S3CommentsBackend) GetComment(commentId int64) (*CommentModelOutp
 	object, err := backend.minio.GetObject(
 		context.Background(),
 		backend.config.Bucket,
-		getCommetObjectName(int64(commentId)),
+		backend.objectName(getCommetObjectName(int64(commentId))),
 		minio.GetObjectOptions{},
 	)
 	if err != nil {
@@ -200,11 +161,65 @@ func (backend *S3CommentsBackend) GetComment(commentId int64) (*CommentModelOutp
 		fmt.Println(err)
 		return nil, err
 	}
-	res := CommentModelOutput{}
-	err = json.Unmarshal(objectBytes, &res)
+	res, err := UnmarshalCommentRecord(objectBytes)
 	if err != nil {
 		log.Printf("Unable to load json with comment id %v, error: %v\n", commentId, err.Error())
 		return nil, err
 	}
-	return &res, nil
+	return res, nil
+}
+
+func (backend *S3CommentsBackend) DeleteComment(commentId int64) error {
+	backend.minioLazyInit()
+	err := backend.minio.RemoveObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(getCommetObjectName(commentId)),
+		minio.RemoveObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("DELETE", "comment_data").Inc()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	log.Printf("deleted comment_id: %v\n", commentId)
+	if err := backend.removeIndexEntries(commentId); err != nil {
+		log.Printf("Unable to remove comment %v from index: %v\n", commentId, err.Error())
+	}
+	return nil
+}
+
+func (backend *S3CommentsBackend) ListComments() ([]int64, error) {
+	backend.minioLazyInit()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	objectCh := backend.minio.ListObjects(ctx, backend.config.Bucket, minio.ListObjectsOptions{
+		Prefix:    backend.objectName(COMMENTS_PREFIX),
+		Recursive: true,
+	})
+	backend.metricOperations.WithLabelValues("LIST", "comment_data").Inc()
+	res := make([]int64, 0)
+	for object := range objectCh {
+		if object.Err != nil {
+			fmt.Println(object.Err)
+			return nil, object.Err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(object.Key, backend.objectName(COMMENTS_PREFIX)), ".json")
+		commentId, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			log.Printf("Unexpected object %v in comments, skipping\n", object.Key)
+			continue
+		}
+		res = append(res, commentId)
+	}
+	return res, nil
+}
+
+// GetCommentsCounts requests every comment from S3, cache layers count with their own caches
+func (backend *S3CommentsBackend) GetCommentsCounts(uris []string) ([]int, error) {
+	backend.minioLazyInit()
+	return countPages(uris, func(uri string) (int, error) {
+		return countPageComments(backend, uri)
+	})
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// every node writes only its own votes/<comment id>/<node>.json
+const VOTES_PREFIX = "votes/"
+
+func getVotesPrefix(commentId int64) string {
+	return fmt.Sprintf("%v%v/", VOTES_PREFIX, commentId)
+}
+
+func getNodeVotesObjectName(commentId int64, node string) string {
+	return fmt.Sprintf("%v%v.json", getVotesPrefix(commentId), node)
+}
+
+func (backend *S3CommentsBackend) readVotes(objectName string) (*VoteCounts, error) {
+	object, err := backend.minio.GetObject(
+		context.Background(),
+		backend.config.Bucket,
+		objectName,
+		minio.GetObjectOptions{},
+	)
+	backend.metricOperations.WithLabelValues("GET", "votes").Inc()
+	if err == nil {
+		var objectBytes []byte
+		objectBytes, err = io.ReadAll(object)
+		if err == nil {
+			votes := VoteCounts{}
+			err = json.Unmarshal(objectBytes, &votes)
+			return &votes, err
+		}
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, nil
+	}
+	return nil, err
+}
+
+func (backend *S3CommentsBackend) GetNodeVotes(commentId int64, node string) (*VoteCounts, error) {
+	backend.minioLazyInit()
+	return backend.readVotes(backend.objectName(getNodeVotesObjectName(commentId, node)))
+}
+
+func (backend *S3CommentsBackend) SaveNodeVotes(commentId int64, node string, votes VoteCounts) error {
+	backend.minioLazyInit()
+	votesBytes, _ := json.Marshal(votes)
+	_, err := backend.minio.PutObject(
+		context.Background(),
+		backend.config.Bucket,
+		backend.objectName(getNodeVotesObjectName(commentId, node)),
+		bytes.NewReader(votesBytes),
+		int64(len(votesBytes)),
+		minio.PutObjectOptions{ContentType: "application/json"},
+	)
+	backend.metricOperations.WithLabelValues("PUT", "votes").Inc()
+	return err
+}
+
+func (backend *S3CommentsBackend) GetCommentVotes(commentId int64) (*VoteCounts, error) {
+	backend.minioLazyInit()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	objectCh := backend.minio.ListObjects(ctx, backend.config.Bucket, minio.ListObjectsOptions{
+		Prefix:    backend.objectName(getVotesPrefix(commentId)),
+		Recursive: true,
+	})
+	backend.metricOperations.WithLabelValues("LIST", "votes").Inc()
+	var res *VoteCounts = nil
+	for object := range objectCh {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		votes, err := backend.readVotes(object.Key)
+		if err != nil {
+			return nil, err
+		}
+		if votes == nil {
+			continue
+		}
+		if res == nil {
+			res = &VoteCounts{}
+		}
+		*res = res.add(*votes)
+	}
+	return res, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const DEFAULT_SITE = "default" // name of site in single site mode
+const API_KEY_HEADER = "X-Api-Key"
+
+var (
+	metricSiteRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "site_requests",
+		Help: "Number of API requests by site",
+	}, []string{"site", "method", "status"})
+	metricSiteRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "site_request_duration_seconds",
+		Help:    "Duration of API requests by site",
+		Buckets: REQUEST_DURATION_BUCKETS,
+	}, []string{"site"})
+)
+
+// GetSiteConfigs returns configured sites or single default site without selectors
+func (config ApplicationConfig) GetSiteConfigs() []SiteConfig {
+	if len(config.Sites) == 0 {
+		return []SiteConfig{{Name: DEFAULT_SITE}}
+	}
+	return config.Sites
+}
+
+// Apply returns global config with settings of site
+func (site SiteConfig) Apply(config ApplicationConfig) ApplicationConfig {
+	res := config
+	res.Sites = nil
+	if config.Minio != nil {
+		minioConfig := *config.Minio
+		if site.Bucket != "" {
+			minioConfig.Bucket = site.Bucket
+		}
+		minioConfig.KeyPrefix += site.KeyPrefix
+		res.Minio = &minioConfig
+	}
+	if config.Redis != nil && len(config.Sites) > 0 {
+		redisConfig := *config.Redis
+		redisConfig.KeyPrefix += site.Name + ":"
+		res.Redis = &redisConfig
+	}
+	if len(site.CorsOrigins) > 0 {
+		res.Server.CorsOrigins = site.CorsOrigins
+	}
+	if site.HashSecret != "" {
+		res.HashSecret = site.HashSecret
+	}
+	if site.PublicUrl != "" {
+		res.Server.PublicUrl = site.PublicUrl
+	}
+	if site.ModerationKey != "" {
+		res.ModerationKey = site.ModerationKey
+	}
+	if site.OwnerEmails != nil {
+		res.Notify.OwnerEmails = site.OwnerEmails
+	}
+	if site.Policy != nil {
+		res.Policy = *site.Policy
+	}
+	if site.Markup != nil {
+		res.Markup = *site.Markup
+	}
+	return res
+}
+
+func (site SiteConfig) hasSelectors() bool {
+	return len(site.Hosts) > 0 || site.PathPrefix != "" || len(site.ApiKeys) > 0
+}
+
+type siteHandler struct {
+	config  SiteConfig
+	logic   *SimpleCommentsLogic
+	engine  *gin.Engine
+	handler http.Handler // engine without path prefix of site
+}
+
+// SitesRouter passes requests to API of selected site
+type SitesRouter struct {
+	sites       []*siteHandler
+	byApiKey    map[string]*siteHandler
+	byHost      map[string]*siteHandler
+	byPrefix    []*siteHandler // longest prefixes first
+	defaultSite *siteHandler   // site without selectors, may be nil
+	nodeKeeper  *NodeIdKeeper  // shared by all sites, nil for node id from config
+	admin       http.Handler   // console of all sites, nil if disabled
+}
+
+func NewSitesRouter(config ApplicationConfig) *SitesRouter {
+	// node id is claimed once through global storage and shared by all sites
+	globalBackend := getS3Backend(DEFAULT_SITE, config)
+	ids, nodeKeeper := getIdGenerator(config, globalBackend)
+
+	router := &SitesRouter{
+		byApiKey:   make(map[string]*siteHandler),
+		byHost:     make(map[string]*siteHandler),
+		nodeKeeper: nodeKeeper,
+	}
+	for _, siteConfig := range config.GetSiteConfigs() {
+		siteAppConfig := siteConfig.Apply(config)
+		backend := globalBackend
+		if len(config.Sites) > 0 {
+			backend = getS3Backend(siteConfig.Name, siteAppConfig)
+		}
+		logic := newSiteCommentsLogic(siteConfig.Name, siteAppConfig, backend, ids)
+		engine := NewGinApp(siteAppConfig, logic)
+		site := &siteHandler{
+			config:  siteConfig,
+			logic:   logic,
+			engine:  engine,
+			handler: engine,
+		}
+		if siteConfig.PathPrefix != "" {
+			site.handler = http.StripPrefix(siteConfig.PathPrefix, engine)
+			router.byPrefix = append(router.byPrefix, site)
+		}
+		for _, apiKey := range siteConfig.ApiKeys {
+			router.byApiKey[apiKey] = site
+		}
+		for _, host := range siteConfig.Hosts {
+			router.byHost[strings.ToLower(host)] = site
+		}
+		if !siteConfig.hasSelectors() {
+			router.defaultSite = site
+		}
+		router.sites = append(router.sites, site)
+	}
+	sort.SliceStable(router.byPrefix, func(i, j int) bool {
+		return len(router.byPrefix[i].config.PathPrefix) > len(router.byPrefix[j].config.PathPrefix)
+	})
+	if config.Admin.Enabled {
+		adminSites := make([]adminSite, 0, len(router.sites))
+		for _, site := range router.sites {
+			adminSites = append(adminSites, adminSite{name: site.config.Name, logic: site.logic})
+		}
+		router.admin = NewAdminApp(config, adminSites)
+	}
+	return router
+}
+
+func (router *SitesRouter) selectSite(r *http.Request) *siteHandler {
+	if apiKey := r.Header.Get(API_KEY_HEADER); apiKey != "" {
+		// wrong key is error, not request to default site
+		return router.byApiKey[apiKey]
+	}
+	for _, site := range router.byPrefix {
+		prefix := site.config.PathPrefix
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			return site
+		}
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host // without port
+	}
+	if site, exists := router.byHost[strings.ToLower(host)]; exists {
+		return site
+	}
+	return router.defaultSite
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (router *SitesRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == METRICS_PATH {
+		// metrics are shared by all sites
+		router.sites[0].engine.ServeHTTP(w, r)
+		return
+	}
+	// admin area is shared by all sites too
+	if router.admin != nil && (r.URL.Path == ADMIN_PATH || strings.HasPrefix(r.URL.Path, ADMIN_PATH+"/")) {
+		router.admin.ServeHTTP(w, r)
+		return
+	}
+	site := router.selectSite(r)
+	if site == nil {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"unknown site"}`))
+		return
+	}
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	site.handler.ServeHTTP(recorder, r)
+	metricSiteRequests.WithLabelValues(site.config.Name, r.Method, strconv.Itoa(recorder.status)).Inc()
+	metricSiteRequestDuration.WithLabelValues(site.config.Name).Observe(time.Since(start).Seconds())
+}
+
+// Close saves buffered data of all sites
+func (router *SitesRouter) Close() error {
+	var lastErr error = nil
+	for _, site := range router.sites {
+		if err := site.logic.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	if router.nodeKeeper != nil {
+		router.nodeKeeper.Close()
+	}
+	return lastErr
+}
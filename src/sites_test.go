@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestSitesConfig() ApplicationConfig {
+	return ApplicationConfig{
+		Policy: DefaultPolicyConfig(),
+		Sites: []SiteConfig{
+			{Name: "main"},
+			{Name: "blog", Hosts: []string{"Blog.example.com"}},
+			{Name: "docs", PathPrefix: "/docs"},
+			{Name: "api", ApiKeys: []string{"api-key"}},
+		},
+	}
+}
+
+func TestSitesSelection(t *testing.T) {
+	router := NewSitesRouter(getTestSitesConfig())
+	defer router.Close()
+
+	selected := func(host string, path string, apiKey string) string {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Host = host
+		if apiKey != "" {
+			req.Header.Set(API_KEY_HEADER, apiKey)
+		}
+		site := router.selectSite(req)
+		if site == nil {
+			return ""
+		}
+		return site.config.Name
+	}
+	assert.Equal(t, "main", selected("example.com", "/?uri=a", ""))
+	assert.Equal(t, "blog", selected("blog.example.com:8123", "/?uri=a", ""))
+	assert.Equal(t, "docs", selected("blog.example.com", "/docs/?uri=a", ""))
+	assert.Equal(t, "docs", selected("example.com", "/docs", ""))
+	assert.Equal(t, "main", selected("example.com", "/docsy/", ""))
+	assert.Equal(t, "api", selected("blog.example.com", "/docs/", "api-key"))
+	assert.Equal(t, "", selected("example.com", "/", "wrong-key"))
+
+	w := serveRequest(router, "GET", "/count", "", withHost("example.com"), withHeader(API_KEY_HEADER, "wrong-key"))
+	assert.Equal(t, 404, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown site")
+
+	// browsers send api key only when preflight allows it
+	w = serveRequest(
+		router, "OPTIONS", "/count", "", withHost("example.com"),
+		withHeader("Origin", "http://127.0.0.1:8800"),
+		withHeader("Access-Control-Request-Method", "POST"),
+		withHeader("Access-Control-Request-Headers", API_KEY_HEADER),
+	)
+	assert.Equal(t, 204, w.Code)
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), API_KEY_HEADER)
+}
+
+func TestSitesIsolation(t *testing.T) {
+	router := NewSitesRouter(getTestSitesConfig())
+	defer router.Close()
+
+	inputComment := getFakeInputComment()
+	w := serveRequest(router, "POST", "/new?uri=shared", jsonBody(t, inputComment), withHost("blog.example.com"))
+	assert.Equal(t, 201, w.Code)
+	w = serveRequest(router, "POST", "/docs/new?uri=shared", jsonBody(t, inputComment), withHost("example.com"))
+	assert.Equal(t, 201, w.Code)
+	w = serveRequest(router, "POST", "/docs/new?uri=shared", jsonBody(t, inputComment), withHost("example.com"))
+	assert.Equal(t, 201, w.Code)
+
+	counts := func(host string, path string) []int {
+		w := serveRequest(router, "POST", path, jsonBody(t, []string{"shared"}), withHost(host))
+		assert.Equal(t, 200, w.Code)
+		var res []int
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+	assert.Equal(t, []int{1}, counts("blog.example.com", "/count"))
+	assert.Equal(t, []int{2}, counts("example.com", "/docs/count"))
+	assert.Equal(t, []int{0}, counts("example.com", "/count"))
+}
+
+func TestSiteApply(t *testing.T) {
+	config := DefaultApplicationConfig()
+	config.Minio.KeyPrefix = "comments/"
+	sitePolicy := DefaultPolicyConfig()
+	sitePolicy.EditMaxAge = time.Hour
+	config.Sites = []SiteConfig{{
+		Name:        "blog",
+		Bucket:      "blog-bucket",
+		KeyPrefix:   "blog/",
+		CorsOrigins: []string{"https://blog.example.com"},
+		HashSecret:  "blog-secret",
+		Policy:      &sitePolicy,
+	}}
+	applied := config.Sites[0].Apply(config)
+	assert.Equal(t, "blog-bucket", applied.Minio.Bucket)
+	assert.Equal(t, "comments/blog/", applied.Minio.KeyPrefix)
+	assert.Equal(t, "s3-comment:blog:", applied.Redis.KeyPrefix)
+	assert.Equal(t, []string{"https://blog.example.com"}, applied.Server.CorsOrigins)
+	assert.Equal(t, "blog-secret", applied.HashSecret)
+	assert.Equal(t, time.Hour, applied.Policy.EditMaxAge)
+	assert.Nil(t, applied.Sites)
+	// global config is not changed
+	assert.Equal(t, "comments/", config.Minio.KeyPrefix)
+	assert.Equal(t, "s3-comment:", config.Redis.KeyPrefix)
+}
+
+func TestSitesConfig(t *testing.T) {
+	configPath := writeTestFile(t, "config.yaml", `
+policy:
+  require_email: true
+sites:
+  - name: blog
+    hosts: [blog.example.com]
+    api_keys: [blog-api-key]
+    policy:
+      edit_max_age: 1h
+  - name: docs
+    key_prefix: docs/
+`)
+	config, err := LoadConfig(getTestEnv(map[string]string{
+		CONFIG_FILE_ENV:         configPath,
+		"POLICY_REQUIRE_AUTHOR": "true",
+	}))
+	assert.Nil(t, err)
+	assert.Len(t, config.Sites, 2)
+	blogPolicy := config.Sites[0].Policy
+	assert.Equal(t, time.Hour, blogPolicy.EditMaxAge)
+	// missing fields are taken from global policy
+	assert.True(t, blogPolicy.RequireEmail)
+	assert.True(t, blogPolicy.RequireAuthor)
+	assert.Nil(t, config.Sites[1].Policy)
+
+	dump := DumpConfig(config)
+	assert.NotContains(t, dump, "blog-api-key")
+	assert.Equal(t, "blog-api-key", config.Sites[0].ApiKeys[0])
+
+	configPath = writeTestFile(t, "invalid.yaml", `
+sites:
+  - name: Blog
+    hosts: [blog.example.com]
+    key_prefix: blog/
+  - name: docs
+    hosts: [BLOG.example.com]
+    path_prefix: /docs/
+    key_prefix: docs/
+  - name: first
+    key_prefix: docs/
+  - name: second
+`)
+	_, err = LoadConfig(getTestEnv(map[string]string{CONFIG_FILE_ENV: configPath}))
+	configErr, isConfigErr := err.(*ConfigError)
+	assert.True(t, isConfigErr)
+	assert.Len(t, configErr.Problems, 5)
+	for _, problem := range []string{"sites[0].name", "same host", "path_prefix", "same bucket", "only one site"} {
+		assert.Contains(t, err.Error(), problem)
+	}
+}
+
+func TestSitesWithIntegrations(t *testing.T) {
+	if _, exists := os.LookupEnv("TESTS_ENABLE_INTEGRATIONS"); !exists {
+		t.Skipf("TESTS_ENABLE_INTEGRATIONS disabled")
+	}
+	config := ReadConfig()
+	config.Minio.Bucket = "test-sites"
+	config.Redis = nil
+	config.Sites = []SiteConfig{
+		{Name: "blog", Hosts: []string{"blog.example.com"}, KeyPrefix: "blog/"},
+		{Name: "docs", Hosts: []string{"docs.example.com"}, KeyPrefix: "docs/"},
+	}
+	router := NewSitesRouter(config)
+	defer postDeleteS3Bucket(t, *config.Minio)
+	defer router.Close()
+
+	inputComment := getFakeInputComment()
+	w := serveRequest(router, "POST", "/new?uri=shared", jsonBody(t, inputComment), withHost("blog.example.com"))
+	assert.Equal(t, 201, w.Code)
+
+	// every site sees only own objects in shared bucket
+	for _, site := range config.Sites {
+		storage, err := NewSiteS3CommentsStorage(site.Name, *site.Apply(config).Minio)
+		assert.Nil(t, err)
+		ids, err := storage.ListComments()
+		assert.Nil(t, err)
+		if site.Name == "blog" {
+			assert.Len(t, ids, 1)
+		} else {
+			assert.Len(t, ids, 0)
+		}
+	}
+}
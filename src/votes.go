@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Votes are counted by every node separately, so replicas never overwrite each other.
+// Node collects votes in memory and saves its own total for every voted comment
+// once per flush interval, then sum of all nodes is copied into comment for readers
+const LEGACY_VOTES_NODE = "legacy" // likes and dislikes saved in comment by old versions
+
+type VoteCounts struct {
+	Likes    int      `json:"likes"`
+	Dislikes int      `json:"dislikes"`
+	Voters   []string `json:"voters,omitempty"` // sorted hashed client addresses, see HashClientAddress
+}
+
+// add sums counts and merges voters
+func (votes VoteCounts) add(other VoteCounts) VoteCounts {
+	return VoteCounts{
+		Likes:    votes.Likes + other.Likes,
+		Dislikes: votes.Dislikes + other.Dislikes,
+		Voters:   mergeVoters(votes.Voters, other.Voters),
+	}
+}
+
+func (votes VoteCounts) hasVoter(voter string) bool {
+	ind := sort.SearchStrings(votes.Voters, voter)
+	return ind < len(votes.Voters) && votes.Voters[ind] == voter
+}
+
+// mergeVoters returns new sorted list of voters of both, nil if both are empty
+func mergeVoters(voters []string, other []string) []string {
+	if len(voters) == 0 && len(other) == 0 {
+		return nil
+	}
+	res := make([]string, 0, len(voters)+len(other))
+	for len(voters) > 0 || len(other) > 0 {
+		switch {
+		case len(other) == 0 || (len(voters) > 0 && voters[0] < other[0]):
+			res = append(res, voters[0])
+			voters = voters[1:]
+		case len(voters) == 0 || other[0] < voters[0]:
+			res = append(res, other[0])
+			other = other[1:]
+		default:
+			res = append(res, voters[0])
+			voters, other = voters[1:], other[1:]
+		}
+	}
+	return res
+}
+
+func (votes VoteCounts) withoutVoters() VoteCounts {
+	return VoteCounts{Likes: votes.Likes, Dislikes: votes.Dislikes}
+}
+
+func likeModifier(votes *VoteCounts) {
+	votes.Likes += 1
+}
+
+func dislikeModifier(votes *VoteCounts) {
+	votes.Dislikes += 1
+}
+
+type VoteStorageInterface interface {
+	GetNodeVotes(commentId int64, node string) (*VoteCounts, error) // nil if node never voted
+	SaveNodeVotes(commentId int64, node string, votes VoteCounts) error
+	GetCommentVotes(commentId int64) (*VoteCounts, error) // sum of all nodes, nil without votes
+}
+
+// MemoryVoteStorage is used without S3
+type MemoryVoteStorage struct {
+	mutex sync.Mutex
+	votes map[int64]map[string]VoteCounts
+}
+
+func NewMemoryVoteStorage() *MemoryVoteStorage {
+	return &MemoryVoteStorage{
+		votes: make(map[int64]map[string]VoteCounts),
+	}
+}
+
+func (storage *MemoryVoteStorage) GetNodeVotes(commentId int64, node string) (*VoteCounts, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	votes, exists := storage.votes[commentId][node]
+	if !exists {
+		return nil, nil
+	}
+	return &votes, nil
+}
+
+func (storage *MemoryVoteStorage) SaveNodeVotes(commentId int64, node string, votes VoteCounts) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if _, exists := storage.votes[commentId]; !exists {
+		storage.votes[commentId] = make(map[string]VoteCounts)
+	}
+	storage.votes[commentId][node] = votes
+	return nil
+}
+
+func (storage *MemoryVoteStorage) GetCommentVotes(commentId int64) (*VoteCounts, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	nodeVotes, exists := storage.votes[commentId]
+	if !exists {
+		return nil, nil
+	}
+	res := VoteCounts{}
+	for _, votes := range nodeVotes {
+		res = res.add(votes)
+	}
+	return &res, nil
+}
+
+type VoteProcessor struct {
+	mutex         sync.Mutex
+	pending       map[int64]VoteCounts // not flushed votes of this node
+	flushMutex    sync.Mutex
+	nodeTotals    *MemoryCache // comment id -> VoteCounts already saved by this node
+	lastNode      string       // node of nodeTotals, must be used under flushMutex
+	votes         VoteStorageInterface
+	comments      CommentsStorageInterface
+	fresh         CommentsStorageInterface // same comments without caches, may be the same storage
+	getNodeId     func() (int64, error)
+	flushInterval time.Duration // zero to flush every vote immediately
+	stop          chan struct{}
+	stopped       sync.WaitGroup
+}
+
+func NewVoteProcessor(
+	votes VoteStorageInterface,
+	comments CommentsStorageInterface,
+	fresh CommentsStorageInterface,
+	getNodeId func() (int64, error),
+	flushInterval time.Duration,
+) *VoteProcessor {
+	processor := &VoteProcessor{
+		pending:       make(map[int64]VoteCounts),
+		nodeTotals:    NewMemoryCache("node_votes", 100000, 0),
+		votes:         votes,
+		comments:      comments,
+		fresh:         fresh,
+		getNodeId:     getNodeId,
+		flushInterval: flushInterval,
+		stop:          make(chan struct{}),
+	}
+	if flushInterval > 0 {
+		processor.stopped.Add(1)
+		go processor.flushLoop()
+	}
+	return processor
+}
+
+func (processor *VoteProcessor) flushLoop() {
+	defer processor.stopped.Done()
+	ticker := time.NewTicker(processor.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			processor.Flush()
+		case <-processor.stop:
+			return
+		}
+	}
+}
+
+// Close stops periodic flushes and saves all pending votes
+func (processor *VoteProcessor) Close() error {
+	if processor.flushInterval > 0 {
+		close(processor.stop)
+		processor.stopped.Wait()
+	}
+	return processor.Flush()
+}
+
+// Vote returns counts of comment with all known votes, including not flushed yet.
+// Counts are returned for rejected votes too
+func (processor *VoteProcessor) Vote(commentId int64, client ClientInfo, modifier func(*VoteCounts)) (VoteCounts, error) {
+	comment, err := processor.comments.GetComment(commentId)
+	// pending comments are hidden, so they are unknown for voters
+	if comment == nil || err != nil || comment.Mode == MODE_DELETED || comment.Mode == MODE_PENDING {
+		return VoteCounts{}, fmt.Errorf("%w: %v", ErrCommentNotFound, commentId)
+	}
+	counts := VoteCounts{Likes: comment.Likes, Dislikes: comment.Dislikes}
+	votedBefore := false
+	if client.VoterId != "" && comment.Voters.Contains(client.VoterId) {
+		// filter may be wrong, saved voters are exact
+		saved, err := processor.votes.GetCommentVotes(commentId)
+		if err != nil {
+			return VoteCounts{}, err
+		}
+		votedBefore = saved != nil && saved.hasVoter(client.VoterId)
+	}
+
+	processor.mutex.Lock()
+	pending := processor.pending[commentId]
+	if client.isAuthorOf(commentId) || (client.VoterId != "" && client.VoterId == comment.AuthorVoter) {
+		processor.mutex.Unlock()
+		return counts.add(pending).withoutVoters(), fmt.Errorf("%w: %v", ErrSelfVote, commentId)
+	}
+	if client.VoterId != "" {
+		// NB: votes to other nodes are visible here only after their flush
+		if votedBefore || pending.hasVoter(client.VoterId) {
+			processor.mutex.Unlock()
+			return counts.add(pending).withoutVoters(), fmt.Errorf("%w: %v", ErrAlreadyVoted, commentId)
+		}
+		pending.Voters = mergeVoters(pending.Voters, []string{client.VoterId})
+	}
+	modifier(&pending)
+	processor.pending[commentId] = pending
+	processor.mutex.Unlock()
+
+	if processor.flushInterval <= 0 {
+		err = processor.Flush()
+		if err != nil {
+			return VoteCounts{}, err
+		}
+		comment, err = processor.comments.GetComment(commentId)
+		if err != nil {
+			return VoteCounts{}, err
+		}
+		return VoteCounts{Likes: comment.Likes, Dislikes: comment.Dislikes}, nil
+	}
+	return counts.add(pending).withoutVoters(), nil
+}
+
+func (processor *VoteProcessor) restorePending(commentId int64, votes VoteCounts) {
+	processor.mutex.Lock()
+	defer processor.mutex.Unlock()
+	processor.pending[commentId] = processor.pending[commentId].add(votes)
+}
+
+// Flush saves pending votes, failed ones are kept for the next flush
+func (processor *VoteProcessor) Flush() error {
+	processor.flushMutex.Lock()
+	defer processor.flushMutex.Unlock()
+
+	processor.mutex.Lock()
+	batch := processor.pending
+	processor.pending = make(map[int64]VoteCounts)
+	processor.mutex.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	nodeId, err := processor.getNodeId()
+	if err != nil {
+		log.Printf("Unable to flush votes for %v comments: %v\n", len(batch), err.Error())
+		for commentId, votes := range batch {
+			processor.restorePending(commentId, votes)
+		}
+		return err
+	}
+	node := strconv.FormatInt(nodeId, 10)
+	if node != processor.lastNode {
+		// node id was claimed again, totals of previous one are useless
+		processor.nodeTotals.Clear()
+		processor.lastNode = node
+	}
+
+	var lastErr error = nil
+	for commentId, votes := range batch {
+		err := processor.flushComment(commentId, node, votes)
+		if err != nil {
+			log.Printf("Unable to flush votes for comment %v: %v\n", commentId, err.Error())
+			processor.restorePending(commentId, votes)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// getNodeTotal returns saved votes of node, must be called under flushMutex
+func (processor *VoteProcessor) getNodeTotal(commentId int64, node string) (VoteCounts, error) {
+	cached, exists := processor.nodeTotals.Get(getCommentCacheKey(commentId))
+	if exists {
+		return cached.(VoteCounts), nil
+	}
+	saved, err := processor.votes.GetNodeVotes(commentId, node)
+	if err != nil || saved != nil {
+		if saved == nil {
+			return VoteCounts{}, err
+		}
+		return *saved, err
+	}
+
+	// first vote for comment, counts from old versions must be kept
+	allVotes, err := processor.votes.GetCommentVotes(commentId)
+	if err != nil {
+		return VoteCounts{}, err
+	}
+	if allVotes == nil {
+		comment, err := processor.comments.GetComment(commentId)
+		if err != nil {
+			return VoteCounts{}, err
+		}
+		if comment.Likes > 0 || comment.Dislikes > 0 {
+			legacy := VoteCounts{Likes: comment.Likes, Dislikes: comment.Dislikes}
+			err = processor.votes.SaveNodeVotes(commentId, LEGACY_VOTES_NODE, legacy)
+			if err != nil {
+				return VoteCounts{}, err
+			}
+		}
+	}
+	return VoteCounts{}, nil
+}
+
+func (processor *VoteProcessor) flushComment(commentId int64, node string, votes VoteCounts) error {
+	nodeTotal, err := processor.getNodeTotal(commentId, node)
+	if err != nil {
+		return err
+	}
+	nodeTotal = nodeTotal.add(votes)
+	err = processor.votes.SaveNodeVotes(commentId, node, nodeTotal)
+	if err != nil {
+		return err
+	}
+	processor.nodeTotals.Set(getCommentCacheKey(commentId), nodeTotal)
+
+	// votes are saved, so errors below only delay counts in comment until next flush
+	allVotes, err := processor.votes.GetCommentVotes(commentId)
+	if err != nil || allVotes == nil {
+		log.Printf("Unable to load votes of comment %v\n", commentId)
+		return nil
+	}
+	// NB: cached comment may be stale, so edit or deletion from another replica would be reverted
+	comment, err := processor.fresh.GetComment(commentId)
+	if comment == nil || err != nil {
+		log.Printf("Unable to load comment %v for votes update\n", commentId)
+		return nil
+	}
+	if comment.Mode != MODE_PUBLIC {
+		return nil
+	}
+	updated := *comment
+	updated.Likes = allVotes.Likes
+	updated.Dislikes = allVotes.Dislikes
+	updated.Voters = NewVoterFilter(allVotes.Voters)
+	err = processor.comments.UpdateComment(&updated)
+	if err != nil {
+		log.Printf("Unable to save votes in comment %v: %v\n", commentId, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getVoteProcessor(logic *SimpleCommentsLogic, votes VoteStorageInterface, nodeId int64) *VoteProcessor {
+	getNodeId := func() (int64, error) { return nodeId, nil }
+	return NewVoteProcessor(votes, logic.storage, logic.storage, getNodeId, time.Hour)
+}
+
+func TestVotesCoalescing(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	addStoredComment(t, logic, "example.com/thread", 1, nil)
+	votes := NewMemoryVoteStorage()
+	processor := getVoteProcessor(logic, votes, 3)
+
+	for i := 0; i < 3; i++ {
+		_, err := processor.Vote(1, ClientInfo{}, likeModifier)
+		assert.Nil(t, err)
+	}
+	counts, err := processor.Vote(1, ClientInfo{}, dislikeModifier)
+	assert.Nil(t, err)
+	assert.Equal(t, VoteCounts{Likes: 3, Dislikes: 1}, counts)
+
+	// nothing is saved before flush
+	saved, _ := votes.GetCommentVotes(1)
+	assert.Nil(t, saved)
+
+	assert.Nil(t, processor.Close())
+	saved, _ = votes.GetNodeVotes(1, "3")
+	assert.Equal(t, VoteCounts{Likes: 3, Dislikes: 1}, *saved)
+	comment, _ := logic.storage.GetComment(1)
+	assert.Equal(t, 3, comment.Likes)
+	assert.Equal(t, 1, comment.Dislikes)
+
+	_, err = processor.Vote(2, ClientInfo{}, likeModifier)
+	assert.ErrorIs(t, err, ErrCommentNotFound)
+}
+
+func TestVotesFromSeveralNodes(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	addStoredComment(t, logic, "example.com/thread", 1, nil)
+	modifyStoredComment(t, logic, 1, func(comment *CommentModelOutput) {
+		comment.Likes = 5
+	})
+	votes := NewMemoryVoteStorage()
+	first := getVoteProcessor(logic, votes, 1)
+	second := getVoteProcessor(logic, votes, 2)
+
+	first.Vote(1, ClientInfo{}, likeModifier)
+	second.Vote(1, ClientInfo{}, likeModifier)
+	second.Vote(1, ClientInfo{}, dislikeModifier)
+	assert.Nil(t, first.Flush())
+	assert.Nil(t, second.Flush())
+	first.Vote(1, ClientInfo{}, likeModifier)
+	assert.Nil(t, first.Flush())
+
+	// legacy likes saved in comment are kept
+	legacy, _ := votes.GetNodeVotes(1, LEGACY_VOTES_NODE)
+	assert.Equal(t, VoteCounts{Likes: 5}, *legacy)
+	comment, _ := logic.storage.GetComment(1)
+	assert.Equal(t, 8, comment.Likes)
+	assert.Equal(t, 1, comment.Dislikes)
+}
+
+func TestVotesKeptOnFailure(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	addStoredComment(t, logic, "example.com/thread", 1, nil)
+	votes := NewMemoryVoteStorage()
+	var nodeErr error = ErrNodeIdLost
+	processor := NewVoteProcessor(votes, logic.storage, logic.storage, func() (int64, error) {
+		return 1, nodeErr
+	}, time.Hour)
+
+	processor.Vote(1, ClientInfo{}, likeModifier)
+	assert.True(t, errors.Is(processor.Flush(), ErrNodeIdLost))
+	saved, _ := votes.GetCommentVotes(1)
+	assert.Nil(t, saved)
+
+	nodeErr = nil
+	processor.Vote(1, ClientInfo{}, likeModifier)
+	assert.Nil(t, processor.Flush())
+	comment, _ := logic.storage.GetComment(1)
+	assert.Equal(t, 2, comment.Likes)
+}
+
+func TestVotersDeduplication(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	addStoredComment(t, logic, "example.com/thread", 1, nil)
+	modifyStoredComment(t, logic, 1, func(comment *CommentModelOutput) {
+		comment.AuthorVoter = "author"
+	})
+	votes := NewMemoryVoteStorage()
+	first := getVoteProcessor(logic, votes, 1)
+	second := getVoteProcessor(logic, votes, 2)
+
+	_, err := first.Vote(1, ClientInfo{VoterId: "author"}, likeModifier)
+	assert.ErrorIs(t, err, ErrSelfVote)
+	authorCookie := ClientInfo{VoterId: "other", IsAuthorOf: func(int64) bool { return true }}
+	_, err = first.Vote(1, authorCookie, likeModifier)
+	assert.ErrorIs(t, err, ErrSelfVote)
+
+	voter := ClientInfo{VoterId: "voter"}
+	_, err = first.Vote(1, voter, likeModifier)
+	assert.Nil(t, err)
+	counts, err := first.Vote(1, voter, dislikeModifier)
+	assert.ErrorIs(t, err, ErrAlreadyVoted)
+	assert.Equal(t, VoteCounts{Likes: 1}, counts)
+
+	// voters are persisted with comment, so other nodes know them after flush
+	assert.Nil(t, first.Flush())
+	_, err = second.Vote(1, voter, likeModifier)
+	assert.ErrorIs(t, err, ErrAlreadyVoted)
+	comment, _ := logic.storage.GetComment(1)
+	assert.True(t, comment.Voters.Contains("voter"))
+	record, _ := MarshalCommentRecord(comment)
+	restored, _ := UnmarshalCommentRecord(record)
+	assert.True(t, restored.Voters.Contains("voter"))
+	assert.False(t, restored.Voters.Contains("other"))
+	assert.Equal(t, "author", restored.AuthorVoter)
+}
+
+func TestVotesKeepChangesOfOtherReplicas(t *testing.T) {
+	slowBackend, _ := NewMemoryStorageLinked(nil, CacheConfig{})
+	cached, _ := NewMemoryStorageLinked(slowBackend, CacheConfig{})
+	comment := CommentModelOutput{Id: 1, Mode: MODE_PUBLIC, Text: "<p>text</p>", Uri: "example.com/thread"}
+	_, err := cached.AddComment(&comment)
+	assert.Nil(t, err)
+	processor := NewVoteProcessor(NewMemoryVoteStorage(), cached, slowBackend, func() (int64, error) {
+		return 1, nil
+	}, time.Hour)
+
+	// another replica edits comment behind the cache
+	edited := comment
+	edited.Text = "<p>edited</p>"
+	assert.Nil(t, slowBackend.UpdateComment(&edited))
+	processor.Vote(1, ClientInfo{}, likeModifier)
+	assert.Nil(t, processor.Flush())
+	saved, _ := slowBackend.GetComment(1)
+	assert.Equal(t, "<p>edited</p>", saved.Text)
+	assert.Equal(t, 1, saved.Likes)
+
+	// and deletes it, tombstone must not get text back
+	tombstone := edited
+	tombstoneModifier(&tombstone)
+	assert.Nil(t, slowBackend.UpdateComment(&tombstone))
+	processor.Vote(1, ClientInfo{}, likeModifier)
+	assert.Nil(t, processor.Flush())
+	saved, _ = slowBackend.GetComment(1)
+	assert.Equal(t, MODE_DELETED, saved.Mode)
+	assert.Equal(t, "", saved.Text)
+}
+
+func TestVoterFilter(t *testing.T) {
+	var filter VoterFilter
+	assert.False(t, filter.Contains("voter"))
+	filter = NewVoterFilter([]string{"voter"})
+	assert.Len(t, filter, VOTER_FILTER_BYTES)
+	assert.True(t, filter.Contains("voter"))
+	assert.False(t, filter.Contains("other"))
+
+	// size grows with voters, so false positives stay rare
+	voters := make([]string, 1000)
+	for ind := range voters {
+		voters[ind] = fmt.Sprintf("voter-%v", ind)
+	}
+	filter = NewVoterFilter(voters)
+	assert.Len(t, filter, 8*VOTER_FILTER_BYTES)
+	falsePositives := 0
+	for ind := range voters {
+		assert.True(t, filter.Contains(voters[ind]))
+		if filter.Contains(fmt.Sprintf("other-%v", ind)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 20)
+}
+
+func TestVotesOfManyVoters(t *testing.T) {
+	logic := getMemoryCommentsLogic()
+	addStoredComment(t, logic, "example.com/thread", 1, nil)
+	votes := NewMemoryVoteStorage()
+	first := getVoteProcessor(logic, votes, 1)
+	second := getVoteProcessor(logic, votes, 2)
+
+	for ind := 0; ind < 1000; ind++ {
+		processor := first
+		if ind%2 == 1 {
+			processor = second
+		}
+		_, err := processor.Vote(1, ClientInfo{VoterId: fmt.Sprintf("voter-%v", ind)}, likeModifier)
+		assert.Nil(t, err)
+		if ind%100 == 99 {
+			assert.Nil(t, first.Flush())
+			assert.Nil(t, second.Flush())
+		}
+	}
+	comment, _ := logic.storage.GetComment(1)
+	assert.Equal(t, 1000, comment.Likes)
+	saved, _ := votes.GetCommentVotes(1)
+	assert.Len(t, saved.Voters, 1000)
+
+	_, err := second.Vote(1, ClientInfo{VoterId: "voter-0"}, likeModifier)
+	assert.ErrorIs(t, err, ErrAlreadyVoted)
+}